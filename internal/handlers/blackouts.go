@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterBlackoutRoutes registers blackout calendar routes
+func RegisterBlackoutRoutes(r *gin.RouterGroup) {
+	r.GET("", GetBlackoutDates)
+	r.GET("/:id", GetBlackoutDate)
+	r.POST("", CreateBlackoutDate)
+	r.PUT("/:id", UpdateBlackoutDate)
+	r.DELETE("/:id", DeleteBlackoutDate)
+}
+
+// get blackout dates, optionally for a school and date range
+func GetBlackoutDates(c *gin.Context) {
+	var schoolID *int
+	if s := c.Query("schoolId"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid schoolId"})
+			return
+		}
+		schoolID = &id
+	}
+	schoolID, err := blackoutSchoolScope(c, schoolID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	blackouts, err := models.GetBlackoutDates(schoolID, c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, blackouts)
+}
+
+// get blackout date by id
+func GetBlackoutDate(c *gin.Context) {
+	var blackout models.BlackoutDate
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetBlackoutDateByID(&blackout, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// Global blackouts are visible to every school
+	if blackout.SchoolID != nil {
+		if err := validateBlackoutAccess(c, &blackout); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, blackout)
+}
+
+func CreateBlackoutDate(c *gin.Context) {
+	var blackout models.BlackoutDate
+
+	if err := c.ShouldBindJSON(&blackout); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBlackoutDate(&blackout); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBlackoutAccess(c, &blackout); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.CreateBlackoutDate(&blackout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, blackout)
+}
+
+// update blackout date
+func UpdateBlackoutDate(c *gin.Context) {
+	var blackout models.BlackoutDate
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetBlackoutDateByID(&blackout, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBlackoutAccess(c, &blackout); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.BindJSON(&blackout); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBlackoutDate(&blackout); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The school may have been changed by the request
+	if err := validateBlackoutAccess(c, &blackout); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = models.UpdateBlackoutDate(&blackout)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, blackout)
+}
+
+func DeleteBlackoutDate(c *gin.Context) {
+	var blackout models.BlackoutDate
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetBlackoutDateByID(&blackout, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBlackoutAccess(c, &blackout); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = models.DeleteBlackoutDate(&blackout)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, blackout)
+}
+
+func validateBlackoutDate(blackout *models.BlackoutDate) error {
+	if blackout.EndDate == "" {
+		blackout.EndDate = blackout.StartDate
+	}
+	start, err := time.Parse("2006-01-02", blackout.StartDate)
+	if err != nil {
+		return fmt.Errorf("invalid startDate %q", blackout.StartDate)
+	}
+	end, err := time.Parse("2006-01-02", blackout.EndDate)
+	if err != nil {
+		return fmt.Errorf("invalid endDate %q", blackout.EndDate)
+	}
+	if end.Before(start) {
+		return errors.New("endDate is before startDate")
+	}
+	return nil
+}
+
+// Global blackouts are managed by admins, school blackouts also by that school's admins
+func validateBlackoutAccess(c *gin.Context, blackout *models.BlackoutDate) error {
+	if blackout.SchoolID == nil {
+		return util.ValidateRoleJWT(c, "admin")
+	}
+	return util.ValidateRoleJWT(c, "admin", fmt.Sprintf("school_admin:%d", *blackout.SchoolID))
+}
+
+// The school whose blackouts are listed besides global ones. School admins may
+// only ask for their own school, which is the default when they manage one.
+func blackoutSchoolScope(c *gin.Context, schoolID *int) (*int, error) {
+	if schoolID != nil {
+		return schoolID, validateBlackoutAccess(c, &models.BlackoutDate{SchoolID: schoolID})
+	}
+	user := util.CurrentUser(c)
+	if user == nil {
+		return nil, nil
+	}
+	var schoolIDs []int
+	for _, role := range models.ParseRoles(user.Roles) {
+		if role.Role == "admin" {
+			return nil, nil
+		}
+		if role.Role == "school_admin" && role.EntityID != nil {
+			schoolIDs = append(schoolIDs, int(*role.EntityID))
+		}
+	}
+	if len(schoolIDs) == 1 {
+		return &schoolIDs[0], nil
+	}
+	return nil, nil
+}
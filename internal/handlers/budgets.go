@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterBudgetRoutes registers budget routes
+func RegisterBudgetRoutes(r *gin.RouterGroup) {
+	r.GET("", GetBudgets)
+	r.GET("/:id", GetBudget)
+	r.POST("", util.JWTAuth("admin"), CreateBudget)
+	r.PUT("/:id", util.JWTAuth("admin"), UpdateBudget)
+	r.DELETE("/:id", util.JWTAuth("admin"), DeleteBudget)
+}
+
+// get budgets with their spent, committed and remaining amounts. School admins
+// only see the budgets of their school.
+func GetBudgets(c *gin.Context) {
+	var schoolID *int
+	if s := c.Query("schoolId"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid schoolId"})
+			return
+		}
+		schoolID = &id
+	}
+	allowedRoles := []string{"admin"}
+	if schoolID != nil {
+		allowedRoles = append(allowedRoles, fmt.Sprintf("school_admin:%d", *schoolID))
+	}
+	if err := util.ValidateRoleJWT(c, allowedRoles...); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	budgets, err := models.GetBudgets(schoolID, c.Query("fundingSource"), c.Query("on"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range budgets {
+		if err := budgets[i].LoadUsage(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, budgets)
+}
+
+// get budget by id, with its usage
+func GetBudget(c *gin.Context) {
+	var budget models.Budget
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetBudgetByID(&budget, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	allowedRoles := []string{"admin"}
+	if budget.SchoolID != nil {
+		allowedRoles = append(allowedRoles, fmt.Sprintf("school_admin:%d", *budget.SchoolID))
+	}
+	if err := util.ValidateRoleJWT(c, allowedRoles...); err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := budget.LoadUsage(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, budget)
+}
+
+func CreateBudget(c *gin.Context) {
+	var budget models.Budget
+
+	if err := c.ShouldBindJSON(&budget); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateBudget(&budget); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.CreateBudget(&budget); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	budget.LoadUsage()
+
+	c.JSON(http.StatusCreated, budget)
+}
+
+// update budget
+func UpdateBudget(c *gin.Context) {
+	var budget models.Budget
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetBudgetByID(&budget, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.BindJSON(&budget); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	budget.ID = id
+	if err := validateBudget(&budget); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = models.UpdateBudget(&budget)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	budget.LoadUsage()
+	c.JSON(http.StatusOK, budget)
+}
+
+func DeleteBudget(c *gin.Context) {
+	var budget models.Budget
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetBudgetByID(&budget, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = models.DeleteBudget(&budget)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, budget)
+}
+
+func validateBudget(budget *models.Budget) error {
+	start, err := time.Parse("2006-01-02", budget.PeriodStart)
+	if err != nil {
+		return fmt.Errorf("invalid periodStart %q", budget.PeriodStart)
+	}
+	end, err := time.Parse("2006-01-02", budget.PeriodEnd)
+	if err != nil {
+		return fmt.Errorf("invalid periodEnd %q", budget.PeriodEnd)
+	}
+	if end.Before(start) {
+		return errors.New("periodEnd is before periodStart")
+	}
+	if budget.Amount < 0 {
+		return errors.New("amount must not be negative")
+	}
+	return nil
+}
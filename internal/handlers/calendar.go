@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterCalendarRoutes registers the calendar feed routes. Feeds are reached
+// by their secret link, since calendar apps cannot sign in.
+func RegisterCalendarRoutes(r *gin.RouterGroup) {
+	auth := util.JWTAuth("admin", "school_admin", "vendor_admin")
+	r.GET("/feed", auth, GetCalendarFeed)
+	r.POST("/feed/reset", auth, ResetCalendarFeed)
+	r.GET("/:file", GetCalendar)
+}
+
+type calendarFeedResponse struct {
+	URL string `json:"url"`
+}
+
+// get the link to the current user's calendar feed
+func GetCalendarFeed(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	feed, err := models.GetCalendarFeed(uint(currentUser.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, calendarFeedResponse{URL: util.CalendarFeedURL(feed)})
+}
+
+// give the current user's calendar feed a new link, e.g. after the old one was shared
+func ResetCalendarFeed(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	feed, err := models.GetCalendarFeed(uint(currentUser.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.ResetCalendarFeed(feed); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, calendarFeedResponse{URL: util.CalendarFeedURL(feed)})
+}
+
+// get the iCalendar feed of the deliveries the feed's user can see, as /:token.ics
+func GetCalendar(c *gin.Context) {
+	token, ok := strings.CutSuffix(c.Param("file"), ".ics")
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var feed models.CalendarFeed
+	if err := models.GetCalendarFeedByToken(&feed, token); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	deliveries, err := models.GetCalendarDeliveries(feed.User, now)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	deleted, err := models.GetCalendarDeletedDeliveries(feed.User, now)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(util.RenderCalendar(*feed.User, deliveries, deleted, now)))
+}
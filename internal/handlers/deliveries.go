@@ -6,7 +6,6 @@ import (
 	"LindaBen_Phase_1_Project/internal/util"
 	"errors"
 	"fmt"
-	"maps"
 	"net/http"
 	"slices"
 	"strconv"
@@ -20,7 +19,8 @@ import (
 // RegisterDeliveryRoutes registers delivery routes
 func RegisterDeliveryRoutes(r *gin.RouterGroup) {
 	r.GET("", util.JWTAuth("admin", "school_admin", "vendor_admin"), GetDeliveries)
-	r.GET("/:id", GetDelivery)
+	r.GET("/calendar", util.JWTAuth("admin", "school_admin", "vendor_admin"), GetDeliveryCalendar)
+	r.GET("/:id", util.JWTAuth("admin", "school_admin", "vendor_admin"), GetDelivery)
 	r.POST("", CreateDelivery)
 	r.PUT("/:id", UpdateDelivery)
 	r.DELETE("/:id", DeleteDelivery)
@@ -28,6 +28,8 @@ func RegisterDeliveryRoutes(r *gin.RouterGroup) {
 	r.DELETE("/:id/orders/:order_id", RemoveOrderFromDelivery)
 	r.POST("/:delivery_id/notify", util.JWTAuth("admin"), SendDeliveryNotifications)
 	r.GET("/:id/notify/recipients", util.JWTAuth("admin"), GetDeliveryNotificationRecipients)
+	r.GET("/:id/notify/log", util.JWTAuth("admin"), GetDeliveryNotificationLogs)
+	r.GET("/:id/reminders", util.JWTAuth("admin"), GetDeliveryReminderTimeline)
 }
 
 // get all Deliveries
@@ -38,25 +40,51 @@ func GetDeliveries(context *gin.Context) {
 		return
 	}
 
-	// Normalize list params (expects repeated query keys, not comma-separated) and always preload orders
-	normalize := func(vals []string) []string {
-		var out []string
-		for _, v := range vals {
-			v = strings.TrimSpace(v)
-			if v != "" {
-				out = append(out, v)
-			}
-		}
-		return out
-	}
-	filters.Expand = normalize(filters.Expand)
-	filters.Contract = normalize(filters.Contract)
-	filters.PackageType = normalize(filters.PackageType)
-	filters.Status = normalize(filters.Status)
+	// Normalize list params and always preload orders
+	filters.Expand = normalizeListParam(filters.Expand)
+	filters.Contract = normalizeListParam(filters.Contract)
+	filters.PackageType = normalizeListParam(filters.PackageType)
+	filters.Status = normalizeListParam(filters.Status)
 	filters.Expand = append(filters.Expand, "orders")
 
 	// Check if is not admin, but school admin
 	user := util.CurrentUser(context)
+	vendorIDs := scopeDeliveryFilters(user, &filters)
+
+	response, err := models.QueryDeliveries(filters)
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Filter orders for vendor admins
+	filterVendorOrders(response.Data, vendorIDs)
+
+	// Orders are always preloaded, so vendor admins only see the cost of their own orders
+	for i := range response.Data {
+		response.Data[i].Totals = models.ComputeDeliveryTotals(response.Data[i].Orders)
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// Trim the values of a list query param and drop empty ones. Lists are given as
+// repeated query keys, not comma-separated.
+func normalizeListParam(vals []string) []string {
+	var out []string
+	for _, v := range vals {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Limit delivery filters to the schools and vendors of a user who is not an admin.
+// Returns the vendors whose orders a vendor admin who is not also a school admin
+// may see, nil when the user may see every order.
+func scopeDeliveryFilters(user *models.User, filters *models.DeliveryFilterParams) []uint {
 	userRoles := models.ParseRoles(user.Roles)
 
 	adminRoleIdx := slices.IndexFunc(userRoles, func(r models.RoleParsed) bool {
@@ -82,13 +110,6 @@ func GetDeliveries(context *gin.Context) {
 		}
 	}
 
-	response, err := models.QueryDeliveries(filters)
-	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Filter orders for vendor admins
 	if adminRoleIdx == -1 && schoolAdminRoleIdx == -1 && vendorAdminRoleIdx != -1 {
 		vendorIDs := []uint{}
 		for _, role := range userRoles {
@@ -96,25 +117,67 @@ func GetDeliveries(context *gin.Context) {
 				vendorIDs = append(vendorIDs, *role.EntityID)
 			}
 		}
+		return vendorIDs
+	}
+	return nil
+}
 
-		for i := range response.Data {
-			delivery := &response.Data[i]
-
-			filteredOrders := []models.Order{}
-			for _, order := range delivery.Orders {
-				// Check if order's vendor ID is in the list of vendor IDs
-				if order.VendorID != nil && slices.Contains(vendorIDs, uint(*order.VendorID)) {
-					filteredOrders = append(filteredOrders, order)
-				} else {
-					fmt.Println("Excluding order ID:", order.ID, "with VendorID:", order.VendorID)
-				}
+// Keep only the orders of the given vendors, all orders when vendorIDs is nil
+func filterVendorOrders(deliveries []models.Delivery, vendorIDs []uint) {
+	if vendorIDs == nil {
+		return
+	}
+	for i := range deliveries {
+		delivery := &deliveries[i]
+
+		filteredOrders := []models.Order{}
+		for _, order := range delivery.Orders {
+			// Check if order's vendor ID is in the list of vendor IDs
+			if order.VendorID != nil && slices.Contains(vendorIDs, uint(*order.VendorID)) {
+				filteredOrders = append(filteredOrders, order)
 			}
-
-			delivery.Orders = filteredOrders
 		}
+
+		delivery.Orders = filteredOrders
 	}
+}
 
-	context.JSON(http.StatusOK, response)
+// get deliveries between two dates grouped by day or week, with counts by status
+// and package type, for month and week views
+func GetDeliveryCalendar(context *gin.Context) {
+	var params models.DeliveryCalendarParams
+	if err := context.ShouldBindQuery(&params); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := util.CurrentUser(context)
+	if user == nil {
+		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	params.Contract = normalizeListParam(params.Contract)
+	params.PackageType = normalizeListParam(params.PackageType)
+	params.Status = normalizeListParam(params.Status)
+	vendorIDs := scopeDeliveryFilters(user, &params.DeliveryFilterParams)
+
+	calendar, err := models.QueryDeliveryCalendar(params)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCalendarRange) {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range calendar.Buckets {
+		bucket := &calendar.Buckets[i]
+		filterVendorOrders(bucket.Deliveries, vendorIDs)
+		for j := range bucket.Deliveries {
+			bucket.Deliveries[j].Totals = models.ComputeDeliveryTotals(bucket.Deliveries[j].Orders)
+		}
+	}
+	context.JSON(http.StatusOK, calendar)
 }
 
 // get delivery by id
@@ -127,8 +190,16 @@ func GetDelivery(context *gin.Context) {
 		expand = e
 	}
 
+	user := util.CurrentUser(context)
+	if user == nil {
+		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	// Orders are always loaded, totals are computed over those the user may see
 	var delivery models.Delivery
-	query := db.Db.Model(&models.Delivery{})
+	query := db.Db.Model(&models.Delivery{}).Preload("Orders")
+	expandOrders := false
 
 	// Preload associated data if requested
 	for _, field := range expand {
@@ -137,6 +208,7 @@ func GetDelivery(context *gin.Context) {
 			query = query.Preload("School")
 		case "orders":
 			query = query.Preload("Orders.Vendor")
+			expandOrders = true
 		}
 	}
 
@@ -150,20 +222,121 @@ func GetDelivery(context *gin.Context) {
 		return
 	}
 
+	// Same scope as the delivery list, deliveries outside it are not found
+	var filters models.DeliveryFilterParams
+	vendorIDs := scopeDeliveryFilters(user, &filters)
+	if len(filters.SchoolID) > 0 && (delivery.SchoolID == nil || !slices.Contains(filters.SchoolID, uint(*delivery.SchoolID))) {
+		context.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if len(filters.VendorID) > 0 && !slices.ContainsFunc(delivery.Orders, func(order models.Order) bool {
+		return order.VendorID != nil && slices.Contains(filters.VendorID, uint(*order.VendorID))
+	}) {
+		context.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	deliveries := []models.Delivery{delivery}
+	filterVendorOrders(deliveries, vendorIDs)
+	delivery = deliveries[0]
+	delivery.Totals = models.ComputeDeliveryTotals(delivery.Orders)
+	if !expandOrders {
+		delivery.Orders = nil
+	}
+
 	context.JSON(http.StatusOK, delivery)
 }
 
+type DeliveryNotificationRequest struct {
+	Note     string   `json:"note"`
+	Channels []string `json:"channels"` // email, sms; all configured channels when empty
+}
+
+// queue a notification about the delivery to its school and vendor admins,
+// the outbox worker sends it and records each send
 func SendDeliveryNotifications(context *gin.Context) {
-	context.JSON(http.StatusCreated, gin.H{"message": "Notifications sent (mock)."})
+	id, _ := strconv.Atoi(context.Param("delivery_id"))
+
+	var input DeliveryNotificationRequest
+	if context.Request.ContentLength != 0 {
+		if err := context.ShouldBindJSON(&input); err != nil {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var delivery models.Delivery
+	if err := models.GetDeliveryByID(&delivery, uint(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			context.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := util.DefaultNotifier().CheckChannels(input.Channels); err != nil {
+		if errors.Is(err, util.ErrNoNotificationChannels) {
+			context.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var sentByID *uint
+	if currentUser := util.CurrentUser(context); currentUser != nil {
+		userID := uint(currentUser.ID)
+		sentByID = &userID
+	}
+
+	message, err := models.QueueDeliveryNotification(delivery.ID, strings.TrimSpace(input.Note), input.Channels, sentByID)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusAccepted, message)
 }
 
 func GetDeliveryNotificationRecipients(context *gin.Context) {
 	id, _ := strconv.Atoi(context.Param("id"))
 
+	delivery, ok := loadNotificationDelivery(context, id)
+	if !ok {
+		return
+	}
+
+	recipients, err := models.GetDeliveryRecipients(&delivery)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, recipients)
+}
+
+// dry run of the delivery's reminders: when each goes out, to whom and on which channels
+func GetDeliveryReminderTimeline(context *gin.Context) {
+	id, _ := strconv.Atoi(context.Param("id"))
+
+	delivery, ok := loadNotificationDelivery(context, id)
+	if !ok {
+		return
+	}
+
+	timeline, err := util.DefaultNotifier().PreviewReminders(&delivery, time.Now())
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, timeline)
+}
+
+// get the notifications sent about the delivery, newest first
+func GetDeliveryNotificationLogs(context *gin.Context) {
+	id, _ := strconv.Atoi(context.Param("id"))
+
 	var delivery models.Delivery
-	query := db.Db.Preload("School").Preload("Orders.Vendor").Model(&models.Delivery{})
-	// Get delivery by ID
-	if err := query.First(&delivery, id).Error; err != nil {
+	if err := models.GetDeliveryByID(&delivery, uint(id)); err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			context.AbortWithStatus(http.StatusNotFound)
 			return
@@ -172,29 +345,26 @@ func GetDeliveryNotificationRecipients(context *gin.Context) {
 		return
 	}
 
-	userMap := make(map[int]models.User)
-
-	// school admins
-	if delivery.School != nil {
-		if schoolAdmins, _ := models.GetUsersByRole(fmt.Sprintf("school_admin:%d", delivery.School.ID)); schoolAdmins != nil {
-			for _, user := range *schoolAdmins {
-				userMap[user.ID] = user
-			}
-		}
+	var logs []models.NotificationLog
+	if err := models.GetDeliveryNotificationLogs(&logs, delivery.ID); err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	context.JSON(http.StatusOK, logs)
+}
 
-	// all orders' vendor contacts
-	for _, order := range delivery.Orders {
-		if order.Vendor != nil {
-			if vendorAdmins, _ := models.GetUsersByRole(fmt.Sprintf("vendor_admin:%d", order.Vendor.ID)); vendorAdmins != nil {
-				for _, user := range *vendorAdmins {
-					userMap[user.ID] = user
-				}
-			}
+// load a delivery with what notifications are rendered from, aborting when it is missing
+func loadNotificationDelivery(context *gin.Context, id int) (models.Delivery, bool) {
+	var delivery models.Delivery
+	if err := models.GetDeliveryForNotification(&delivery, id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			context.AbortWithStatus(http.StatusNotFound)
+			return delivery, false
 		}
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return delivery, false
 	}
-
-	context.JSON(http.StatusOK, slices.Collect(maps.Values(userMap)))
+	return delivery, true
 }
 
 // update delivery
@@ -276,16 +446,41 @@ func UpdateDelivery(c *gin.Context) {
 		addLog("schoolId", oldSchool, newSchool)
 	}
 
-	// Save Logs
-	if len(logs) > 0 {
-		db.Db.Create(&logs)
+	// Validate the new date or school against blackouts and receiving hours
+	if oldTime != newTime || oldSchool != newSchool {
+		overridden, ok := checkDeliveryDate(c, &delivery)
+		if !ok {
+			return
+		}
+		if len(overridden) > 0 {
+			addLog("scheduledAtOverride", "", describeDateConflicts(overridden))
+		}
+	}
+
+	// Keep the generator from overwriting an individually edited occurrence
+	if len(logs) > 0 && delivery.ScheduleID != nil {
+		delivery.ScheduleDetached = true
 	}
 
-	err = models.UpdateDelivery(&delivery)
+	// Save the delivery with its logs
+	err = models.UpdateDeliveryWithLogs(&delivery, logs)
 	if err != nil {
+		if abortVendorCapacityError(c, err) {
+			return
+		}
+		if isFulfillmentError(err) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
+	deliveries := []models.Delivery{delivery}
+	if err := models.LoadDeliveryTotals(deliveries); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	delivery.Totals = deliveries[0].Totals
 	c.JSON(http.StatusOK, delivery)
 }
 
@@ -321,12 +516,92 @@ func CreateDelivery(c *gin.Context) {
 		return
 	}
 
-	if err := models.CreateDelivery(&delivery); err != nil {
+	// Defaults are applied before the date check so the drop-off time is validated
+	if err := models.ApplySchoolDefaults(&delivery); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	overridden, ok := checkDeliveryDate(c, &delivery)
+	if !ok {
+		return
+	}
+
+	// The overridden conflicts are recorded with the delivery, see UpdateDelivery
+	var logs []models.DeliveryChangeLog
+	if len(overridden) > 0 {
+		changeLog := models.DeliveryChangeLog{
+			ChangedAt: time.Now(),
+			FieldName: "scheduledAtOverride",
+			NewValue:  describeDateConflicts(overridden),
+		}
+		if currentUser := util.CurrentUser(c); currentUser != nil {
+			changeLog.ChangeByUserID = uint(currentUser.ID)
+		}
+		logs = append(logs, changeLog)
+	}
+
+	if err := models.CreateDeliveryWithLogs(&delivery, logs); err != nil {
+		if abortVendorCapacityError(c, err) {
+			return
+		}
+		if errors.Is(err, models.ErrInvalidOrderStatus) || isFulfillmentError(err) || errors.Is(err, models.ErrUnknownItem) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
 
+	// Orders are created with the delivery, so the totals include list prices applied on save
+	delivery.Totals = models.ComputeDeliveryTotals(delivery.Orders)
+	warnings, err := models.CheckDeliveryBudgets(&delivery)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	delivery.BudgetWarnings = warnings
+
 	c.JSON(http.StatusCreated, delivery)
 }
+
+// Check the scheduled date of a delivery. Blocking conflicts are rejected unless the
+// request passes override=true, in which case they are returned so they can be logged.
+// Every conflict found is attached to the delivery. Returns false if the request was aborted.
+func checkDeliveryDate(c *gin.Context, delivery *models.Delivery) ([]models.DateConflict, bool) {
+	conflicts, err := models.CheckDeliveryDate(delivery.SchoolID, delivery.ScheduledAt)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	delivery.DateConflicts = conflicts
+
+	var blocking []models.DateConflict
+	for _, conflict := range conflicts {
+		if conflict.Blocking {
+			blocking = append(blocking, conflict)
+		}
+	}
+	if len(blocking) == 0 {
+		return nil, true
+	}
+
+	if override, _ := strconv.ParseBool(c.Query("override")); !override {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+			"error":     "scheduled date conflicts with the blackout calendar, retry with override=true to schedule anyway",
+			"conflicts": conflicts,
+		})
+		return nil, false
+	}
+	return blocking, true
+}
+
+func describeDateConflicts(conflicts []models.DateConflict) string {
+	var messages []string
+	for _, conflict := range conflicts {
+		messages = append(messages, conflict.Message)
+	}
+	return strings.Join(messages, "; ")
+}
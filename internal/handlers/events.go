@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/util"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long browsers wait before reconnecting a dropped stream, in milliseconds
+const streamRetryMs = 3000
+
+// RegisterEventRoutes registers the live stream of delivery and order changes
+func RegisterEventRoutes(r *gin.RouterGroup) {
+	r.GET("/stream", streamToken, util.JWTAuth("admin", "school_admin", "vendor_admin"), StreamEvents)
+}
+
+// EventSource cannot set headers, so browsers may pass the token as ?access_token=
+func streamToken(c *gin.Context) {
+	if token := c.Query("access_token"); token != "" && c.GetHeader("Authorization") == "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	c.Next()
+}
+
+// stream the delivery and order changes the user may see as server-sent events,
+// resuming after the Last-Event-ID header (or lastEventId query) when reconnecting
+func StreamEvents(c *gin.Context) {
+	user := util.CurrentUser(c)
+	if user == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var lastEventID *uint64
+	last := c.GetHeader("Last-Event-ID")
+	if last == "" {
+		last = c.Query("lastEventId")
+	}
+	if last != "" {
+		id, err := strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+		lastEventID = &id
+	}
+
+	broker := util.DefaultEventBroker()
+	subscription, missed, reset := broker.Subscribe(user, lastEventID)
+	defer subscription.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetryMs)
+	if reset {
+		// The missed events are gone, the client should reload what it shows
+		fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", broker.LastEventID())
+	}
+	for _, event := range missed {
+		writeStreamEvent(c, &event)
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(util.EventsHeartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-subscription.Events:
+			if !ok {
+				// Dropped for falling behind, the client reconnects and resumes
+				return
+			}
+			writeStreamEvent(c, &event)
+			w.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			w.Flush()
+		}
+	}
+}
+
+func writeStreamEvent(c *gin.Context, event *util.StreamEvent) {
+	fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
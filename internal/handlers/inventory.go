@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Days ahead the shortfall report looks without a horizon
+const defaultShortfallDays = 30
+
+// RegisterInventoryRoutes registers warehouse inventory routes
+func RegisterInventoryRoutes(r *gin.RouterGroup) {
+	r.GET("", GetInventoryLevels)
+	r.GET("/low-stock", GetLowStockLevels)
+	r.GET("/shortfall", GetInventoryShortfall)
+	r.GET("/transactions", GetInventoryTransactions)
+	r.GET("/reservations", GetInventoryReservations)
+	r.POST("/receipts", CreateInventoryReceipt)
+	r.POST("/adjustments", CreateInventoryAdjustment)
+}
+
+// get the warehouse stock of every catalog item
+func GetInventoryLevels(c *gin.Context) {
+	levels, err := models.GetInventoryLevels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, levels)
+}
+
+// get the items whose available stock is below their reorder level
+func GetLowStockLevels(c *gin.Context) {
+	levels, err := models.GetLowStockLevels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, levels)
+}
+
+// project stock over the internal orders of deliveries up to a day, inclusive
+func GetInventoryShortfall(c *gin.Context) {
+	today := time.Now().In(time.Local)
+	until := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, defaultShortfallDays+1)
+	if to := c.Query("to"); to != "" {
+		day, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid to %q", to)})
+			return
+		}
+		until = day.AddDate(0, 0, 1)
+	}
+
+	shortfalls, err := models.GetInventoryShortfall(until)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, shortfalls)
+}
+
+// get the inventory ledger, optionally of one item
+func GetInventoryTransactions(c *gin.Context) {
+	itemID, ok := inventoryItemQuery(c)
+	if !ok {
+		return
+	}
+	transactions, err := models.GetInventoryTransactions(itemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, transactions)
+}
+
+// get the stock held for confirmed internal orders, optionally of one item
+func GetInventoryReservations(c *gin.Context) {
+	itemID, ok := inventoryItemQuery(c)
+	if !ok {
+		return
+	}
+	reservations, err := models.GetInventoryReservations(itemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reservations)
+}
+
+type InventoryTransactionRequest struct {
+	ItemID    int    `json:"itemId" binding:"required"`
+	Quantity  int    `json:"quantity" binding:"required"`
+	Reference string `json:"reference"`
+	Notes     string `json:"notes"`
+}
+
+// record stock received into the warehouse
+func CreateInventoryReceipt(c *gin.Context) {
+	createInventoryTransaction(c, models.InventoryReceipt)
+}
+
+// record a stock correction, negative quantities take stock out
+func CreateInventoryAdjustment(c *gin.Context) {
+	createInventoryTransaction(c, models.InventoryAdjustment)
+}
+
+func createInventoryTransaction(c *gin.Context, transactionType string) {
+	var input InventoryTransactionRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if transactionType == models.InventoryAdjustment && input.Notes == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "notes are required for adjustments"})
+		return
+	}
+
+	entry := models.InventoryTransaction{
+		ItemID:    input.ItemID,
+		Type:      transactionType,
+		Quantity:  input.Quantity,
+		Reference: input.Reference,
+		Notes:     input.Notes,
+	}
+	if currentUser := util.CurrentUser(c); currentUser != nil {
+		userID := uint(currentUser.ID)
+		entry.UserID = &userID
+	}
+
+	if err := models.RecordInventoryTransaction(&entry); err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		case errors.Is(err, models.ErrInvalidInventoryTransaction):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, entry)
+}
+
+func inventoryItemQuery(c *gin.Context) (*int, bool) {
+	s := c.Query("itemId")
+	if s == "" {
+		return nil, true
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid itemId"})
+		return nil, false
+	}
+	return &id, true
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Invoice routes are nested under a vendor and registered by RegisterVendorRoutes
+
+type InvoiceRequest struct {
+	Number          string               `json:"number" binding:"required"`
+	PurchaseOrderID *int                 `json:"purchaseOrderId"`
+	InvoiceDate     string               `json:"invoiceDate"`
+	DueDate         string               `json:"dueDate"`
+	Lines           []models.InvoiceLine `json:"lines" binding:"required"`
+	Notes           string               `json:"notes"`
+}
+
+// get the invoices of a vendor, optionally filtered by status
+func GetVendorInvoices(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	invoices, err := models.GetVendorInvoices(id, c.QueryArray("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, invoices)
+}
+
+// get an invoice with its reconciled lines
+func GetInvoice(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+// submit a vendor invoice, it is matched against the orders right away
+func CreateInvoice(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	var vendor models.Vendor
+	err := models.GetVendorByID(&vendor, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var input InvoiceRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	invoice := models.Invoice{VendorID: vendor.ID}
+	applyInvoiceRequest(&invoice, &input)
+	if err := validateInvoice(&invoice); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if currentUser := util.CurrentUser(c); currentUser != nil {
+		invoice.SubmittedByUserID = uint(currentUser.ID)
+	}
+
+	if err := models.CreateInvoice(&invoice); err != nil {
+		abortInvoiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, invoice)
+}
+
+// correct an invoice that is submitted or disputed, it is matched again
+func UpdateInvoice(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+
+	var input InvoiceRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applyInvoiceRequest(&invoice, &input)
+	if err := validateInvoice(&invoice); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.UpdateInvoice(&invoice); err != nil {
+		abortInvoiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+// attach the invoice document, e.g. the vendor's PDF
+func UploadInvoiceFile(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+	if !invoice.Editable() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": models.ErrInvoiceLocked.Error()})
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	file, err := CreateFileFromUpload(fileHeader)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.SetInvoiceFile(&invoice, file); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+// match an invoice against its orders again, e.g. after deliveries were completed
+func ReconcileInvoice(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+	if err := models.ReconcileInvoice(&invoice); err != nil {
+		abortInvoiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+type ApproveInvoiceRequest struct {
+	Force bool `json:"force"` // approve even though lines do not match
+}
+
+// approve an invoice for payment
+func ApproveInvoice(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+
+	var input ApproveInvoiceRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	currentUser := util.CurrentUser(c)
+	if err := models.ApproveInvoice(&invoice, input.Force, uint(currentUser.ID)); err != nil {
+		if errors.Is(err, models.ErrInvoiceMismatch) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error(), "lines": invoice.Lines})
+			return
+		}
+		abortInvoiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+type DisputeInvoiceRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// dispute an invoice, the vendor can then correct it
+func DisputeInvoice(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+
+	var input DisputeInvoiceRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.DisputeInvoice(&invoice, input.Reason); err != nil {
+		abortInvoiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+type PayInvoiceRequest struct {
+	Reference string `json:"reference"` // e.g. cheque or transfer number
+}
+
+// mark an approved invoice as paid
+func PayInvoice(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+
+	var input PayInvoiceRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := models.PayInvoice(&invoice, input.Reference); err != nil {
+		abortInvoiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+func DeleteInvoice(c *gin.Context) {
+	var invoice models.Invoice
+	if !loadVendorInvoice(c, &invoice) {
+		return
+	}
+	if err := models.DeleteInvoice(&invoice); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, invoice)
+}
+
+// Load the invoice of the route's vendor, aborting when the user may not see it
+// or it belongs to another vendor
+func loadVendorInvoice(c *gin.Context, invoice *models.Invoice) bool {
+	id, _ := strconv.Atoi(c.Param("id"))
+	invoiceID, _ := strconv.Atoi(c.Param("invoiceId"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+
+	err := models.GetInvoiceByID(invoice, uint(invoiceID))
+	if err != nil || invoice.VendorID != id {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return false
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func applyInvoiceRequest(invoice *models.Invoice, input *InvoiceRequest) {
+	invoice.Number = input.Number
+	invoice.PurchaseOrderID = input.PurchaseOrderID
+	invoice.InvoiceDate = input.InvoiceDate
+	invoice.DueDate = input.DueDate
+	invoice.Lines = input.Lines
+	invoice.Notes = input.Notes
+}
+
+func validateInvoice(invoice *models.Invoice) error {
+	for _, date := range []string{invoice.InvoiceDate, invoice.DueDate} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return fmt.Errorf("invalid date %q", date)
+		}
+	}
+	if len(invoice.Lines) == 0 {
+		return errors.New("invoice has no lines")
+	}
+	for i, line := range invoice.Lines {
+		if line.Quantity <= 0 {
+			return fmt.Errorf("line %d: quantity must be positive", i+1)
+		}
+		if line.UnitCost < 0 {
+			return fmt.Errorf("line %d: unitPrice must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+func abortInvoiceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrDuplicateInvoiceNumber),
+		errors.Is(err, models.ErrInvoiceLocked),
+		errors.Is(err, models.ErrInvalidInvoiceTransition):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/db"
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterItemRoutes registers item catalog routes
+func RegisterItemRoutes(r *gin.RouterGroup) {
+	r.GET("", util.JWTAuth("admin", "school_admin", "vendor_admin"), GetItems)
+	r.GET("/:id", util.JWTAuth("admin", "school_admin", "vendor_admin"), GetItem)
+	r.POST("", util.JWTAuth("admin"), CreateItem)
+	r.PUT("/:id", util.JWTAuth("admin"), UpdateItem)
+	r.DELETE("/:id", util.JWTAuth("admin"), DeleteItem)
+
+	r.GET("/mappings", util.JWTAuth("admin"), GetItemMappings)
+	r.POST("/mappings/scan", util.JWTAuth("admin"), ScanItemMappings)
+	r.POST("/mappings/:id/approve", util.JWTAuth("admin"), ApproveItemMapping)
+	r.POST("/mappings/:id/reject", util.JWTAuth("admin"), RejectItemMapping)
+}
+
+// search the item catalog
+func GetItems(c *gin.Context) {
+	var filters models.ItemFilterParams
+	if err := c.ShouldBindQuery(&filters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := models.QueryItems(filters)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// get item by id
+func GetItem(c *gin.Context) {
+	var item models.Item
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetItemByID(&item, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, item)
+}
+
+func CreateItem(c *gin.Context) {
+	var item models.Item
+
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if item.SKU == "" || item.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sku and name are required"})
+		return
+	}
+
+	if err := models.CreateItem(&item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, item)
+}
+
+// update item
+func UpdateItem(c *gin.Context) {
+	var item models.Item
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetItemByID(&item, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.BindJSON(&item); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = models.UpdateItem(&item)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, item)
+}
+
+func DeleteItem(c *gin.Context) {
+	var item models.Item
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetItemByID(&item, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = models.DeleteItem(&item)
+	if errors.Is(err, models.ErrItemInUse) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, item)
+}
+
+// get item mappings awaiting or after review
+func GetItemMappings(c *gin.Context) {
+	var mappings []models.ItemMapping
+	query := db.Db.Preload("SuggestedItem").Preload("Item").Order("order_count desc")
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Find(&mappings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, mappings)
+}
+
+// collect unmapped free-text order items into mappings for review
+func ScanItemMappings(c *gin.Context) {
+	created, err := models.ScanItemMappings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"created": created})
+}
+
+type ApproveItemMappingRequest struct {
+	// Defaults to the suggested item
+	ItemID *int `json:"itemId"`
+}
+
+// approve a mapping and link its orders to the catalog item
+func ApproveItemMapping(c *gin.Context) {
+	var mapping models.ItemMapping
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := db.Db.First(&mapping, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var input ApproveItemMappingRequest
+	if err := c.ShouldBindJSON(&input); err != nil && c.Request.ContentLength > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	itemID := input.ItemID
+	if itemID == nil {
+		itemID = mapping.SuggestedItemID
+	}
+	if itemID == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "itemId is required when there is no suggestion"})
+		return
+	}
+
+	currentUser := util.CurrentUser(c)
+	updated, err := models.ApproveItemMapping(&mapping, *itemID, uint(currentUser.ID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "item not found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mapping": mapping, "ordersUpdated": updated})
+}
+
+// reject a mapping, its orders keep their free text
+func RejectItemMapping(c *gin.Context) {
+	var mapping models.ItemMapping
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	if err := db.Db.First(&mapping, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	currentUser := util.CurrentUser(c)
+	if err := models.RejectItemMapping(&mapping, uint(currentUser.ID)); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, mapping)
+}
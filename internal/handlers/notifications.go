@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterNotificationRoutes registers the current user's notification routes
+func RegisterNotificationRoutes(r *gin.RouterGroup) {
+	r.GET("", GetNotifications)
+	r.GET("/unread-count", GetUnreadNotificationCount)
+	r.POST("/read-all", MarkAllNotificationsRead)
+	r.POST("/:id/read", MarkNotificationRead)
+	r.GET("/preferences", GetNotificationPreferences)
+	r.PUT("/preferences", UpdateNotificationPreferences)
+	r.GET("/digest", GetDigestSubscription)
+	r.PUT("/digest", UpdateDigestSubscription)
+	r.GET("/digest/preview", PreviewDigest)
+}
+
+// RegisterDigestRoutes registers the public digest routes, reached from links in digest emails
+func RegisterDigestRoutes(r *gin.RouterGroup) {
+	r.GET("/unsubscribe", ConfirmUnsubscribeDigest)
+	r.POST("/unsubscribe", UnsubscribeDigest)
+}
+
+// get the current user's in-app notifications, newest first
+func GetNotifications(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var filters models.NotificationFilterParams
+	if err := c.ShouldBindQuery(&filters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := models.QueryNotifications(uint(currentUser.ID), filters)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// count the current user's unread notifications, for the bell icon
+func GetUnreadNotificationCount(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	count, err := models.CountUnreadNotifications(uint(currentUser.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unread": count})
+}
+
+func MarkNotificationRead(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	// Other users' notifications are not found
+	var notification models.Notification
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := models.GetUserNotificationByID(&notification, uint(currentUser.ID), uint(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.MarkNotificationRead(&notification); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, notification)
+}
+
+func MarkAllNotificationsRead(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	count, err := models.MarkAllNotificationsRead(uint(currentUser.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"marked": count})
+}
+
+// get the current user's notification preferences for every event and channel
+func GetNotificationPreferences(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	preferences, err := models.GetNotificationPreferenceList(uint(currentUser.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preferences)
+}
+
+type NotificationPreferenceRequest struct {
+	EventType string `json:"eventType" binding:"required"`
+	Channel   string `json:"channel" binding:"required"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// turn events on channels on or off for the current user, others are left as they are
+func UpdateNotificationPreferences(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var input []NotificationPreferenceRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preferences := make([]models.NotificationPreference, len(input))
+	for i, preference := range input {
+		preferences[i] = models.NotificationPreference{EventType: preference.EventType, Channel: preference.Channel, Enabled: preference.Enabled}
+	}
+	if err := models.SetNotificationPreferences(uint(currentUser.ID), preferences); err != nil {
+		if errors.Is(err, models.ErrInvalidNotificationPreference) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	list, err := models.GetNotificationPreferenceList(uint(currentUser.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// get how often the current user gets the digest and whether it is on
+func GetDigestSubscription(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	subscription, ok := loadDigestSubscription(c, currentUser)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+type DigestSubscriptionRequest struct {
+	Frequency string `json:"frequency" binding:"required"` // daily, weekly
+	// Turns the digest on or off for every event, left as it is when omitted
+	Enabled *bool `json:"enabled"`
+}
+
+func UpdateDigestSubscription(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	var input DigestSubscriptionRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscription, err := models.GetDigestSubscription(uint(currentUser.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.SetDigestFrequency(subscription, input.Frequency); err != nil {
+		if errors.Is(err, models.ErrInvalidDigestFrequency) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Enabled != nil {
+		if err := models.SetDigestEnabled(uint(currentUser.ID), *input.Enabled); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	response, ok := loadDigestSubscription(c, currentUser)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// show the current user's digest as it would go out now, without sending it
+func PreviewDigest(c *gin.Context) {
+	currentUser := util.CurrentUser(c)
+	if currentUser == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+
+	subscription, err := models.GetDigestSubscription(uint(currentUser.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	subscription.User = currentUser
+
+	schedule := util.DigestScheduleFromEnv()
+	digest, err := util.PreviewDigest(subscription, schedule, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	subject, body, err := util.RenderDigest(subscription, digest, schedule)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"digest": digest, "subject": subject, "body": body})
+}
+
+var unsubscribeDigestPage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe from the delivery digest</title></head>
+<body>
+<p>Stop receiving the delivery digest by email?</p>
+<form method="post" action="unsubscribe">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Unsubscribe</button>
+</form>
+</body>
+</html>
+`))
+
+// Load the subscription of an unsubscribe link, answering with a plain text error if there is none
+func loadUnsubscribeSubscription(c *gin.Context, token string) (*models.DigestSubscription, bool) {
+	var subscription models.DigestSubscription
+	if err := models.GetDigestSubscriptionByToken(&subscription, token); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "This unsubscribe link is not valid.")
+			return nil, false
+		}
+		c.String(http.StatusInternalServerError, "Something went wrong, please try again later.")
+		return nil, false
+	}
+	return &subscription, true
+}
+
+// show the confirmation page of an unsubscribe link. Opening the link changes
+// nothing, so mail scanners that follow links do not unsubscribe the user.
+func ConfirmUnsubscribeDigest(c *gin.Context) {
+	token := c.Query("token")
+	if _, ok := loadUnsubscribeSubscription(c, token); !ok {
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := unsubscribeDigestPage.Execute(c.Writer, token); err != nil {
+		c.Error(err)
+	}
+}
+
+// turn the digest off for the user of an unsubscribe link, once confirmed. The
+// token is read from the form or, for one-click unsubscribes, the query.
+func UnsubscribeDigest(c *gin.Context) {
+	token := c.PostForm("token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	subscription, ok := loadUnsubscribeSubscription(c, token)
+	if !ok {
+		return
+	}
+	if err := models.SetDigestEnabled(subscription.UserID, false); err != nil {
+		c.String(http.StatusInternalServerError, "Something went wrong, please try again later.")
+		return
+	}
+	c.String(http.StatusOK, "You will no longer receive the delivery digest. You can turn it back on in your notification settings.")
+}
+
+type digestSubscriptionResponse struct {
+	models.DigestSubscription
+	Enabled bool `json:"enabled"` // whether the digest is on for any event
+}
+
+func loadDigestSubscription(c *gin.Context, user *models.User) (digestSubscriptionResponse, bool) {
+	subscription, err := models.GetDigestSubscription(uint(user.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return digestSubscriptionResponse{}, false
+	}
+	preferences, err := models.GetNotificationPreferences(uint(user.ID))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return digestSubscriptionResponse{}, false
+	}
+	return digestSubscriptionResponse{DigestSubscription: *subscription, Enabled: models.WantsDigest(preferences)}, true
+}
@@ -18,10 +18,20 @@ import (
 
 // RegisterOrderRoutes registers order routes
 func RegisterOrderRoutes(r *gin.RouterGroup) {
+	r.GET("/price-deviations", util.JWTAuth("admin"), GetPriceDeviations)
+	r.GET("/escalations", util.JWTAuth("admin"), GetEscalatedOrders)
 	r.GET("/:id", GetOrderByID)
 	r.PUT("/:id", UpdateOrder, util.JWTAuth("admin"))
 	r.DELETE("/:id", DeleteOrder, util.JWTAuth("admin"))
 	r.GET("/:id/notify/recipients", util.JWTAuth("admin"), GetOrderNotificationRecipients)
+	r.POST("/:id/confirm", util.JWTAuth("admin", "vendor_admin"), ConfirmOrder)
+	r.POST("/:id/complete", util.JWTAuth("admin", "vendor_admin"), CompleteOrder)
+	r.POST("/:id/cancel", util.JWTAuth("admin"), CancelOrder)
+	r.POST("/:id/accept", util.JWTAuth("admin", "vendor_admin"), AcceptOrder)
+	r.POST("/:id/reject", util.JWTAuth("admin", "vendor_admin"), RejectOrder)
+	r.POST("/:id/propose", util.JWTAuth("admin", "vendor_admin"), ProposeOrderChange)
+	r.POST("/:id/proposal/approve", util.JWTAuth("admin"), ApproveOrderProposal)
+	r.POST("/:id/proposal/decline", util.JWTAuth("admin"), DeclineOrderProposal)
 }
 
 // get order by id
@@ -39,8 +49,10 @@ func GetOrderByID(context *gin.Context) {
 		return
 	}
 
-	allowedRoles := []string{"admin", fmt.Sprintf("school_admin:%d", order.Delivery.SchoolID)}
-
+	allowedRoles := []string{"admin"}
+	if order.Delivery.SchoolID != nil {
+		allowedRoles = append(allowedRoles, fmt.Sprintf("school_admin:%d", *order.Delivery.SchoolID))
+	}
 	if order.VendorID != nil {
 		allowedRoles = append(allowedRoles, fmt.Sprintf("vendor_admin:%d", *order.VendorID))
 	}
@@ -104,6 +116,28 @@ func UpdateOrder(c *gin.Context) {
 		return
 	}
 
+	// Validate status change against the transition graph
+	if models.NormalizeOrderStatus(order.Status) != models.NormalizeOrderStatus(oldOrder.Status) {
+		newStatus := order.Status
+		order.Status = oldOrder.Status
+		if err := order.SetStatus(newStatus); err != nil {
+			abortOrderStatusError(c, err)
+			return
+		}
+	} else {
+		order.Status = oldOrder.Status
+	}
+
+	// Toggling isInternal without picking a vendor moves the order to or from the
+	// internal vendor, otherwise isInternal follows the vendor
+	if order.IsInternal != oldOrder.IsInternal && intPtrEqual(order.VendorID, oldOrder.VendorID) {
+		order.VendorID = nil
+	}
+	if err := models.ResolveOrderFulfillment(&order); err != nil {
+		abortOrderStatusError(c, err)
+		return
+	}
+
 	// Compare and Log
 	currentUser := util.CurrentUser(c)
 	var logs []models.OrderChangeLog
@@ -120,7 +154,7 @@ func UpdateOrder(c *gin.Context) {
 		})
 	}
 
-	if oldOrder.Status != order.Status {
+	if models.NormalizeOrderStatus(oldOrder.Status) != order.Status {
 		addLog("status", oldOrder.Status, order.Status)
 	}
 	if oldOrder.Quantity != order.Quantity {
@@ -129,6 +163,19 @@ func UpdateOrder(c *gin.Context) {
 	if oldOrder.Item != order.Item {
 		addLog("item", oldOrder.Item, order.Item)
 	}
+
+	// ItemID
+	oldItem := ""
+	newItem := ""
+	if oldOrder.ItemID != nil {
+		oldItem = fmt.Sprintf("%d", *oldOrder.ItemID)
+	}
+	if order.ItemID != nil {
+		newItem = fmt.Sprintf("%d", *order.ItemID)
+	}
+	if oldItem != newItem {
+		addLog("itemId", oldItem, newItem)
+	}
 	if oldOrder.UnitCost != order.UnitCost {
 		addLog("unitPrice", fmt.Sprintf("%f", oldOrder.UnitCost), fmt.Sprintf("%f", order.UnitCost))
 	}
@@ -152,19 +199,262 @@ func UpdateOrder(c *gin.Context) {
 		addLog("vendorId", oldVendor, newVendor)
 	}
 
-	// Save logs
-	if len(logs) > 0 {
-		db.Db.Create(&logs)
+	// A new vendor or more units must fit the vendor's capacity on the delivery day
+	if oldVendor != newVendor || order.Quantity > oldOrder.Quantity {
+		err := models.CheckOrderCapacity(&order)
+		if abortVendorCapacityError(c, err) {
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	err = models.UpdateOrder(&order)
+	// Save the order with its logs
+	err = models.UpdateOrderWithLogs(&order, logs)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
+		abortOrderStatusError(c, err)
+		return
+	}
+
+	// A new vendor has not answered yet
+	if oldVendor != newVendor {
+		if err := models.ResetVendorResponse(&order); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+type CancelOrderRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// confirm order
+func ConfirmOrder(c *gin.Context) {
+	transitionOrder(c, models.OrderStatusConfirmed, "")
+}
+
+// complete order
+func CompleteOrder(c *gin.Context) {
+	transitionOrder(c, models.OrderStatusCompleted, "")
+}
+
+// cancel order with a reason
+func CancelOrder(c *gin.Context) {
+	var input CancelOrderRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	transitionOrder(c, models.OrderStatusCancelled, input.Reason)
+}
+
+// Load the order, check the caller may act on it and move it to the given status
+func transitionOrder(c *gin.Context, status string, reason string) {
+	var order models.Order
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetOrderByID(&order, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	allowedRoles := []string{"admin"}
+	if order.VendorID != nil {
+		allowedRoles = append(allowedRoles, fmt.Sprintf("vendor_admin:%d", *order.VendorID))
+	}
+	if err := util.ValidateRoleJWT(c, allowedRoles...); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	currentUser := util.CurrentUser(c)
+	if err := models.TransitionOrder(&order, status, reason, uint(currentUser.ID)); err != nil {
+		abortOrderStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+type RejectOrderRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+type ProposeOrderChangeRequest struct {
+	Quantity *int     `json:"quantity"`
+	UnitCost *float64 `json:"unitPrice"`
+	Reason   string   `json:"reason" binding:"required"`
+}
+
+// vendor accepts and confirms an order
+func AcceptOrder(c *gin.Context) {
+	respondToOrder(c, models.VendorResponseAccepted, "", nil, nil)
+}
+
+// vendor rejects an order with a reason
+func RejectOrder(c *gin.Context) {
+	var input RejectOrderRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	respondToOrder(c, models.VendorResponseRejected, input.Reason, nil, nil)
+}
+
+// vendor proposes a different quantity or unit cost
+func ProposeOrderChange(c *gin.Context) {
+	var input ProposeOrderChangeRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Quantity == nil && input.UnitCost == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "quantity or unitPrice is required"})
+		return
+	}
+	if (input.Quantity != nil && *input.Quantity <= 0) || (input.UnitCost != nil && *input.UnitCost < 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid quantity or unitPrice"})
+		return
+	}
+	respondToOrder(c, models.VendorResponseChangeProposed, input.Reason, input.Quantity, input.UnitCost)
+}
+
+// Load the order, check the caller is the order's vendor or an admin and record the response
+func respondToOrder(c *gin.Context, response string, reason string, quantity *int, unitCost *float64) {
+	var order models.Order
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetOrderByID(&order, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	allowedRoles := []string{"admin"}
+	if order.VendorID != nil {
+		allowedRoles = append(allowedRoles, fmt.Sprintf("vendor_admin:%d", *order.VendorID))
+	}
+	if err := util.ValidateRoleJWT(c, allowedRoles...); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	currentUser := util.CurrentUser(c)
+	if err := models.RespondToOrder(&order, response, reason, quantity, unitCost, uint(currentUser.ID)); err != nil {
+		if errors.Is(err, models.ErrOrderNotAwaitingResponse) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		abortOrderStatusError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// admin applies a vendor's proposed change and confirms the order
+func ApproveOrderProposal(c *gin.Context) {
+	resolveOrderProposal(c, true)
+}
+
+// admin declines a vendor's proposed change
+func DeclineOrderProposal(c *gin.Context) {
+	resolveOrderProposal(c, false)
+}
+
+func resolveOrderProposal(c *gin.Context, approve bool) {
+	var order models.Order
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetOrderByID(&order, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	currentUser := util.CurrentUser(c)
+	if err := models.ResolveOrderProposal(&order, approve, uint(currentUser.ID)); err != nil {
+		if errors.Is(err, models.ErrNoProposedChange) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		abortOrderStatusError(c, err)
+		return
+	}
+
 	c.JSON(http.StatusOK, order)
 }
 
+// get pending orders escalated because they are unconfirmed close to delivery
+func GetEscalatedOrders(c *gin.Context) {
+	orders, err := models.GetEscalatedOrders()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, orders)
+}
+
+// Abort with 409 and alternative vendors when a vendor is over capacity.
+// Returns false for any other error.
+func abortVendorCapacityError(c *gin.Context, err error) bool {
+	var capacityErr *models.VendorCapacityError
+	if !errors.As(err, &capacityErr) {
+		return false
+	}
+	c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+		"error":        capacityErr.Error(),
+		"vendorId":     capacityErr.VendorID,
+		"day":          capacityErr.Day,
+		"alternatives": capacityErr.Alternatives,
+	})
+	return true
+}
+
+// Map status and transition errors to their HTTP status
+func abortOrderStatusError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidOrderStatus), isFulfillmentError(err), errors.Is(err, models.ErrUnknownItem):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrInvalidOrderTransition):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func intPtrEqual(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Is the error a rejected vendor or isInternal of an order or order template
+func isFulfillmentError(err error) bool {
+	return errors.Is(err, models.ErrVendorSentinel) || errors.Is(err, models.ErrInconsistentFulfillment)
+}
+
 func DeleteOrder(c *gin.Context) {
 	var order models.Order
 	id, _ := strconv.Atoi(c.Param("id"))
@@ -207,6 +497,9 @@ func AddOrderToDelivery(c *gin.Context) {
 	}
 
 	err = models.AddOrderToDelivery(&delivery, &order)
+	if abortVendorCapacityError(c, err) {
+		return
+	}
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
@@ -219,7 +512,7 @@ func AddOrderToDelivery(c *gin.Context) {
 func RemoveOrderFromDelivery(c *gin.Context) {
 	var delivery models.Delivery
 	var order models.Order
-	deliveryID, _ := strconv.Atoi(c.Param("delivery_id"))
+	deliveryID, _ := strconv.Atoi(c.Param("id"))
 	orderID, _ := strconv.Atoi(c.Param("order_id"))
 
 	err := db.Db.First(&delivery, deliveryID).Error
@@ -228,13 +521,18 @@ func RemoveOrderFromDelivery(c *gin.Context) {
 		return
 	}
 
+	// An order on another delivery is not found on this one
 	err = db.Db.First(&order, orderID).Error
-	if err != nil {
+	if err != nil || order.DeliveryID != delivery.ID {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 		return
 	}
 
 	err = models.RemoveOrderFromDelivery(&delivery, &order)
+	if errors.Is(err, models.ErrOrderNotOnDelivery) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
@@ -242,3 +540,53 @@ func RemoveOrderFromDelivery(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Order removed from delivery successfully"})
 }
+
+// report orders whose unit cost deviates from the vendor's list price
+func GetPriceDeviations(c *gin.Context) {
+	threshold := 0.0
+	if s := c.Query("threshold"); s != "" {
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid threshold"})
+			return
+		}
+		threshold = parsed
+	}
+
+	var from, to *time.Time
+	if s := c.Query("from"); s != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+		from = &parsed
+	}
+	if s := c.Query("to"); s != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+		// inclusive of the whole day
+		parsed = parsed.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		to = &parsed
+	}
+
+	var vendorID *int
+	if s := c.Query("vendorId"); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid vendorId"})
+			return
+		}
+		vendorID = &parsed
+	}
+
+	deviations, err := models.GetPriceDeviations(threshold, from, to, vendorID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deviations)
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Messages listed without a limit
+const defaultOutboxLimit = 100
+
+// RegisterOutboxRoutes registers routes to inspect and replay outbox messages
+func RegisterOutboxRoutes(r *gin.RouterGroup) {
+	r.GET("", GetOutboxMessages)
+	r.GET("/:id", GetOutboxMessage)
+	r.POST("/:id/replay", ReplayOutboxMessage)
+	r.POST("/replay", ReplayDeadOutboxMessages)
+}
+
+// get outbox messages, newest first, optionally of one status and topic
+func GetOutboxMessages(c *gin.Context) {
+	limit := defaultOutboxLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	var messages []models.OutboxMessage
+	if err := models.GetOutboxMessages(&messages, c.Query("status"), c.Query("topic"), limit); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, messages)
+}
+
+func GetOutboxMessage(c *gin.Context) {
+	message, ok := loadOutboxMessage(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, message)
+}
+
+// put a dead message back in the queue
+func ReplayOutboxMessage(c *gin.Context) {
+	message, ok := loadOutboxMessage(c)
+	if !ok {
+		return
+	}
+	if err := models.ReplayOutboxMessage(&message); err != nil {
+		if errors.Is(err, models.ErrOutboxNotReplayable) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, message)
+}
+
+// put every dead message, optionally of one topic, back in the queue
+func ReplayDeadOutboxMessages(c *gin.Context) {
+	count, err := models.ReplayDeadOutboxMessages(c.Query("topic"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"replayed": count})
+}
+
+func loadOutboxMessage(c *gin.Context) (models.OutboxMessage, bool) {
+	var message models.OutboxMessage
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := models.GetOutboxMessageByID(&message, uint(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return message, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return message, false
+	}
+	return message, true
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterPackageRoutes registers package type catalog routes
+func RegisterPackageRoutes(r *gin.RouterGroup) {
+	r.GET("", util.JWTAuth("admin", "school_admin", "vendor_admin"), GetPackageTypes)
+	r.GET("/:id", util.JWTAuth("admin", "school_admin", "vendor_admin"), GetPackageType)
+	r.POST("", util.JWTAuth("admin"), CreatePackageType)
+	r.PUT("/:id", util.JWTAuth("admin"), UpdatePackageType)
+	r.DELETE("/:id", util.JWTAuth("admin"), DeletePackageType)
+	r.POST("/:id/versions", util.JWTAuth("admin"), AddPackageVersion)
+}
+
+// get all package types
+func GetPackageTypes(c *gin.Context) {
+	var packageTypes []models.PackageType
+	err := models.GetAllPackageTypes(&packageTypes)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, packageTypes)
+}
+
+// get package type by id, with all of its versions
+func GetPackageType(c *gin.Context) {
+	var packageType models.PackageType
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetPackageTypeByID(&packageType, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, packageType)
+}
+
+func CreatePackageType(c *gin.Context) {
+	var packageType models.PackageType
+
+	if err := c.ShouldBindJSON(&packageType); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if packageType.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+	for i := range packageType.Versions {
+		if err := validatePackageItems(packageType.Versions[i].Items); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		packageType.Versions[i].Version = i + 1
+	}
+
+	if err := models.CreatePackageType(&packageType); err != nil {
+		if isFulfillmentError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, packageType)
+}
+
+// update package type details, contents are changed by adding a version
+func UpdatePackageType(c *gin.Context) {
+	var packageType models.PackageType
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetPackageTypeByID(&packageType, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.BindJSON(&packageType); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = models.UpdatePackageType(&packageType)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, packageType)
+}
+
+func DeletePackageType(c *gin.Context) {
+	var packageType models.PackageType
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetPackageTypeByID(&packageType, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = models.DeletePackageType(&packageType)
+	if errors.Is(err, models.ErrPackageTypeInUse) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, packageType)
+}
+
+// add a new version of the package contents
+func AddPackageVersion(c *gin.Context) {
+	var packageType models.PackageType
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetPackageTypeByID(&packageType, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var version models.PackageVersion
+	if err := c.ShouldBindJSON(&version); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePackageItems(version.Items); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.AddPackageVersion(&packageType, &version); err != nil {
+		if isFulfillmentError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, version)
+}
+
+func validatePackageItems(items []models.PackageItem) error {
+	for _, item := range items {
+		if item.Item == "" {
+			return errors.New("item is required")
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("quantity of %q must be positive", item.Item)
+		}
+		if item.Per != models.PackageItemPerStudent && item.Per != models.PackageItemPerBox {
+			return fmt.Errorf("per of %q must be %q or %q", item.Item, models.PackageItemPerStudent, models.PackageItemPerBox)
+		}
+	}
+	return nil
+}
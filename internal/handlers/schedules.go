@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterScheduleRoutes registers delivery schedule routes
+func RegisterScheduleRoutes(r *gin.RouterGroup) {
+	r.GET("", GetSchedules)
+	r.GET("/:id", GetSchedule)
+	r.POST("", CreateSchedule)
+	r.PUT("/:id", UpdateSchedule)
+	r.DELETE("/:id", DeleteSchedule)
+	r.POST("/:id/generate", GenerateSchedule)
+}
+
+// get all schedules
+func GetSchedules(c *gin.Context) {
+	var schedules []models.DeliverySchedule
+	err := models.GetAllDeliverySchedules(&schedules)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedules)
+}
+
+// get schedule by id
+func GetSchedule(c *gin.Context) {
+	var schedule models.DeliverySchedule
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetDeliveryScheduleByID(&schedule, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+func CreateSchedule(c *gin.Context) {
+	var schedule models.DeliverySchedule
+
+	if err := c.ShouldBindJSON(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := validateSchedule(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := models.CreateDeliverySchedule(&schedule); err != nil {
+		if isFulfillmentError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, schedule)
+}
+
+// update schedule
+func UpdateSchedule(c *gin.Context) {
+	var schedule models.DeliverySchedule
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetDeliveryScheduleByID(&schedule, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.BindJSON(&schedule); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateSchedule(&schedule); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = models.UpdateDeliverySchedule(&schedule)
+	if err != nil {
+		if isFulfillmentError(err) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+func DeleteSchedule(c *gin.Context) {
+	var schedule models.DeliverySchedule
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetDeliveryScheduleByID(&schedule, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = models.DeleteDeliverySchedule(&schedule)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// generate upcoming deliveries of a schedule now instead of waiting for the background run
+func GenerateSchedule(c *gin.Context) {
+	var schedule models.DeliverySchedule
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetDeliveryScheduleByID(&schedule, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	deliveries, err := models.GenerateScheduleDeliveries(&schedule, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if deliveries == nil {
+		deliveries = []models.Delivery{}
+	}
+	c.JSON(http.StatusCreated, deliveries)
+}
+
+func validateSchedule(schedule *models.DeliverySchedule) error {
+	if schedule.SchoolID == nil {
+		return errors.New("schoolId is required")
+	}
+	if schedule.StartsAt.IsZero() {
+		return errors.New("startsAt is required")
+	}
+	if _, err := models.ParseRecurrence(schedule.Recurrence); err != nil {
+		return fmt.Errorf("invalid recurrence: %w", err)
+	}
+	switch schedule.BlackoutPolicy {
+	case "", models.BlackoutPolicySkip, models.BlackoutPolicyShift:
+	default:
+		return fmt.Errorf("invalid blackoutPolicy %q", schedule.BlackoutPolicy)
+	}
+	for _, date := range schedule.BlackoutDates {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return fmt.Errorf("invalid blackout date %q", date)
+		}
+	}
+	return nil
+}
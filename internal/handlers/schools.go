@@ -110,6 +110,10 @@ func UpdateSchool(c *gin.Context) {
 		return
 	}
 	c.BindJSON(&school)
+	if err := school.ValidateReceivingHours(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	err = models.UpdateSchool(&school)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -150,6 +154,13 @@ func CreateSchool(c *gin.Context) {
 		return
 	}
 
+	if err := school.ValidateReceivingHours(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
 	if err := models.CreateSchool(&school); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
@@ -3,9 +3,12 @@ package handlers
 import (
 	"LindaBen_Phase_1_Project/internal/db"
 	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -18,6 +21,30 @@ func RegisterVendorRoutes(r *gin.RouterGroup) {
 	r.POST("", CreateVendor)
 	r.PUT("/:id", UpdateVendor)
 	r.DELETE("/:id", DeleteVendor)
+
+	r.GET("/:id/orders", util.JWTAuth("admin", "vendor_admin"), GetVendorOrders)
+
+	r.GET("/:id/purchase-orders", util.JWTAuth("admin", "vendor_admin"), GetVendorPurchaseOrders)
+	r.GET("/:id/purchase-orders/:poId", util.JWTAuth("admin", "vendor_admin"), GetPurchaseOrder)
+	r.GET("/:id/purchase-orders/:poId/:format", util.JWTAuth("admin", "vendor_admin"), DownloadPurchaseOrder)
+	r.POST("/:id/purchase-orders", util.JWTAuth("admin"), CreatePurchaseOrder)
+	r.DELETE("/:id/purchase-orders/:poId", util.JWTAuth("admin"), DeletePurchaseOrder)
+
+	r.GET("/:id/prices", util.JWTAuth("admin", "vendor_admin"), GetVendorPrices)
+	r.POST("/:id/prices", util.JWTAuth("admin"), CreateVendorPrice)
+	r.PUT("/:id/prices/:priceId", util.JWTAuth("admin"), UpdateVendorPrice)
+	r.DELETE("/:id/prices/:priceId", util.JWTAuth("admin"), DeleteVendorPrice)
+
+	r.GET("/:id/invoices", util.JWTAuth("admin", "vendor_admin"), GetVendorInvoices)
+	r.GET("/:id/invoices/:invoiceId", util.JWTAuth("admin", "vendor_admin"), GetInvoice)
+	r.POST("/:id/invoices", util.JWTAuth("admin", "vendor_admin"), CreateInvoice)
+	r.PUT("/:id/invoices/:invoiceId", util.JWTAuth("admin", "vendor_admin"), UpdateInvoice)
+	r.POST("/:id/invoices/:invoiceId/file", util.JWTAuth("admin", "vendor_admin"), UploadInvoiceFile)
+	r.POST("/:id/invoices/:invoiceId/reconcile", util.JWTAuth("admin"), ReconcileInvoice)
+	r.POST("/:id/invoices/:invoiceId/approve", util.JWTAuth("admin"), ApproveInvoice)
+	r.POST("/:id/invoices/:invoiceId/dispute", util.JWTAuth("admin"), DisputeInvoice)
+	r.POST("/:id/invoices/:invoiceId/pay", util.JWTAuth("admin"), PayInvoice)
+	r.DELETE("/:id/invoices/:invoiceId", util.JWTAuth("admin"), DeleteInvoice)
 }
 
 // get all vendors
@@ -93,7 +120,16 @@ func UpdateVendor(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
+	isInternal := vendor.IsInternal
 	c.BindJSON(&vendor)
+	if vendor.IsInternal != isInternal {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": models.ErrInternalVendorRequired.Error()})
+		return
+	}
+	if err := vendor.ValidateCapacity(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	err = models.UpdateVendor(&vendor)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -116,6 +152,10 @@ func DeleteVendor(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
+	if vendor.IsInternal {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": models.ErrInternalVendorRequired.Error()})
+		return
+	}
 	err = models.DeleteVendor(&vendor)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -134,6 +174,15 @@ func CreateVendor(c *gin.Context) {
 		return
 	}
 
+	if vendor.IsInternal {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "there is already an internal vendor"})
+		return
+	}
+	if err := vendor.ValidateCapacity(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	if err := models.CreateVendor(&vendor); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
@@ -143,3 +192,334 @@ func CreateVendor(c *gin.Context) {
 
 	c.JSON(http.StatusCreated, vendor)
 }
+
+// get the order inbox of a vendor, optionally filtered by status
+func GetVendorOrders(c *gin.Context) {
+	var vendor models.Vendor
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	err := models.GetVendorByID(&vendor, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	orders, err := models.GetVendorOrders(&vendor, c.QueryArray("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, orders)
+}
+
+// get the purchase orders of a vendor
+func GetVendorPurchaseOrders(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	purchaseOrders, err := models.GetVendorPurchaseOrders(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, purchaseOrders)
+}
+
+// get a purchase order with its lines and files
+func GetPurchaseOrder(c *gin.Context) {
+	var purchaseOrder models.PurchaseOrder
+	id, _ := strconv.Atoi(c.Param("id"))
+	poID, _ := strconv.Atoi(c.Param("poId"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	err := models.GetPurchaseOrderByID(&purchaseOrder, uint(poID))
+	if err != nil || purchaseOrder.VendorID != id {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, purchaseOrder)
+}
+
+// download the pdf or csv file of a purchase order
+func DownloadPurchaseOrder(c *gin.Context) {
+	var purchaseOrder models.PurchaseOrder
+	id, _ := strconv.Atoi(c.Param("id"))
+	poID, _ := strconv.Atoi(c.Param("poId"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	err := models.GetPurchaseOrderByID(&purchaseOrder, uint(poID))
+	if err != nil || purchaseOrder.VendorID != id {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var file *models.File
+	switch c.Param("format") {
+	case "pdf":
+		file = purchaseOrder.PdfFile
+	case "csv":
+		file = purchaseOrder.CsvFile
+	}
+	if file == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.FileAttachment(file.FullPath(), purchaseOrder.Number+"."+c.Param("format"))
+}
+
+type CreatePurchaseOrderRequest struct {
+	From string `json:"from" binding:"required"` // YYYY-MM-DD
+	To   string `json:"to" binding:"required"`   // YYYY-MM-DD, inclusive
+}
+
+// group the vendor's confirmed orders over a date range into a purchase order
+func CreatePurchaseOrder(c *gin.Context) {
+	var vendor models.Vendor
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetVendorByID(&vendor, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var input CreatePurchaseOrderRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, err := time.ParseInLocation("2006-01-02", input.From, time.Local)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid from %q", input.From)})
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", input.To, time.Local)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid to %q", input.To)})
+		return
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to is before from"})
+		return
+	}
+
+	purchaseOrder, err := models.CreatePurchaseOrder(&vendor, from, to)
+	if err != nil {
+		if errors.Is(err, models.ErrNoOrdersForPurchaseOrder) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, purchaseOrder)
+}
+
+// delete a purchase order, its orders can then go on a new one
+func DeletePurchaseOrder(c *gin.Context) {
+	var purchaseOrder models.PurchaseOrder
+	id, _ := strconv.Atoi(c.Param("id"))
+	poID, _ := strconv.Atoi(c.Param("poId"))
+
+	err := models.GetPurchaseOrderByID(&purchaseOrder, uint(poID))
+	if err != nil || purchaseOrder.VendorID != id {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = models.DeletePurchaseOrder(&purchaseOrder)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, purchaseOrder)
+}
+
+// get the price list of a vendor, optionally for one item
+func GetVendorPrices(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := util.ValidateRoleJWT(c, "admin", fmt.Sprintf("vendor_admin:%d", id)); err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	var itemID *int
+	if s := c.Query("itemId"); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid itemId"})
+			return
+		}
+		itemID = &parsed
+	}
+
+	prices, err := models.GetVendorPrices(id, itemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, prices)
+}
+
+func CreateVendorPrice(c *gin.Context) {
+	var vendor models.Vendor
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := models.GetVendorByID(&vendor, uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var price models.VendorPrice
+	if err := c.ShouldBindJSON(&price); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	price.ID = 0
+	price.VendorID = vendor.ID
+	if err := validateVendorPrice(&price); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.CreateVendorPrice(&price); err != nil {
+		abortVendorPriceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, price)
+}
+
+func UpdateVendorPrice(c *gin.Context) {
+	var price models.VendorPrice
+	id, _ := strconv.Atoi(c.Param("id"))
+	priceID, _ := strconv.Atoi(c.Param("priceId"))
+
+	err := models.GetVendorPriceByID(&price, uint(priceID))
+	if err != nil || price.VendorID != id {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.BindJSON(&price); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	price.ID = priceID
+	price.VendorID = id
+	if err := validateVendorPrice(&price); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.UpdateVendorPrice(&price); err != nil {
+		abortVendorPriceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, price)
+}
+
+func DeleteVendorPrice(c *gin.Context) {
+	var price models.VendorPrice
+	id, _ := strconv.Atoi(c.Param("id"))
+	priceID, _ := strconv.Atoi(c.Param("priceId"))
+
+	err := models.GetVendorPriceByID(&price, uint(priceID))
+	if err != nil || price.VendorID != id {
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = models.DeleteVendorPrice(&price)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, price)
+}
+
+func validateVendorPrice(price *models.VendorPrice) error {
+	if price.ItemID == 0 {
+		return errors.New("itemId is required")
+	}
+	var item models.Item
+	if err := models.GetItemByID(&item, uint(price.ItemID)); err != nil {
+		return fmt.Errorf("item %d not found", price.ItemID)
+	}
+	if price.Price < 0 {
+		return errors.New("price must not be negative")
+	}
+	from, err := time.Parse("2006-01-02", price.EffectiveFrom)
+	if err != nil {
+		return fmt.Errorf("invalid effectiveFrom %q", price.EffectiveFrom)
+	}
+	if price.EffectiveTo != "" {
+		to, err := time.Parse("2006-01-02", price.EffectiveTo)
+		if err != nil {
+			return fmt.Errorf("invalid effectiveTo %q", price.EffectiveTo)
+		}
+		if to.Before(from) {
+			return errors.New("effectiveTo is before effectiveFrom")
+		}
+	}
+	return nil
+}
+
+func abortVendorPriceError(c *gin.Context, err error) {
+	if errors.Is(err, models.ErrOverlappingVendorPrice) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"LindaBen_Phase_1_Project/internal/util"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Log entries listed without a limit
+const defaultWebhookDeliveryLimit = 100
+
+// RegisterWebhookRoutes registers routes to manage webhooks and inspect their deliveries
+func RegisterWebhookRoutes(r *gin.RouterGroup) {
+	r.GET("", GetWebhooks)
+	r.GET("/:id", GetWebhook)
+	r.POST("", CreateWebhook)
+	r.PUT("/:id", UpdateWebhook)
+	r.DELETE("/:id", DeleteWebhook)
+	r.POST("/:id/ping", PingWebhook)
+	r.GET("/:id/deliveries", GetWebhookDeliveries)
+	r.POST("/:id/deliveries/:delivery_id/replay", ReplayWebhookDelivery)
+}
+
+type WebhookRequest struct {
+	URL         string   `json:"url" binding:"required"`
+	Secret      string   `json:"secret"` // generated when empty
+	Events      []string `json:"events" binding:"required"`
+	Active      *bool    `json:"active"` // defaults to true
+	Description string   `json:"description"`
+}
+
+func (input *WebhookRequest) apply(webhook *models.Webhook) {
+	webhook.URL = input.URL
+	webhook.Events = input.Events
+	webhook.Description = input.Description
+	if input.Secret != "" {
+		webhook.Secret = input.Secret
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+}
+
+func GetWebhooks(c *gin.Context) {
+	var webhooks []models.Webhook
+	if err := models.GetAllWebhooks(&webhooks); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+func GetWebhook(c *gin.Context) {
+	webhook, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+func CreateWebhook(c *gin.Context) {
+	var input WebhookRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	webhook := models.Webhook{Active: true}
+	input.apply(&webhook)
+	if err := webhook.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.CreateWebhook(&webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, webhook)
+}
+
+// update webhook, keeping its secret unless a new one is given
+func UpdateWebhook(c *gin.Context) {
+	webhook, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	var input WebhookRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.apply(&webhook)
+	if err := webhook.Validate(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.UpdateWebhook(&webhook); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+func DeleteWebhook(c *gin.Context) {
+	webhook, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	if err := models.DeleteWebhook(&webhook); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+// queue a signed test request to the webhook, also when it is inactive
+func PingWebhook(c *gin.Context) {
+	webhook, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	body, err := util.WebhookPingBody(&webhook)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	message, err := models.QueueWebhookPing(&webhook, body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, message)
+}
+
+// get the webhook's delivery log, newest first
+func GetWebhookDeliveries(c *gin.Context) {
+	webhook, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	limit := defaultWebhookDeliveryLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := models.GetWebhookDeliveries(&deliveries, uint(webhook.ID), limit); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// send the request of a logged delivery again, with the same body and event ID
+func ReplayWebhookDelivery(c *gin.Context) {
+	webhook, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	var delivery models.WebhookDelivery
+	deliveryID, _ := strconv.Atoi(c.Param("delivery_id"))
+	if err := models.GetWebhookDeliveryByID(&delivery, uint(webhook.ID), uint(deliveryID)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, err := models.ReplayWebhookDelivery(&delivery)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, message)
+}
+
+func loadWebhook(c *gin.Context) (models.Webhook, bool) {
+	var webhook models.Webhook
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := models.GetWebhookByID(&webhook, uint(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return webhook, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return webhook, false
+	}
+	return webhook, true
+}
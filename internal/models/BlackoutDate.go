@@ -0,0 +1,178 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+)
+
+// BlackoutDate is a range of days on which no deliveries should be made,
+// either for a single school or, without a school, for all of them
+type BlackoutDate struct {
+	Model
+
+	// Belongs-to: School, nil for global blackouts
+	SchoolID *int    `gorm:"index" json:"schoolId"`
+	School   *School `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"school,omitempty"`
+
+	StartDate string `gorm:"index" json:"startDate"` // YYYY-MM-DD
+	EndDate   string `gorm:"index" json:"endDate"`   // YYYY-MM-DD, inclusive
+
+	Kind string `json:"kind"` // holiday, testing, closure
+	Name string `json:"name"`
+}
+
+// DateConflict describes why a delivery date is problematic. Blocking
+// conflicts reject the date unless explicitly overridden.
+type DateConflict struct {
+	Kind     string `json:"kind"` // blackout, weekend, receivingHours
+	Message  string `json:"message"`
+	Blocking bool   `json:"blocking"`
+}
+
+// Get Blackout Date by ID
+func GetBlackoutDateByID(BlackoutDate *BlackoutDate, id uint) (err error) {
+	err = db.Db.First(BlackoutDate, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get blackout dates overlapping [from, to]. With a school, both its own and
+// global blackouts are returned; without one, only global blackouts.
+func GetBlackoutDates(schoolID *int, from, to string) ([]BlackoutDate, error) {
+	var blackouts []BlackoutDate
+	query := db.Db.Model(&BlackoutDate{})
+	if schoolID != nil {
+		query = query.Where("school_id IS NULL OR school_id = ?", *schoolID)
+	} else {
+		query = query.Where("school_id IS NULL")
+	}
+	if from != "" {
+		query = query.Where("end_date >= ?", from)
+	}
+	if to != "" {
+		query = query.Where("start_date <= ?", to)
+	}
+	err := query.Order("start_date asc").Find(&blackouts).Error
+	return blackouts, err
+}
+
+// Create Blackout Date
+func CreateBlackoutDate(BlackoutDate *BlackoutDate) (err error) {
+	err = db.Db.Create(BlackoutDate).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update Blackout Date
+func UpdateBlackoutDate(BlackoutDate *BlackoutDate) (err error) {
+	err = db.Db.Save(BlackoutDate).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete Blackout Date
+func DeleteBlackoutDate(BlackoutDate *BlackoutDate) (err error) {
+	err = db.Db.Delete(BlackoutDate).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Does the blackout cover the given YYYY-MM-DD day
+func (blackout *BlackoutDate) Covers(day string) bool {
+	return blackout.StartDate <= day && day <= blackout.EndDate
+}
+
+// Find the blackout covering a day, if any
+func FindBlackout(blackouts []BlackoutDate, day string) *BlackoutDate {
+	for i := range blackouts {
+		if blackouts[i].Covers(day) {
+			return &blackouts[i]
+		}
+	}
+	return nil
+}
+
+// Check a delivery date against blackouts, weekends and the school's receiving hours.
+// Dates and times are compared in the server's local time zone.
+func CheckDeliveryDate(schoolID *int, scheduledAt *time.Time) ([]DateConflict, error) {
+	var conflicts []DateConflict
+	if scheduledAt == nil {
+		return conflicts, nil
+	}
+
+	local := scheduledAt.In(time.Local)
+	day := local.Format("2006-01-02")
+
+	blackouts, err := GetBlackoutDates(schoolID, day, day)
+	if err != nil {
+		return nil, err
+	}
+	for _, blackout := range blackouts {
+		scope := "global"
+		if blackout.SchoolID != nil {
+			scope = "school"
+		}
+		conflicts = append(conflicts, DateConflict{
+			Kind:     "blackout",
+			Message:  fmt.Sprintf("%s falls on %s blackout %q (%s to %s)", day, scope, blackout.Name, blackout.StartDate, blackout.EndDate),
+			Blocking: true,
+		})
+	}
+
+	if local.Weekday() == time.Saturday || local.Weekday() == time.Sunday {
+		conflicts = append(conflicts, DateConflict{
+			Kind:    "weekend",
+			Message: fmt.Sprintf("%s is a %s", day, local.Weekday()),
+		})
+	}
+
+	if schoolID != nil {
+		var school School
+		if err := db.Db.First(&school, *schoolID).Error; err != nil {
+			return nil, err
+		}
+		if conflict := checkReceivingHours(&school, local); conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+
+	return conflicts, nil
+}
+
+// Check a local time against the school's receiving windows for that weekday
+func checkReceivingHours(school *School, local time.Time) *DateConflict {
+	windows := school.ReceivingWindowsOn(local.Weekday())
+	if len(windows) == 0 {
+		if len(school.ReceivingWindows) == 0 {
+			return nil
+		}
+		return &DateConflict{
+			Kind:    "receivingHours",
+			Message: fmt.Sprintf("the school does not receive deliveries on %s", local.Weekday()),
+		}
+	}
+
+	clock := local.Format("15:04")
+	var hours []string
+	for _, window := range windows {
+		if (window.From == "" || clock >= window.From) && (window.To == "" || clock <= window.To) {
+			return nil
+		}
+		hours = append(hours, window.From+"-"+window.To)
+	}
+	return &DateConflict{
+		Kind:    "receivingHours",
+		Message: fmt.Sprintf("%s is outside the school's receiving hours on %s (%s)", clock, local.Weekday(), strings.Join(hours, ", ")),
+	}
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Budget is an amount available to a school, a funding source or both over a fiscal
+// period. It covers deliveries scheduled in the period that match its school and
+// funding source; a budget without either covers all deliveries.
+type Budget struct {
+	Model
+	Name string `json:"name"` // e.g. "FY2026"
+
+	// Belongs-to: School, nil for budgets not tied to a school
+	SchoolID *int    `gorm:"index" json:"schoolId"`
+	School   *School `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"school,omitempty"`
+
+	FundingSource string `gorm:"index" json:"fundingSource"` // matches Delivery.FundingSource, any when empty
+
+	PeriodStart string  `gorm:"index" json:"periodStart"` // YYYY-MM-DD
+	PeriodEnd   string  `gorm:"index" json:"periodEnd"`   // YYYY-MM-DD, inclusive
+	Amount      float64 `json:"amount"`
+	Notes       string  `json:"notes"`
+
+	// Filled in by LoadUsage
+	Usage BudgetUsage `gorm:"-" json:"usage"`
+}
+
+// BudgetUsage is how much of a budget is used. Completed orders are spent,
+// pending and confirmed orders are committed.
+type BudgetUsage struct {
+	BudgetID  int     `json:"budgetId"`
+	Name      string  `json:"name"`
+	Amount    float64 `json:"amount"`
+	Spent     float64 `json:"spent"`
+	Committed float64 `json:"committed"`
+	Remaining float64 `json:"remaining"`
+}
+
+// Get budgets, optionally for a school (with budgets not tied to a school), a funding
+// source, or covering a YYYY-MM-DD day
+func GetBudgets(schoolID *int, fundingSource string, on string) ([]Budget, error) {
+	var budgets []Budget
+	query := db.Db.Model(&Budget{})
+	if schoolID != nil {
+		query = query.Where("school_id IS NULL OR school_id = ?", *schoolID)
+	}
+	if fundingSource != "" {
+		query = query.Where("funding_source = ?", fundingSource)
+	}
+	if on != "" {
+		query = query.Where("period_start <= ? AND period_end >= ?", on, on)
+	}
+	err := query.Order("period_start desc, id asc").Find(&budgets).Error
+	return budgets, err
+}
+
+// Get Budget by ID
+func GetBudgetByID(Budget *Budget, id uint) (err error) {
+	err = db.Db.First(Budget, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Budget
+func CreateBudget(Budget *Budget) (err error) {
+	err = db.Db.Create(Budget).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update Budget
+func UpdateBudget(Budget *Budget) (err error) {
+	err = db.Db.Omit("School").Save(Budget).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete Budget
+func DeleteBudget(Budget *Budget) (err error) {
+	err = db.Db.Delete(Budget).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Compute the spent, committed and remaining amounts of the budget
+func (budget *Budget) LoadUsage() (err error) {
+	start, err := time.ParseInLocation("2006-01-02", budget.PeriodStart, time.Local)
+	if err != nil {
+		return err
+	}
+	end, err := time.ParseInLocation("2006-01-02", budget.PeriodEnd, time.Local)
+	if err != nil {
+		return err
+	}
+
+	var usage struct {
+		Spent     float64
+		Committed float64
+	}
+	query := db.Db.Model(&Order{}).
+		Select("COALESCE(SUM(CASE WHEN orders.status = ? THEN orders.quantity * orders.unit_cost ELSE 0 END), 0) AS spent, "+
+			"COALESCE(SUM(CASE WHEN orders.status IN ? THEN orders.quantity * orders.unit_cost ELSE 0 END), 0) AS committed",
+			OrderStatusCompleted, []string{OrderStatusPending, OrderStatusConfirmed}).
+		Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+		Where("deliveries.scheduled_at >= ? AND deliveries.scheduled_at < ?", start, end.AddDate(0, 0, 1))
+	query = budget.scope(query)
+	if err := query.Scan(&usage).Error; err != nil {
+		return err
+	}
+
+	budget.Usage = BudgetUsage{
+		BudgetID:  budget.ID,
+		Name:      budget.Name,
+		Amount:    budget.Amount,
+		Spent:     usage.Spent,
+		Committed: usage.Committed,
+		Remaining: budget.Amount - usage.Spent - usage.Committed,
+	}
+	return nil
+}
+
+// Restrict a query joined with deliveries to the deliveries the budget covers
+func (budget *Budget) scope(query *gorm.DB) *gorm.DB {
+	if budget.SchoolID != nil {
+		query = query.Where("deliveries.school_id = ?", *budget.SchoolID)
+	}
+	if budget.FundingSource != "" {
+		query = query.Where("deliveries.funding_source = ?", budget.FundingSource)
+	}
+	return query
+}
+
+// Find the budgets covering a saved delivery that it takes over their amount.
+// Budgets that were already over without the delivery are not reported again.
+func CheckDeliveryBudgets(Delivery *Delivery) ([]BudgetUsage, error) {
+	if Delivery.ScheduledAt == nil {
+		return nil, nil
+	}
+	day := Delivery.ScheduledAt.In(time.Local).Format("2006-01-02")
+
+	var budgets []Budget
+	query := db.Db.Where("period_start <= ? AND period_end >= ?", day, day)
+	if Delivery.SchoolID != nil {
+		query = query.Where("school_id IS NULL OR school_id = ?", *Delivery.SchoolID)
+	} else {
+		query = query.Where("school_id IS NULL")
+	}
+	query = query.Where("funding_source = '' OR funding_source = ?", Delivery.FundingSource)
+	if err := query.Find(&budgets).Error; err != nil {
+		return nil, err
+	}
+
+	// What the delivery adds to the usage of every budget covering it
+	var amount float64
+	err := db.Db.Model(&Order{}).Select("COALESCE(SUM(quantity * unit_cost), 0)").
+		Where("delivery_id = ? AND status IN ?", Delivery.ID,
+			[]string{OrderStatusCompleted, OrderStatusPending, OrderStatusConfirmed}).
+		Scan(&amount).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var exceeded []BudgetUsage
+	for i := range budgets {
+		if err := budgets[i].LoadUsage(); err != nil {
+			return nil, err
+		}
+		remaining := budgets[i].Usage.Remaining
+		if remaining < 0 && remaining+amount >= 0 {
+			exceeded = append(exceeded, budgets[i].Usage)
+		}
+	}
+	return exceeded, nil
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Days of past deliveries a calendar feed keeps listing
+const CalendarFeedPastDays = 90
+
+// CalendarFeed is the secret link to a user's iCalendar feed of deliveries,
+// for calendar apps that cannot sign in
+type CalendarFeed struct {
+	Model
+	UserID uint   `gorm:"uniqueIndex" json:"userId"`
+	User   *User  `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user,omitempty"`
+	Token  string `gorm:"uniqueIndex" json:"-"`
+}
+
+func newCalendarToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Get the calendar feed of a user, creating it if there is none
+func GetCalendarFeed(userID uint) (*CalendarFeed, error) {
+	var feeds []CalendarFeed
+	if err := db.Db.Where("user_id = ?", userID).Limit(1).Find(&feeds).Error; err != nil {
+		return nil, err
+	}
+	if len(feeds) > 0 {
+		return &feeds[0], nil
+	}
+
+	token, err := newCalendarToken()
+	if err != nil {
+		return nil, err
+	}
+	feed := CalendarFeed{UserID: userID, Token: token}
+	if err := db.Db.Create(&feed).Error; err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+// Get a calendar feed by its token, with its user
+func GetCalendarFeedByToken(CalendarFeed *CalendarFeed, token string) (err error) {
+	if token == "" {
+		return gorm.ErrRecordNotFound
+	}
+	err = db.Db.Preload("User").Where("token = ?", token).First(CalendarFeed).Error
+	if err != nil {
+		return err
+	}
+	if CalendarFeed.User == nil {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Give a calendar feed a new token, so that the old link stops working
+func ResetCalendarFeed(feed *CalendarFeed) (err error) {
+	token, err := newCalendarToken()
+	if err != nil {
+		return err
+	}
+	feed.Token = token
+	return db.Db.Model(feed).UpdateColumn("token", token).Error
+}
+
+// Get the scheduled deliveries a user can see for their calendar feed, from
+// CalendarFeedPastDays days ago on, with their school and orders' vendors.
+// Cancelled deliveries are included so that calendars can show them as cancelled.
+func GetCalendarDeliveries(user *User, now time.Time) ([]Delivery, error) {
+	var deliveries []Delivery
+	scope := scopeOf(user)
+	if scope.empty() {
+		return deliveries, nil
+	}
+	query := db.Db.Preload("School").Preload("Orders.Vendor").Model(&Delivery{}).
+		Where("deliveries.scheduled_at >= ?", now.AddDate(0, 0, -CalendarFeedPastDays))
+	err := scope.deliveries(query).Order("deliveries.scheduled_at asc").Find(&deliveries).Error
+	return deliveries, err
+}
+
+// DeletedDelivery is what calendar feeds keep of a deleted delivery, from its
+// delivery.deleted event, so that calendars cancel the event instead of losing it
+type DeletedDelivery struct {
+	ID          int
+	ScheduledAt time.Time
+	DeletedAt   time.Time
+}
+
+// Get the deliveries a user could see that were deleted, scheduled from
+// CalendarFeedPastDays days ago on. Deletions from before deleted deliveries
+// recorded their scheduled time are left out, as are IDs taken by a new delivery.
+func GetCalendarDeletedDeliveries(user *User, now time.Time) ([]DeletedDelivery, error) {
+	var deleted []DeletedDelivery
+	scope := scopeOf(user)
+	if scope.empty() {
+		return deleted, nil
+	}
+
+	since := now.AddDate(0, 0, -CalendarFeedPastDays)
+	var messages []OutboxMessage
+	err := db.Db.Where("topic = ? AND created_at >= ?", OutboxDeliveryDeleted, since).
+		Where("delivery_id NOT IN (?)", db.Db.Model(&Delivery{}).Select("id")).
+		Order("id asc").Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[int]bool{}
+	for _, message := range messages {
+		payload := message.Payload
+		if message.DeliveryID == nil || seen[*message.DeliveryID] || payload.ScheduledAt == nil || payload.ScheduledAt.Before(since) {
+			continue
+		}
+		visible := scope.all ||
+			(payload.SchoolID != nil && slices.Contains(scope.schoolIDs, *payload.SchoolID)) ||
+			slices.ContainsFunc(payload.VendorIDs, func(vendorID int) bool { return slices.Contains(scope.vendorIDs, vendorID) })
+		if !visible {
+			continue
+		}
+		seen[*message.DeliveryID] = true
+		deleted = append(deleted, DeletedDelivery{ID: *message.DeliveryID, ScheduledAt: *payload.ScheduledAt, DeletedAt: message.CreatedAt})
+	}
+	return deleted, nil
+}
@@ -1,9 +1,22 @@
 package models
 
 import (
+	"errors"
 	"time"
 
 	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Delivery statuses, computed from the delivery's orders
+const (
+	DeliveryStatusDraft          = "draft"
+	DeliveryStatusScheduled      = "scheduled"
+	DeliveryStatusPacking        = "packing"
+	DeliveryStatusOutForDelivery = "out-for-delivery"
+	DeliveryStatusDelivered      = "delivered"
+	DeliveryStatusCancelled      = "cancelled"
 )
 
 // Delivery model
@@ -15,14 +28,106 @@ type Delivery struct {
 
 	Contract string `json:"contract"` // hold, completed
 
+	// Computed from orders on every change, never set by clients
+	Status string `gorm:"<-:false;index;not null;default:draft" json:"status"` // draft, scheduled, packing, out-for-delivery, delivered, cancelled
+
 	PackageType string     `json:"packageType"` // standard, premium, standard-holiday, premium-holiday
 	ScheduledAt *time.Time `json:"scheduledAt"`
 
+	// Package version the orders were generated from, if any
+	PackageVersionID *int `json:"packageVersionId"`
+
 	// Belongs-to: School
 	SchoolID *int    `json:"schoolId"`
 	School   *School `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"school"`
 
 	Notes string `json:"notes"`
+
+	// Budget the delivery is charged to, besides the school's, e.g. a grant
+	FundingSource string `gorm:"index" json:"fundingSource"`
+
+	// Set when generated from a recurring schedule
+	ScheduleID     *int       `gorm:"index" json:"scheduleId"`
+	OccurrenceDate *time.Time `json:"occurrenceDate"` // original date in the series, kept when rescheduled
+	// Edited individually, so schedule changes leave it alone
+	ScheduleDetached bool `json:"scheduleDetached"`
+
+	// Problems with the scheduled date found when the delivery was last written
+	DateConflicts []DateConflict `gorm:"-" json:"dateConflicts,omitempty"`
+
+	// Cost of the delivery's orders, filled in by LoadDeliveryTotals or ComputeDeliveryTotals
+	Totals DeliveryTotals `gorm:"-" json:"totals"`
+
+	// Budgets exceeded by the delivery, returned on create only
+	BudgetWarnings []BudgetUsage `gorm:"-" json:"budgetWarnings,omitempty"`
+}
+
+// DeliveryTotals is the cost of a delivery's non-cancelled orders
+type DeliveryTotals struct {
+	Internal float64 `json:"internal"`
+	External float64 `json:"external"`
+	Total    float64 `json:"total"`
+}
+
+// Compute the totals of loaded orders
+func ComputeDeliveryTotals(orders []Order) DeliveryTotals {
+	var totals DeliveryTotals
+	for _, order := range orders {
+		if NormalizeOrderStatus(order.Status) == OrderStatusCancelled {
+			continue
+		}
+		if order.IsInternal {
+			totals.Internal += float64(order.Quantity) * order.UnitCost
+		} else {
+			totals.External += float64(order.Quantity) * order.UnitCost
+		}
+	}
+	totals.Total = totals.Internal + totals.External
+	return totals
+}
+
+// Fill in the totals of deliveries from their orders in a single query
+func LoadDeliveryTotals(deliveries []Delivery) (err error) {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	ids := make([]int, len(deliveries))
+	for i := range deliveries {
+		ids[i] = deliveries[i].ID
+	}
+
+	var rows []struct {
+		DeliveryID int
+		IsInternal bool
+		Total      float64
+	}
+	err = db.Db.Model(&Order{}).
+		Select("delivery_id, is_internal, SUM(quantity * unit_cost) AS total").
+		Where("delivery_id IN ? AND status != ?", ids, OrderStatusCancelled).
+		Group("delivery_id, is_internal").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	totals := map[int]*DeliveryTotals{}
+	for _, row := range rows {
+		if totals[row.DeliveryID] == nil {
+			totals[row.DeliveryID] = &DeliveryTotals{}
+		}
+		if row.IsInternal {
+			totals[row.DeliveryID].Internal += row.Total
+		} else {
+			totals[row.DeliveryID].External += row.Total
+		}
+	}
+	for i := range deliveries {
+		deliveries[i].Totals = DeliveryTotals{}
+		if total := totals[deliveries[i].ID]; total != nil {
+			total.Total = total.Internal + total.External
+			deliveries[i].Totals = *total
+		}
+	}
+	return nil
 }
 
 // Get all Deliveries
@@ -43,25 +148,90 @@ func GetDeliveryByID(Delivery *Delivery, id uint) (err error) {
 	return nil
 }
 
-// Create Delivery
+// Fill in the drop-off time and order quantities from the delivery's school.
+// A scheduledAt at local midnight is treated as a date without a time.
+func ApplySchoolDefaults(Delivery *Delivery) (err error) {
+	if Delivery.SchoolID == nil {
+		return nil
+	}
+	var school School
+	err = db.Db.First(&school, *Delivery.SchoolID).Error
+	if err != nil {
+		return err
+	}
+
+	if Delivery.ScheduledAt != nil {
+		local := Delivery.ScheduledAt.In(time.Local)
+		if local.Hour() == 0 && local.Minute() == 0 && local.Second() == 0 {
+			if dropOff, ok := school.DefaultDeliveryTime(local); ok {
+				Delivery.ScheduledAt = &dropOff
+			}
+		}
+	}
+
+	if school.Headcount > 0 {
+		for i := range Delivery.Orders {
+			if Delivery.Orders[i].Quantity == 0 {
+				Delivery.Orders[i].Quantity = school.Headcount
+			}
+		}
+	}
+	return nil
+}
+
+// Create Delivery, rejecting orders beyond their vendor's capacity. School
+// defaults are expected to be applied already, see ApplySchoolDefaults.
 func CreateDelivery(Delivery *Delivery) (err error) {
+	return createDelivery(db.Db, Delivery, nil, true)
+}
+
+// Create Delivery and its change logs in one transaction, e.g. the record of
+// an overridden date conflict. The logs get the new delivery's ID.
+func CreateDeliveryWithLogs(Delivery *Delivery, logs []DeliveryChangeLog) (err error) {
+	return createDelivery(db.Db, Delivery, logs, true)
+}
+
+// Create a delivery within tx, which may be a transaction the delivery is part of
+func createDelivery(tx *gorm.DB, Delivery *Delivery, logs []DeliveryChangeLog, checkCapacity bool) (err error) {
+	err = ApplyPackageContents(Delivery)
+	if err != nil {
+		return err
+	}
+
 	// Sanitize Orders
 	for i := range Delivery.Orders {
 		// Reset ID if negative (temporary frontend ID)
 		if Delivery.Orders[i].ID < 0 {
 			Delivery.Orders[i].ID = 0
 		}
-		// Handle internal vendor ID placeholder
-		if Delivery.Orders[i].VendorID != nil && *Delivery.Orders[i].VendorID == -1 {
-			Delivery.Orders[i].VendorID = nil
+		// Vendors must be known for the capacity check, this maps the deprecated internal vendor ID
+		order := &Delivery.Orders[i]
+		if err := resolveFulfillment(tx, &order.VendorID, &order.IsInternal, order.ID == 0); err != nil {
+			return err
 		}
 	}
 
-	err = db.Db.Create(Delivery).Error
-	if err != nil {
-		return err
+	if checkCapacity {
+		err = checkDeliveryCapacity(tx, Delivery)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(Delivery).Error; err != nil {
+			return err
+		}
+		if len(logs) > 0 {
+			for i := range logs {
+				logs[i].DeliveryID = uint(Delivery.ID)
+			}
+			if err := tx.Create(&logs).Error; err != nil {
+				return err
+			}
+		}
+		return enqueueDeliveryCreated(tx, Delivery)
+	})
 }
 
 // Update Delivery
@@ -73,11 +243,128 @@ func UpdateDelivery(Delivery *Delivery) (err error) {
 	return nil
 }
 
-// Delete Delivery
+// Update Delivery and save its change logs in one transaction, queueing a
+// delivery.updated event when anything changed. A delivery moved to another
+// time is rejected when its orders do not fit their vendors' capacity then.
+func UpdateDeliveryWithLogs(Delivery *Delivery, logs []DeliveryChangeLog) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := checkRescheduledCapacity(tx, Delivery); err != nil {
+			return err
+		}
+		if len(logs) > 0 {
+			if err := tx.Create(&logs).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(Delivery).Error; err != nil {
+			return err
+		}
+		return enqueueDeliveryUpdated(tx, Delivery, logs)
+	})
+}
+
+// Delete Delivery, excluding its occurrence from the schedule it was generated from
 func DeleteDelivery(Delivery *Delivery) (err error) {
-	err = db.Db.Delete(Delivery).Error
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if Delivery.ScheduleID != nil && Delivery.OccurrenceDate != nil {
+			var schedule DeliverySchedule
+			err := tx.First(&schedule, *Delivery.ScheduleID).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if err == nil {
+				schedule.ExcludedDates = append(schedule.ExcludedDates, Delivery.OccurrenceDate.In(time.Local).Format("2006-01-02"))
+				if err := tx.Model(&schedule).Select("ExcludedDates").Updates(&schedule).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if err := CancelDeliveryReminders(tx, Delivery.ID); err != nil {
+			return err
+		}
+		if err := enqueueDeliveryDeleted(tx, Delivery); err != nil {
+			return err
+		}
+		return tx.Delete(Delivery).Error
+	})
+}
+
+// Compute the delivery status from its schedule and orders
+func ComputeDeliveryStatus(delivery *Delivery) string {
+	var active, completed, packing int
+	for _, order := range delivery.Orders {
+		switch NormalizeOrderStatus(order.Status) {
+		case OrderStatusCancelled:
+			continue
+		case OrderStatusCompleted:
+			completed++
+		default:
+			if order.PackingTime != nil {
+				packing++
+			}
+		}
+		active++
+	}
+
+	switch {
+	case len(delivery.Orders) > 0 && active == 0:
+		return DeliveryStatusCancelled
+	case delivery.ScheduledAt == nil || active == 0:
+		return DeliveryStatusDraft
+	case completed == active:
+		return DeliveryStatusDelivered
+	case completed > 0:
+		return DeliveryStatusOutForDelivery
+	case packing > 0:
+		return DeliveryStatusPacking
+	}
+	return DeliveryStatusScheduled
+}
+
+// Recalculate and persist the status of a delivery. The status follows the
+// orders, so it is always stored as computed: transitions are enforced on the
+// order statuses that are set, not on the delivery status they add up to.
+func RefreshDeliveryStatus(tx *gorm.DB, deliveryID int) (string, error) {
+	var delivery Delivery
+	if err := tx.Preload("Orders").First(&delivery, deliveryID).Error; err != nil {
+		return "", err
+	}
+
+	status := ComputeDeliveryStatus(&delivery)
+	if status == delivery.Status {
+		return status, nil
+	}
+
+	err := tx.Table("deliveries").Where("id = ?", deliveryID).UpdateColumn("status", status).Error
+	if err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// Recalculate the status of every delivery, used to backfill existing rows
+func RefreshAllDeliveryStatuses() (err error) {
+	var deliveries []Delivery
+	err = db.Db.Preload("Orders").Find(&deliveries).Error
 	if err != nil {
 		return err
 	}
+	for _, delivery := range deliveries {
+		status := ComputeDeliveryStatus(&delivery)
+		err = db.Db.Table("deliveries").Where("id = ?", delivery.ID).UpdateColumn("status", status).Error
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// Keep the stored status and the reminders in sync after the delivery itself changes
+func (delivery *Delivery) AfterSave(tx *gorm.DB) (err error) {
+	status, err := RefreshDeliveryStatus(tx, delivery.ID)
+	if err != nil {
+		return err
+	}
+	delivery.Status = status
+	return SyncDeliveryReminders(tx, delivery, ReminderOffsets(), time.Now())
+}
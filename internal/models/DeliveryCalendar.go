@@ -0,0 +1,155 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+)
+
+// Calendar groupings
+const (
+	CalendarGroupByDay  = "day"
+	CalendarGroupByWeek = "week"
+)
+
+// Longest range a delivery calendar covers, a year of month views
+const DeliveryCalendarMaxDays = 366
+
+var ErrInvalidCalendarRange = errors.New("invalid calendar range")
+
+// DeliveryCalendarParams are the range and grouping of a delivery calendar, on
+// top of the filters of a deliveries query. Paging and sorting are ignored.
+type DeliveryCalendarParams struct {
+	DeliveryFilterParams
+	From     string `form:"from" binding:"required"` // first day, YYYY-MM-DD in Timezone, or RFC 3339
+	To       string `form:"to" binding:"required"`   // last day, included, or an RFC 3339 end, excluded
+	GroupBy  string `form:"groupBy"`                 // day (default), week
+	Timezone string `form:"timezone"`                // IANA name, the server's when empty
+}
+
+// DeliveryCalendarBucket is a day or week of a delivery calendar
+type DeliveryCalendarBucket struct {
+	Date          string         `json:"date"` // first day, YYYY-MM-DD in the calendar's timezone
+	Start         time.Time      `json:"start"`
+	End           time.Time      `json:"end"` // excluded
+	Total         int            `json:"total"`
+	ByStatus      map[string]int `json:"byStatus"`
+	ByPackageType map[string]int `json:"byPackageType"`
+	Deliveries    []Delivery     `json:"deliveries"`
+}
+
+// DeliveryCalendar is the deliveries of a range grouped by day or week, with
+// every day or week of the range present, also when it has no deliveries
+type DeliveryCalendar struct {
+	From     time.Time                `json:"from"`
+	To       time.Time                `json:"to"` // excluded
+	GroupBy  string                   `json:"groupBy"`
+	Timezone string                   `json:"timezone"`
+	Buckets  []DeliveryCalendarBucket `json:"buckets"`
+}
+
+// Parse a calendar bound, a date being the start of that day in the location
+func parseCalendarTime(value string, location *time.Location) (t time.Time, date bool, err error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", value, location)
+	return t, true, err
+}
+
+// Start of the day or week (from Monday) a time falls in, in its location
+func calendarBucketStart(t time.Time, groupBy string) time.Time {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if groupBy == CalendarGroupByWeek {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	}
+	return start
+}
+
+func nextCalendarBucket(start time.Time, groupBy string) time.Time {
+	if groupBy == CalendarGroupByWeek {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// Group the scheduled deliveries of a range matching the filters by day or week.
+// Days start at midnight in the params' timezone, so a delivery late in the
+// evening is not counted on the next day as it would be in UTC.
+func QueryDeliveryCalendar(params DeliveryCalendarParams) (DeliveryCalendar, error) {
+	calendar := DeliveryCalendar{GroupBy: params.GroupBy}
+	if calendar.GroupBy == "" {
+		calendar.GroupBy = CalendarGroupByDay
+	}
+	if calendar.GroupBy != CalendarGroupByDay && calendar.GroupBy != CalendarGroupByWeek {
+		return calendar, fmt.Errorf("%w: groupBy must be day or week", ErrInvalidCalendarRange)
+	}
+
+	location := time.Local
+	if params.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(params.Timezone); err != nil {
+			return calendar, fmt.Errorf("%w: unknown timezone %q", ErrInvalidCalendarRange, params.Timezone)
+		}
+	}
+	calendar.Timezone = location.String()
+
+	from, _, err := parseCalendarTime(params.From, location)
+	if err != nil {
+		return calendar, fmt.Errorf("%w: invalid from", ErrInvalidCalendarRange)
+	}
+	to, date, err := parseCalendarTime(params.To, location)
+	if err != nil {
+		return calendar, fmt.Errorf("%w: invalid to", ErrInvalidCalendarRange)
+	}
+	if date {
+		to = to.AddDate(0, 0, 1)
+	}
+	calendar.From, calendar.To = from.In(location), to.In(location)
+	if !calendar.To.After(calendar.From) {
+		return calendar, fmt.Errorf("%w: to must be after from", ErrInvalidCalendarRange)
+	}
+	if calendar.To.Sub(calendar.From) > DeliveryCalendarMaxDays*24*time.Hour {
+		return calendar, fmt.Errorf("%w: at most %d days", ErrInvalidCalendarRange, DeliveryCalendarMaxDays)
+	}
+
+	query := db.Db.Model(&Delivery{}).Preload("School").Preload("Orders.Vendor").
+		Where("deliveries.scheduled_at >= ? AND deliveries.scheduled_at < ?", calendar.From, calendar.To)
+	query, err = filterDeliveries(query, params.DeliveryFilterParams)
+	if err != nil {
+		return calendar, err
+	}
+	var deliveries []Delivery
+	if err := query.Order("deliveries.scheduled_at asc, deliveries.id asc").Find(&deliveries).Error; err != nil {
+		return calendar, err
+	}
+
+	// A week bucket may start before from, it still only holds deliveries of the range
+	index := map[string]int{}
+	for start := calendarBucketStart(calendar.From, calendar.GroupBy); start.Before(calendar.To); start = nextCalendarBucket(start, calendar.GroupBy) {
+		date := start.Format("2006-01-02")
+		index[date] = len(calendar.Buckets)
+		calendar.Buckets = append(calendar.Buckets, DeliveryCalendarBucket{
+			Date:          date,
+			Start:         start,
+			End:           nextCalendarBucket(start, calendar.GroupBy),
+			ByStatus:      map[string]int{},
+			ByPackageType: map[string]int{},
+			Deliveries:    []Delivery{},
+		})
+	}
+	for _, delivery := range deliveries {
+		i, ok := index[calendarBucketStart(delivery.ScheduledAt.In(location), calendar.GroupBy).Format("2006-01-02")]
+		if !ok {
+			continue
+		}
+		bucket := &calendar.Buckets[i]
+		bucket.Total++
+		bucket.ByStatus[delivery.Status]++
+		bucket.ByPackageType[delivery.PackageType]++
+		bucket.Deliveries = append(bucket.Deliveries, delivery)
+	}
+	return calendar, nil
+}
@@ -0,0 +1,284 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Reminder statuses
+const (
+	ReminderPending   = "pending"
+	ReminderSent      = "sent"
+	ReminderCancelled = "cancelled" // the delivery moved, was deleted or put on hold before it was due
+)
+
+// Reminder audiences
+const (
+	ReminderAudienceSchool = "school"
+	ReminderAudienceVendor = "vendor"
+)
+
+// Event type of reminders, for notification preferences and the log
+const ReminderEvent = "delivery.reminder"
+
+// Contract of deliveries that get no reminders
+const ContractHold = "hold"
+
+// Offsets before ScheduledAt reminders go out at, without DELIVERY_REMINDER_OFFSETS
+const DefaultReminderOffsets = "72h,24h"
+
+// DeliveryReminder is a reminder due some time before a delivery. Pending
+// reminders follow the delivery: they are rescheduled when it moves and cancelled
+// when it is deleted, cancelled or put on hold.
+type DeliveryReminder struct {
+	Model
+	DeliveryID int        `gorm:"index" json:"deliveryId"`
+	Offset     string     `json:"offset"` // before ScheduledAt, e.g. 72h
+	DueAt      time.Time  `gorm:"index" json:"dueAt"`
+	Status     string     `gorm:"index" json:"status"` // pending, sent, cancelled
+	SentAt     *time.Time `json:"sentAt"`
+}
+
+// Read the reminder offsets from DELIVERY_REMINDER_OFFSETS, a comma separated
+// list of durations such as 72h,24h, longest first
+func ReminderOffsets() []time.Duration {
+	value := os.Getenv("DELIVERY_REMINDER_OFFSETS")
+	if value == "" {
+		value = DefaultReminderOffsets
+	}
+	offsets, err := parseReminderOffsets(value)
+	if err != nil {
+		log.Printf("Invalid DELIVERY_REMINDER_OFFSETS %q, using %s: %v", value, DefaultReminderOffsets, err)
+		offsets, _ = parseReminderOffsets(DefaultReminderOffsets)
+	}
+	return offsets
+}
+
+func parseReminderOffsets(value string) ([]time.Duration, error) {
+	var offsets []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		offset, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, err
+		}
+		if offset <= 0 {
+			return nil, fmt.Errorf("offset %s is not positive", part)
+		}
+		offsets = append(offsets, offset)
+	}
+	slices.Sort(offsets)
+	slices.Reverse(offsets)
+	return slices.Compact(offsets), nil
+}
+
+// Format an offset the way it is configured, 72h rather than 72h0m0s
+func FormatReminderOffset(offset time.Duration) string {
+	s := offset.String()
+	if strings.HasSuffix(s, "h0m0s") {
+		return strings.TrimSuffix(s, "0m0s")
+	}
+	if strings.HasSuffix(s, "m0s") {
+		return strings.TrimSuffix(s, "0s")
+	}
+	return s
+}
+
+// Does a delivery get reminders at all
+func RemindersApply(delivery *Delivery) bool {
+	return delivery.ScheduledAt != nil && delivery.Contract != ContractHold && delivery.Status != DeliveryStatusCancelled
+}
+
+// Bring the pending reminders of a delivery in line with its schedule. Reminders
+// whose time has passed are not created, unchanged ones are kept and the rest
+// are cancelled.
+func SyncDeliveryReminders(tx *gorm.DB, delivery *Delivery, offsets []time.Duration, now time.Time) (err error) {
+	wanted := map[string]time.Time{}
+	if RemindersApply(delivery) {
+		for _, offset := range offsets {
+			if dueAt := delivery.ScheduledAt.Add(-offset); dueAt.After(now) {
+				wanted[FormatReminderOffset(offset)] = dueAt
+			}
+		}
+	}
+
+	// A reminder already sent for the same time is not sent again
+	var existing []DeliveryReminder
+	err = tx.Where("delivery_id = ? AND status IN ?", delivery.ID, []string{ReminderPending, ReminderSent}).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	var stale []int
+	for _, reminder := range existing {
+		if dueAt, ok := wanted[reminder.Offset]; ok && dueAt.Equal(reminder.DueAt) {
+			delete(wanted, reminder.Offset)
+			continue
+		}
+		if reminder.Status == ReminderPending {
+			stale = append(stale, reminder.ID)
+		}
+	}
+	if len(stale) > 0 {
+		err = tx.Model(&DeliveryReminder{}).Where("id IN ?", stale).UpdateColumn("status", ReminderCancelled).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	for offset, dueAt := range wanted {
+		reminder := DeliveryReminder{DeliveryID: delivery.ID, Offset: offset, DueAt: dueAt, Status: ReminderPending}
+		if err := tx.Create(&reminder).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel the pending reminders of a delivery
+func CancelDeliveryReminders(tx *gorm.DB, deliveryID int) (err error) {
+	return tx.Model(&DeliveryReminder{}).Where("delivery_id = ? AND status = ?", deliveryID, ReminderPending).
+		UpdateColumn("status", ReminderCancelled).Error
+}
+
+// Get the reminders of a delivery, earliest first
+func GetDeliveryReminders(DeliveryReminders *[]DeliveryReminder, deliveryID int) (err error) {
+	err = db.Db.Where("delivery_id = ?", deliveryID).Order("due_at asc, id asc").Find(DeliveryReminders).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the pending reminders due at or before now
+func GetDueDeliveryReminders(now time.Time, limit int) ([]DeliveryReminder, error) {
+	var reminders []DeliveryReminder
+	err := db.Db.Where("status = ? AND due_at <= ?", ReminderPending, now).Order("due_at asc, id asc").Limit(limit).Find(&reminders).Error
+	return reminders, err
+}
+
+// Mark a reminder sent or cancelled, queueing its notifications in the same
+// transaction. Nothing happens if it is no longer pending.
+func CloseDeliveryReminder(reminder *DeliveryReminder, status string, notifications []OutboxMessage, now time.Time) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]any{"status": status}
+		if status == ReminderSent {
+			updates["sent_at"] = now
+		}
+		result := tx.Model(&DeliveryReminder{}).Where("id = ? AND status = ?", reminder.ID, ReminderPending).UpdateColumns(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		for i := range notifications {
+			if err := EnqueueOutbox(tx, &notifications[i]); err != nil {
+				return err
+			}
+		}
+		reminder.Status = status
+		if status == ReminderSent {
+			reminder.SentAt = &now
+		}
+		return nil
+	})
+}
+
+// ReminderRecipient is a user a reminder goes to, with the orders they are reminded of
+type ReminderRecipient struct {
+	User     User    `json:"user"`
+	Audience string  `json:"audience"` // school, vendor
+	Orders   []Order `json:"orders"`
+}
+
+// Get who a delivery's reminders go to: the school's contact, or its admins when
+// it has none, and the vendor admins of each order still going ahead. The
+// delivery needs its School and Orders.Vendor loaded.
+func GetReminderRecipients(delivery *Delivery) ([]ReminderRecipient, error) {
+	var orders []Order
+	for _, order := range delivery.Orders {
+		if NormalizeOrderStatus(order.Status) != OrderStatusCancelled {
+			orders = append(orders, order)
+		}
+	}
+
+	var recipients []ReminderRecipient
+	if delivery.School != nil {
+		var contacts []User
+		if delivery.School.ContactID != nil {
+			var contact User
+			if err := db.Db.Limit(1).Find(&contact, *delivery.School.ContactID).Error; err != nil {
+				return nil, err
+			}
+			if contact.ID != 0 {
+				contacts = append(contacts, contact)
+			}
+		}
+		if len(contacts) == 0 {
+			admins, err := GetUsersByRole(fmt.Sprintf("school_admin:%d", delivery.School.ID))
+			if err != nil {
+				return nil, err
+			}
+			contacts = *admins
+		}
+		for _, contact := range contacts {
+			recipients = append(recipients, ReminderRecipient{User: contact, Audience: ReminderAudienceSchool, Orders: orders})
+		}
+	}
+
+	var vendorIDs []int
+	for _, order := range orders {
+		if order.VendorID != nil && !slices.Contains(vendorIDs, *order.VendorID) {
+			vendorIDs = append(vendorIDs, *order.VendorID)
+		}
+	}
+	slices.Sort(vendorIDs)
+	vendorRecipients := map[int]int{} // user ID to index in recipients
+	for _, vendorID := range vendorIDs {
+		admins, err := GetUsersByRole(fmt.Sprintf("vendor_admin:%d", vendorID))
+		if err != nil {
+			return nil, err
+		}
+		for _, admin := range *admins {
+			i, ok := vendorRecipients[admin.ID]
+			if !ok {
+				i = len(recipients)
+				vendorRecipients[admin.ID] = i
+				recipients = append(recipients, ReminderRecipient{User: admin, Audience: ReminderAudienceVendor})
+			}
+			for _, order := range orders {
+				if order.VendorID != nil && *order.VendorID == vendorID {
+					recipients[i].Orders = append(recipients[i].Orders, order)
+				}
+			}
+		}
+	}
+	return recipients, nil
+}
+
+// Schedule the reminders of every upcoming delivery, used when reminders are first turned on
+func ScheduleAllDeliveryReminders(now time.Time) (err error) {
+	var deliveries []Delivery
+	err = db.Db.Where("scheduled_at > ?", now).Find(&deliveries).Error
+	if err != nil {
+		return err
+	}
+	offsets := ReminderOffsets()
+	for i := range deliveries {
+		if err := SyncDeliveryReminders(db.Db, &deliveries[i], offsets, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// How an occurrence falling on a blackout date is handled
+const (
+	BlackoutPolicySkip  = "skip"
+	BlackoutPolicyShift = "shift"
+)
+
+// Shifted occurrences move forward at most this many days
+const maxBlackoutShiftDays = 7
+
+// Default number of days ahead that deliveries are generated for
+const defaultScheduleLeadDays = 28
+
+// DeliverySchedule is a recurring delivery of the same package to a school
+type DeliverySchedule struct {
+	Model
+
+	// Belongs-to: School
+	SchoolID *int    `json:"schoolId"`
+	School   *School `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"school,omitempty"`
+
+	PackageType string `json:"packageType"` // standard, premium, standard-holiday, premium-holiday
+	Recurrence  string `json:"recurrence"`  // RRULE, e.g. FREQ=WEEKLY;BYDAY=TU
+
+	// First occurrence, its clock time is used for every delivery
+	StartsAt time.Time  `json:"startsAt"`
+	EndsAt   *time.Time `json:"endsAt"`
+
+	// Orders created for every generated delivery
+	OrderTemplates []ScheduledOrder `gorm:"serializer:json" json:"orderTemplates"`
+
+	BlackoutPolicy string   `gorm:"default:skip" json:"blackoutPolicy"` // skip, shift
+	BlackoutDates  []string `gorm:"serializer:json" json:"blackoutDates"`
+	// Occurrences removed individually, never regenerated
+	ExcludedDates []string `gorm:"serializer:json" json:"excludedDates"`
+
+	LeadDays int  `json:"leadDays"` // how many days ahead deliveries are generated
+	Paused   bool `json:"paused"`
+
+	Notes string `json:"notes"`
+}
+
+// ScheduledOrder is the template of an order generated for each occurrence
+type ScheduledOrder struct {
+	ItemID     *int    `json:"itemId"`
+	Item       string  `json:"item"`
+	Quantity   int     `json:"quantity"`
+	UnitCost   float64 `json:"unitPrice"`
+	VendorID   *int    `json:"vendorId"`
+	IsInternal bool    `json:"isInternal"`
+	Notes      string  `json:"notes"`
+}
+
+// Get all Delivery Schedules
+func GetAllDeliverySchedules(DeliverySchedule *[]DeliverySchedule) (err error) {
+	err = db.Db.Preload("School").Find(DeliverySchedule).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get Delivery Schedule by ID
+func GetDeliveryScheduleByID(DeliverySchedule *DeliverySchedule, id uint) (err error) {
+	err = db.Db.First(DeliverySchedule, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Delivery Schedule
+func CreateDeliverySchedule(DeliverySchedule *DeliverySchedule) (err error) {
+	err = db.Db.Create(DeliverySchedule).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update Delivery Schedule, regenerating upcoming occurrences that were not edited individually
+func UpdateDeliverySchedule(DeliverySchedule *DeliverySchedule) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(DeliverySchedule).Error; err != nil {
+			return err
+		}
+		if err := removeUpcomingOccurrences(tx, DeliverySchedule.ID); err != nil {
+			return err
+		}
+		_, err := generateScheduleDeliveries(tx, DeliverySchedule, time.Now())
+		return err
+	})
+}
+
+// Delete Delivery Schedule together with its upcoming occurrences
+func DeleteDeliverySchedule(DeliverySchedule *DeliverySchedule) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := removeUpcomingOccurrences(tx, DeliverySchedule.ID); err != nil {
+			return err
+		}
+		return tx.Delete(DeliverySchedule).Error
+	})
+}
+
+// Remove generated deliveries that have not started and were not edited individually,
+// queueing their deleted events and releasing the stock reserved for their orders
+func removeUpcomingOccurrences(tx *gorm.DB, scheduleID int) error {
+	var deliveries []Delivery
+	err := tx.Preload("Orders").
+		Where("schedule_id = ? AND schedule_detached = ? AND scheduled_at > ?", scheduleID, false, time.Now()).
+		Where("status IN ?", []string{DeliveryStatusDraft, DeliveryStatusScheduled}).
+		Find(&deliveries).Error
+	if err != nil {
+		return err
+	}
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		if err := CancelDeliveryReminders(tx, delivery.ID); err != nil {
+			return err
+		}
+		if err := enqueueDeliveryDeleted(tx, delivery); err != nil {
+			return err
+		}
+		// One by one, so that AfterDelete releases each order's reservation
+		for j := range delivery.Orders {
+			if err := tx.Delete(&delivery.Orders[j]).Error; err != nil {
+				return err
+			}
+			if err := enqueueOrderDeleted(tx, &delivery.Orders[j]); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&Delivery{}, delivery.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve the vendor of each order template before the schedule is written, see resolveFulfillment
+func (schedule *DeliverySchedule) BeforeSave(tx *gorm.DB) (err error) {
+	for i := range schedule.OrderTemplates {
+		template := &schedule.OrderTemplates[i]
+		if err := resolveFulfillment(tx, &template.VendorID, &template.IsInternal, true); err != nil {
+			return fmt.Errorf("order template %q: %w", template.Item, err)
+		}
+	}
+	return nil
+}
+
+// Is the date blacked out for this schedule, by its own dates or the school and global calendar
+func (schedule *DeliverySchedule) isBlackedOut(date time.Time, blackouts []BlackoutDate) bool {
+	day := date.In(time.Local).Format("2006-01-02")
+	return slices.Contains(schedule.BlackoutDates, day) || FindBlackout(blackouts, day) != nil
+}
+
+// Generate the missing deliveries of a schedule up to its lead time from now
+func GenerateScheduleDeliveries(schedule *DeliverySchedule, now time.Time) ([]Delivery, error) {
+	return generateScheduleDeliveries(db.Db, schedule, now)
+}
+
+func generateScheduleDeliveries(tx *gorm.DB, schedule *DeliverySchedule, now time.Time) ([]Delivery, error) {
+	if schedule.Paused {
+		return nil, nil
+	}
+
+	recurrence, err := ParseRecurrence(schedule.Recurrence)
+	if err != nil {
+		return nil, err
+	}
+
+	leadDays := schedule.LeadDays
+	if leadDays <= 0 {
+		leadDays = defaultScheduleLeadDays
+	}
+	to := now.AddDate(0, 0, leadDays)
+	if schedule.EndsAt != nil && schedule.EndsAt.Before(to) {
+		to = *schedule.EndsAt
+	}
+
+	// Occurrences already materialized, keyed by their original date
+	var existing []Delivery
+	err = tx.Where("schedule_id = ?", schedule.ID).Find(&existing).Error
+	if err != nil {
+		return nil, err
+	}
+	generated := map[string]bool{}
+	for _, delivery := range existing {
+		if delivery.OccurrenceDate != nil {
+			generated[delivery.OccurrenceDate.In(time.Local).Format("2006-01-02")] = true
+		}
+	}
+
+	blackouts, err := GetBlackoutDates(schedule.SchoolID, now.In(time.Local).Format("2006-01-02"), to.AddDate(0, 0, maxBlackoutShiftDays).In(time.Local).Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Step through the dates in the local zone, so occurrences keep their wall
+	// clock time across daylight saving changes
+	var created []Delivery
+	for _, occurrence := range recurrence.Between(schedule.StartsAt.In(time.Local), now, to) {
+		key := occurrence.In(time.Local).Format("2006-01-02")
+		if generated[key] || slices.Contains(schedule.ExcludedDates, key) {
+			continue
+		}
+
+		scheduledAt := occurrence
+		if schedule.isBlackedOut(scheduledAt, blackouts) {
+			if schedule.BlackoutPolicy != BlackoutPolicyShift {
+				continue
+			}
+			shifted := false
+			for range maxBlackoutShiftDays {
+				scheduledAt = scheduledAt.AddDate(0, 0, 1)
+				if !schedule.isBlackedOut(scheduledAt, blackouts) {
+					shifted = true
+					break
+				}
+			}
+			if !shifted {
+				continue
+			}
+		}
+
+		occurrenceDate := occurrence
+		delivery := Delivery{
+			ScheduleID:     &schedule.ID,
+			OccurrenceDate: &occurrenceDate,
+			ScheduledAt:    &scheduledAt,
+			SchoolID:       schedule.SchoolID,
+			PackageType:    schedule.PackageType,
+			Notes:          schedule.Notes,
+		}
+		for _, template := range schedule.OrderTemplates {
+			delivery.Orders = append(delivery.Orders, Order{
+				ItemID:     template.ItemID,
+				Item:       template.Item,
+				Quantity:   template.Quantity,
+				UnitCost:   template.UnitCost,
+				VendorID:   template.VendorID,
+				IsInternal: template.IsInternal,
+				Notes:      template.Notes,
+				Status:     OrderStatusPending,
+			})
+		}
+
+		if err := ApplySchoolDefaults(&delivery); err != nil {
+			return created, err
+		}
+
+		// Schools still get their delivery, the vendor's inbox and escalation surface the overbooking
+		err := createDelivery(tx, &delivery, nil, true)
+		if errors.Is(err, ErrVendorCapacity) {
+			log.Printf("Schedule %d on %s: %v", schedule.ID, key, err)
+			err = createDelivery(tx, &delivery, nil, false)
+		}
+		if err != nil {
+			return created, err
+		}
+		created = append(created, delivery)
+	}
+
+	return created, nil
+}
+
+// Generate upcoming deliveries for every schedule that is not paused
+func GenerateAllScheduleDeliveries(now time.Time) (int, error) {
+	var schedules []DeliverySchedule
+	err := db.Db.Where("paused = ?", false).Find(&schedules).Error
+	if err != nil {
+		return 0, err
+	}
+
+	// A schedule that fails is skipped, so it does not hold up the others
+	count := 0
+	var errs []error
+	for i := range schedules {
+		created, err := GenerateScheduleDeliveries(&schedules[i], now)
+		count += len(created)
+		if err != nil {
+			log.Printf("Failed to generate deliveries of schedule %d: %v", schedules[i].ID, err)
+			errs = append(errs, fmt.Errorf("schedule %d: %w", schedules[i].ID, err))
+		}
+	}
+	return count, errors.Join(errs...)
+}
@@ -0,0 +1,279 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Digest frequencies
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// Days of upcoming deliveries a digest lists
+const DigestUpcomingDays = 7
+
+var ErrInvalidDigestFrequency = errors.New("invalid digest frequency, use daily or weekly")
+
+// DigestSubscription is how often a user gets the digest. Whether the digest is
+// sent and which changes it lists follow the user's digest preferences.
+type DigestSubscription struct {
+	Model
+	UserID     uint       `gorm:"uniqueIndex" json:"userId"`
+	User       *User      `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user,omitempty"`
+	Frequency  string     `json:"frequency"`            // daily, weekly
+	Token      string     `gorm:"uniqueIndex" json:"-"` // identifies the user in unsubscribe links
+	LastSentAt *time.Time `json:"lastSentAt"`
+}
+
+// Digest is what a digest lists for one recipient
+type Digest struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+
+	// Deliveries in the next DigestUpcomingDays days, with their school and orders' vendors
+	Upcoming []Delivery `json:"upcoming"`
+
+	// Changes since the last digest made by others, of the kinds the user wants in the digest
+	DeliveryChanges []DeliveryChangeLog `json:"deliveryChanges"`
+	OrderChanges    []OrderChangeLog    `json:"orderChanges"`
+
+	// Upcoming orders still waiting for their vendor to confirm
+	AwaitingConfirmation []Order `json:"awaitingConfirmation"`
+	// Vendor change proposals waiting for an admin, admins only
+	ProposedChanges []Order `json:"proposedChanges"`
+}
+
+func newDigestToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Get the digest subscription of a user, creating a daily one if there is none
+func GetDigestSubscription(userID uint) (*DigestSubscription, error) {
+	var subscriptions []DigestSubscription
+	if err := db.Db.Where("user_id = ?", userID).Limit(1).Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	if len(subscriptions) > 0 {
+		return &subscriptions[0], nil
+	}
+
+	token, err := newDigestToken()
+	if err != nil {
+		return nil, err
+	}
+	subscription := DigestSubscription{UserID: userID, Frequency: DigestDaily, Token: token}
+	if err := db.Db.Create(&subscription).Error; err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// Get a digest subscription by its unsubscribe token
+func GetDigestSubscriptionByToken(DigestSubscription *DigestSubscription, token string) (err error) {
+	if token == "" {
+		return gorm.ErrRecordNotFound
+	}
+	err = db.Db.Where("token = ?", token).First(DigestSubscription).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Change how often a user gets the digest
+func SetDigestFrequency(subscription *DigestSubscription, frequency string) (err error) {
+	if frequency != DigestDaily && frequency != DigestWeekly {
+		return ErrInvalidDigestFrequency
+	}
+	subscription.Frequency = frequency
+	return db.Db.Model(subscription).UpdateColumn("frequency", frequency).Error
+}
+
+// Turn the digest on or off for every event of a user
+func SetDigestEnabled(userID uint, enabled bool) (err error) {
+	var preferences []NotificationPreference
+	for _, eventType := range NotificationEvents {
+		preferences = append(preferences, NotificationPreference{EventType: eventType, Channel: NotificationChannelDigest, Enabled: enabled})
+	}
+	return SetNotificationPreferences(userID, preferences)
+}
+
+// Is the digest on for any event of the user
+func WantsDigest(preferences NotificationPreferences) bool {
+	return slices.ContainsFunc(NotificationEvents, func(eventType string) bool {
+		return preferences.Enabled(eventType, NotificationChannelDigest)
+	})
+}
+
+// Get the subscriptions of users with the digest on for any event, with their
+// users. The digest is off by default, so only users who turned it on are found.
+func GetDigestSubscriptions() ([]DigestSubscription, error) {
+	var userIDs []uint
+	err := db.Db.Model(&NotificationPreference{}).
+		Where("channel = ? AND enabled = ?", NotificationChannelDigest, true).
+		Distinct().Pluck("user_id", &userIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []DigestSubscription
+	for _, userID := range userIDs {
+		subscription, err := GetDigestSubscription(userID)
+		if err != nil {
+			return nil, err
+		}
+		var user User
+		if err := db.Db.Limit(1).Find(&user, userID).Error; err != nil {
+			return nil, err
+		}
+		if user.ID == 0 {
+			continue
+		}
+		subscription.User = &user
+		subscriptions = append(subscriptions, *subscription)
+	}
+	return subscriptions, nil
+}
+
+// Record that a digest went out, together with the outbox message that sends it
+func QueueDigest(subscription *DigestSubscription, message *OutboxMessage, sentAt time.Time) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if message != nil {
+			if err := EnqueueOutbox(tx, message); err != nil {
+				return err
+			}
+		}
+		subscription.LastSentAt = &sentAt
+		return tx.Model(subscription).UpdateColumn("last_sent_at", sentAt).Error
+	})
+}
+
+// Is the digest empty, so that there is no point in sending it
+func (digest *Digest) IsEmpty() bool {
+	return len(digest.Upcoming) == 0 && len(digest.DeliveryChanges) == 0 && len(digest.OrderChanges) == 0 &&
+		len(digest.AwaitingConfirmation) == 0 && len(digest.ProposedChanges) == 0
+}
+
+// The schools and vendors a user's roles cover, all when the user is an admin
+type roleScope struct {
+	all       bool
+	schoolIDs []int
+	vendorIDs []int
+}
+
+func scopeOf(user *User) roleScope {
+	var scope roleScope
+	for _, role := range ParseRoles(user.Roles) {
+		switch {
+		case role.Role == "admin":
+			scope.all = true
+		case role.Role == "school_admin" && role.EntityID != nil:
+			scope.schoolIDs = append(scope.schoolIDs, int(*role.EntityID))
+		case role.Role == "vendor_admin" && role.EntityID != nil:
+			scope.vendorIDs = append(scope.vendorIDs, int(*role.EntityID))
+		}
+	}
+	return scope
+}
+
+func (scope roleScope) empty() bool {
+	return !scope.all && len(scope.schoolIDs) == 0 && len(scope.vendorIDs) == 0
+}
+
+// Limit a deliveries query to the scope
+func (scope roleScope) deliveries(query *gorm.DB) *gorm.DB {
+	if scope.all {
+		return query
+	}
+	return query.Where("deliveries.school_id IN ? OR deliveries.id IN (?)",
+		append(scope.schoolIDs, 0), db.Db.Model(&Order{}).Select("delivery_id").Where("vendor_id IN ?", append(scope.vendorIDs, 0)))
+}
+
+// Limit an orders query joined with deliveries to the scope
+func (scope roleScope) orders(query *gorm.DB) *gorm.DB {
+	if scope.all {
+		return query
+	}
+	return query.Where("orders.vendor_id IN ? OR deliveries.school_id IN ?", append(scope.vendorIDs, 0), append(scope.schoolIDs, 0))
+}
+
+// Compile the digest of a user for the period from since to now
+func BuildDigest(user *User, preferences NotificationPreferences, since time.Time, now time.Time) (Digest, error) {
+	digest := Digest{Since: since, Until: now}
+	scope := scopeOf(user)
+	if scope.empty() {
+		return digest, nil
+	}
+
+	query := db.Db.Preload("School").Preload("Orders.Vendor").Model(&Delivery{}).
+		Where("deliveries.scheduled_at >= ? AND deliveries.scheduled_at < ? AND deliveries.status != ?", now, now.AddDate(0, 0, DigestUpcomingDays), DeliveryStatusCancelled)
+	err := scope.deliveries(query).Order("deliveries.scheduled_at asc").Find(&digest.Upcoming).Error
+	if err != nil {
+		return digest, fmt.Errorf("upcoming deliveries: %w", err)
+	}
+
+	if preferences.Enabled(OutboxDeliveryUpdated, NotificationChannelDigest) {
+		query := db.Db.Preload("ChangedByUser").Model(&DeliveryChangeLog{}).
+			Joins("JOIN deliveries ON deliveries.id = delivery_change_logs.delivery_id").
+			Where("delivery_change_logs.changed_at > ? AND delivery_change_logs.changed_at <= ?", since, now).
+			Where("delivery_change_logs.change_by_user_id != ?", user.ID)
+		err := scope.deliveries(query).Order("delivery_change_logs.changed_at asc").Find(&digest.DeliveryChanges).Error
+		if err != nil {
+			return digest, fmt.Errorf("delivery changes: %w", err)
+		}
+	}
+
+	statusChanges := preferences.Enabled(OutboxOrderStatusChanged, NotificationChannelDigest)
+	otherChanges := preferences.Enabled(OutboxOrderUpdated, NotificationChannelDigest)
+	if statusChanges || otherChanges {
+		var changes []OrderChangeLog
+		query := db.Db.Preload("ChangedByUser").Model(&OrderChangeLog{}).
+			Joins("JOIN orders ON orders.id = order_change_logs.order_id").
+			Joins("LEFT JOIN deliveries ON deliveries.id = orders.delivery_id").
+			Where("order_change_logs.changed_at > ? AND order_change_logs.changed_at <= ?", since, now).
+			Where("order_change_logs.change_by_user_id != ?", user.ID)
+		err := scope.orders(query).Order("order_change_logs.changed_at asc").Find(&changes).Error
+		if err != nil {
+			return digest, fmt.Errorf("order changes: %w", err)
+		}
+		for _, change := range changes {
+			if (change.FieldName == "status" && statusChanges) || (change.FieldName != "status" && otherChanges) {
+				digest.OrderChanges = append(digest.OrderChanges, change)
+			}
+		}
+	}
+
+	query = db.Db.Preload("Delivery.School").Preload("Vendor").Model(&Order{}).
+		Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+		Where("orders.status = ? AND orders.vendor_response = ? AND orders.is_internal = ?", OrderStatusPending, "", false).
+		Where("deliveries.scheduled_at >= ?", now)
+	err = scope.orders(query).Order("deliveries.scheduled_at asc, orders.id asc").Find(&digest.AwaitingConfirmation).Error
+	if err != nil {
+		return digest, fmt.Errorf("orders awaiting confirmation: %w", err)
+	}
+
+	if scope.all {
+		err := db.Db.Preload("Delivery.School").Preload("Vendor").Model(&Order{}).
+			Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+			Where("orders.status = ? AND orders.vendor_response = ?", OrderStatusPending, VendorResponseChangeProposed).
+			Order("deliveries.scheduled_at asc, orders.id asc").Find(&digest.ProposedChanges).Error
+		if err != nil {
+			return digest, fmt.Errorf("proposed changes: %w", err)
+		}
+	}
+	return digest, nil
+}
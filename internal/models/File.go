@@ -2,7 +2,12 @@ package models
 
 import (
 	"LindaBen_Phase_1_Project/internal/db"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"gorm.io/gorm"
@@ -13,6 +18,9 @@ type File struct {
 	// Path is internal
 	Path string `json:"-" gorm:"not null"`
 	Url  string `json:"url" gorm:"-"`
+
+	// Stored in DOCUMENT_PATH, served only by the handler of what it belongs to
+	Private bool `json:"-"`
 }
 
 // Save File details
@@ -23,7 +31,62 @@ func (file *File) Save() (*File, error) {
 	return file, nil
 }
 
+// Directory of private files, outside the public upload path
+func documentPath() string {
+	if path := os.Getenv("DOCUMENT_PATH"); path != "" {
+		return path
+	}
+	return "./documents/"
+}
+
+// Write generated content as a private file and save its file details with tx.
+// The file is removed again if its details cannot be saved; callers remove it
+// with RemoveFileContent when tx is rolled back later.
+func SaveGeneratedFile(tx *gorm.DB, name string, data []byte) (*File, error) {
+	if err := os.MkdirAll(documentPath(), 0o700); err != nil {
+		return nil, err
+	}
+
+	// Random names, so that one document's name does not give away another's
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	file := &File{
+		Path:    fmt.Sprintf("%s_%s", hex.EncodeToString(token), filepath.Base(name)),
+		Private: true,
+	}
+	if err := os.WriteFile(file.FullPath(), data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := tx.Create(file).Error; err != nil {
+		RemoveFileContent(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+// Where the file is stored on disk
+func (file *File) FullPath() string {
+	if file.Private {
+		return filepath.Join(documentPath(), file.Path)
+	}
+	return filepath.Join(os.Getenv("UPLOAD_PATH"), file.Path)
+}
+
+// Remove the stored content of a file, logging failures as there is nothing
+// left for the caller to do about them
+func RemoveFileContent(file *File) {
+	if err := os.Remove(file.FullPath()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove file %s: %v", file.Path, err)
+	}
+}
+
+// The public url of an uploaded file, private files have none
 func GetUrl(file *File) string {
+	if file.Private {
+		return ""
+	}
 	baseUrl := os.Getenv("BASE_URL")
 	baseUrl = strings.TrimRight(baseUrl, "/")
 
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Deprecated vendor ID clients used for orders fulfilled by the organization
+const InternalVendorSentinel = -1
+
+// Name of the internal vendor when INTERNAL_VENDOR_NAME is not set
+const DefaultInternalVendorName = "LindaBen"
+
+// Last day the sentinel is accepted when VENDOR_SENTINEL_SUNSET is not set
+const DefaultVendorSentinelSunset = "2026-12-31"
+
+var (
+	ErrVendorSentinel          = errors.New("vendorId -1 is no longer supported, use the internal vendor's id")
+	ErrInconsistentFulfillment = errors.New("isInternal does not match the vendor")
+	ErrInternalVendorRequired  = errors.New("the internal vendor cannot be deleted or unflagged")
+)
+
+// Get the vendor record of the organization itself
+func GetInternalVendor(tx *gorm.DB) (*Vendor, error) {
+	var vendors []Vendor
+	if err := tx.Where("is_internal = ?", true).Order("id asc").Limit(1).Find(&vendors).Error; err != nil {
+		return nil, err
+	}
+	if len(vendors) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &vendors[0], nil
+}
+
+// Make sure the internal vendor exists. A vendor already named like the
+// organization is flagged rather than duplicated.
+func EnsureInternalVendor() (*Vendor, error) {
+	vendor, err := GetInternalVendor(db.Db)
+	if err == nil || !errors.Is(err, gorm.ErrRecordNotFound) {
+		return vendor, err
+	}
+
+	name := os.Getenv("INTERNAL_VENDOR_NAME")
+	if name == "" {
+		name = DefaultInternalVendorName
+	}
+	var vendors []Vendor
+	if err := db.Db.Where("name = ?", name).Limit(1).Find(&vendors).Error; err != nil {
+		return nil, err
+	}
+	if len(vendors) > 0 {
+		vendor = &vendors[0]
+		vendor.IsInternal = true
+		err = db.Db.Model(vendor).UpdateColumn("is_internal", true).Error
+	} else {
+		vendor = &Vendor{Name: name, IsInternal: true}
+		err = db.Db.Create(vendor).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using vendor %d %q as the internal vendor", vendor.ID, vendor.Name)
+	return vendor, nil
+}
+
+// Is the deprecated vendor ID sentinel still accepted
+func VendorSentinelAccepted(now time.Time) bool {
+	sunset := os.Getenv("VENDOR_SENTINEL_SUNSET")
+	if sunset == "" {
+		sunset = DefaultVendorSentinelSunset
+	}
+	day, err := time.ParseInLocation("2006-01-02", sunset, time.Local)
+	if err != nil {
+		log.Printf("Invalid VENDOR_SENTINEL_SUNSET %q, using %s", sunset, DefaultVendorSentinelSunset)
+		day, _ = time.ParseInLocation("2006-01-02", DefaultVendorSentinelSunset, time.Local)
+	}
+	return now.Before(day.AddDate(0, 0, 1))
+}
+
+// Resolve the fulfillment source of an order or order template. The vendor is
+// the source of truth: isInternal follows the vendor, an internal order without a
+// vendor gets the internal vendor, and the deprecated sentinel is mapped to it
+// until its sunset. A new order claiming to be internal with an external vendor
+// is rejected; existing orders follow their vendor.
+func resolveFulfillment(tx *gorm.DB, vendorID **int, isInternal *bool, isNew bool) error {
+	if *vendorID != nil && **vendorID == InternalVendorSentinel {
+		if !VendorSentinelAccepted(time.Now()) {
+			return ErrVendorSentinel
+		}
+		log.Printf("Deprecated vendorId %d used, mapping it to the internal vendor", InternalVendorSentinel)
+		*vendorID = nil
+		*isInternal = true
+	}
+
+	if *vendorID == nil {
+		if !*isInternal {
+			return nil
+		}
+		internal, err := GetInternalVendor(tx)
+		if err != nil {
+			return fmt.Errorf("internal vendor: %w", err)
+		}
+		*vendorID = &internal.ID
+		return nil
+	}
+
+	var vendors []Vendor
+	if err := tx.Select("id", "is_internal").Where("id = ?", **vendorID).Limit(1).Find(&vendors).Error; err != nil {
+		return err
+	}
+	if len(vendors) == 0 {
+		return fmt.Errorf("vendor %d not found", **vendorID)
+	}
+	if isNew && *isInternal && !vendors[0].IsInternal {
+		return fmt.Errorf("%w: vendor %d is external", ErrInconsistentFulfillment, **vendorID)
+	}
+	*isInternal = vendors[0].IsInternal
+	return nil
+}
+
+// Point internal orders and order templates at the internal vendor and derive
+// isInternal from the vendor for every order
+func MigrateInternalVendor() (err error) {
+	internal, err := EnsureInternalVendor()
+	if err != nil {
+		return err
+	}
+
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Order{}).
+			Where("vendor_id = ? OR (vendor_id IS NULL AND is_internal = ?)", InternalVendorSentinel, true).
+			UpdateColumns(map[string]any{"vendor_id": internal.ID, "is_internal": true}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&Order{}).Where("vendor_id = ? AND is_internal = ?", internal.ID, false).
+			UpdateColumn("is_internal", true).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&Order{}).Where("vendor_id IS NOT NULL AND vendor_id != ? AND is_internal = ?", internal.ID, true).
+			UpdateColumn("is_internal", false).Error
+		if err != nil {
+			return err
+		}
+
+		var versions []PackageVersion
+		if err := tx.Find(&versions).Error; err != nil {
+			return err
+		}
+		for i := range versions {
+			changed := false
+			for j := range versions[i].Items {
+				item := &versions[i].Items[j]
+				changed = migrateTemplateVendor(&item.VendorID, &item.IsInternal, internal.ID) || changed
+			}
+			if changed {
+				if err := tx.Model(&versions[i]).Select("Items").UpdateColumns(&versions[i]).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		var schedules []DeliverySchedule
+		if err := tx.Find(&schedules).Error; err != nil {
+			return err
+		}
+		for i := range schedules {
+			changed := false
+			for j := range schedules[i].OrderTemplates {
+				template := &schedules[i].OrderTemplates[j]
+				changed = migrateTemplateVendor(&template.VendorID, &template.IsInternal, internal.ID) || changed
+			}
+			if changed {
+				if err := tx.Model(&schedules[i]).Select("OrderTemplates").UpdateColumns(&schedules[i]).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Point a template at the internal vendor when it uses the sentinel or is
+// internal without a vendor
+func migrateTemplateVendor(vendorID **int, isInternal *bool, internalID int) bool {
+	if (*vendorID != nil && **vendorID == InternalVendorSentinel) || (*vendorID == nil && *isInternal) {
+		id := internalID
+		*vendorID = &id
+		*isInternal = true
+		return true
+	}
+	return false
+}
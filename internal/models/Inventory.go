@@ -0,0 +1,412 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Inventory transaction types
+const (
+	InventoryReceipt    = "receipt"    // stock received into the warehouse
+	InventoryAdjustment = "adjustment" // count corrections, spoilage, donations in kind
+	InventoryIssue      = "issue"      // stock deducted for a completed internal order
+)
+
+// InventoryTransaction is an entry in the warehouse ledger of a catalog item.
+// Stock on hand is the sum of the item's entries.
+type InventoryTransaction struct {
+	Model
+
+	// Belongs-to: Item
+	ItemID int   `gorm:"index" json:"itemId"`
+	Item   *Item `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"item,omitempty"`
+
+	Type     string `gorm:"index" json:"type"` // receipt, adjustment, issue
+	Quantity int    `json:"quantity"`          // change in stock on hand, negative for deductions
+
+	// Internal order the stock was issued for
+	OrderID *int `gorm:"index" json:"orderId"`
+
+	Reference string `json:"reference"` // e.g. packing slip or count sheet number
+	Notes     string `json:"notes"`
+	UserID    *uint  `json:"userId"`
+}
+
+// InventoryReservation holds stock for a confirmed internal order until it is
+// completed or cancelled
+type InventoryReservation struct {
+	Model
+
+	// Belongs-to: Order, one reservation per order
+	OrderID int    `gorm:"uniqueIndex" json:"orderId"`
+	Order   *Order `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"order,omitempty"`
+
+	ItemID   int `gorm:"index" json:"itemId"`
+	Quantity int `json:"quantity"`
+}
+
+// InventoryLevel is the warehouse stock of a catalog item
+type InventoryLevel struct {
+	ItemID       int    `json:"itemId"`
+	Item         string `json:"item"`
+	Unit         string `json:"unit"`
+	OnHand       int    `json:"onHand"`
+	Reserved     int    `json:"reserved"`
+	Available    int    `json:"available"` // on hand less reserved
+	ReorderLevel int    `json:"reorderLevel"`
+	Low          bool   `json:"low"` // available is below the reorder level
+}
+
+// InventoryShortfall projects an item's stock over the internal orders of
+// upcoming deliveries
+type InventoryShortfall struct {
+	ItemID      int    `json:"itemId"`
+	Item        string `json:"item"`
+	Unit        string `json:"unit"`
+	OnHand      int    `json:"onHand"`
+	Demand      int    `json:"demand"`      // pending and confirmed internal orders until the horizon
+	Projected   int    `json:"projected"`   // on hand less demand
+	ShortfallOn string `json:"shortfallOn"` // YYYY-MM-DD of the first delivery stock does not cover, empty when covered
+	Orders      int    `json:"orders"`
+}
+
+var ErrInvalidInventoryTransaction = errors.New("invalid inventory transaction")
+
+// Get ledger entries, optionally of one item, newest first
+func GetInventoryTransactions(itemID *int) ([]InventoryTransaction, error) {
+	var transactions []InventoryTransaction
+	query := db.Db.Preload("Item")
+	if itemID != nil {
+		query = query.Where("item_id = ?", *itemID)
+	}
+	err := query.Order("id desc").Find(&transactions).Error
+	return transactions, err
+}
+
+// Get stock reservations, optionally of one item, with their orders
+func GetInventoryReservations(itemID *int) ([]InventoryReservation, error) {
+	var reservations []InventoryReservation
+	query := db.Db.Preload("Order.Delivery")
+	if itemID != nil {
+		query = query.Where("item_id = ?", *itemID)
+	}
+	err := query.Order("id asc").Find(&reservations).Error
+	return reservations, err
+}
+
+// Record a receipt or adjustment in the ledger. Receipts must add stock,
+// adjustments may go either way but not below zero on hand.
+func RecordInventoryTransaction(entry *InventoryTransaction) (err error) {
+	switch entry.Type {
+	case InventoryReceipt:
+		if entry.Quantity <= 0 {
+			return fmt.Errorf("%w: receipt quantity must be positive", ErrInvalidInventoryTransaction)
+		}
+	case InventoryAdjustment:
+		if entry.Quantity == 0 {
+			return fmt.Errorf("%w: adjustment quantity must not be 0", ErrInvalidInventoryTransaction)
+		}
+	default:
+		return fmt.Errorf("%w: type %q", ErrInvalidInventoryTransaction, entry.Type)
+	}
+
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		var item Item
+		if err := tx.First(&item, entry.ItemID).Error; err != nil {
+			return err
+		}
+		if entry.Quantity < 0 {
+			level, err := getInventoryLevel(tx, &item)
+			if err != nil {
+				return err
+			}
+			if level.OnHand+entry.Quantity < 0 {
+				return fmt.Errorf("%w: only %d %s on hand", ErrInvalidInventoryTransaction, level.OnHand, item.Name)
+			}
+		}
+		if err := tx.Omit("Item").Create(entry).Error; err != nil {
+			return err
+		}
+		return alertLowStock(tx, &item, -entry.Quantity)
+	})
+}
+
+// Get the stock of every catalog item
+func GetInventoryLevels() ([]InventoryLevel, error) {
+	var items []Item
+	if err := db.Db.Order("name asc").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	onHand, err := sumByItem(db.Db, &InventoryTransaction{})
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := sumByItem(db.Db, &InventoryReservation{})
+	if err != nil {
+		return nil, err
+	}
+
+	levels := make([]InventoryLevel, len(items))
+	for i := range items {
+		levels[i] = newInventoryLevel(&items[i], onHand[items[i].ID], reserved[items[i].ID])
+	}
+	return levels, nil
+}
+
+// Get the items whose available stock is below their reorder level
+func GetLowStockLevels() ([]InventoryLevel, error) {
+	levels, err := GetInventoryLevels()
+	if err != nil {
+		return nil, err
+	}
+	low := []InventoryLevel{}
+	for _, level := range levels {
+		if level.Low {
+			low = append(low, level)
+		}
+	}
+	return low, nil
+}
+
+// Project stock over the pending and confirmed internal orders on deliveries
+// scheduled before the horizon, soonest first, and find the first delivery each
+// item falls short on. Overdue deliveries count as demand too.
+func GetInventoryShortfall(until time.Time) ([]InventoryShortfall, error) {
+	var orders []Order
+	err := db.Db.Preload("Delivery").
+		Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+		Where("orders.is_internal = ? AND orders.item_id IS NOT NULL AND orders.status IN ?", true, []string{OrderStatusPending, OrderStatusConfirmed}).
+		Where("deliveries.scheduled_at < ?", until).
+		Order("deliveries.scheduled_at asc, orders.id asc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	onHand, err := sumByItem(db.Db, &InventoryTransaction{})
+	if err != nil {
+		return nil, err
+	}
+
+	byItem := map[int]*InventoryShortfall{}
+	var itemIDs []int
+	for _, order := range orders {
+		shortfall := byItem[*order.ItemID]
+		if shortfall == nil {
+			shortfall = &InventoryShortfall{ItemID: *order.ItemID, Item: order.Item, OnHand: onHand[*order.ItemID]}
+			byItem[*order.ItemID] = shortfall
+			itemIDs = append(itemIDs, *order.ItemID)
+		}
+		shortfall.Demand += order.Quantity
+		shortfall.Orders++
+		shortfall.Projected = shortfall.OnHand - shortfall.Demand
+		if shortfall.Projected < 0 && shortfall.ShortfallOn == "" && order.Delivery.ScheduledAt != nil {
+			shortfall.ShortfallOn = order.Delivery.ScheduledAt.In(time.Local).Format("2006-01-02")
+		}
+	}
+
+	var items []Item
+	if len(itemIDs) > 0 {
+		if err := db.Db.Where("id IN ?", itemIDs).Find(&items).Error; err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range items {
+		byItem[item.ID].Item = item.Name
+		byItem[item.ID].Unit = item.Unit
+	}
+
+	// Items falling short come first, soonest shortfall first
+	shortfalls := make([]InventoryShortfall, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		shortfalls = append(shortfalls, *byItem[id])
+	}
+	sort.SliceStable(shortfalls, func(i, j int) bool {
+		a, b := shortfalls[i].ShortfallOn, shortfalls[j].ShortfallOn
+		if (a == "") != (b == "") {
+			return a != ""
+		}
+		return a < b
+	})
+	return shortfalls, nil
+}
+
+// Keep the stock of an internal order in line with its status: confirmed orders
+// reserve their quantity, completed orders are issued from stock once, and
+// any other state releases the reservation
+func syncOrderInventory(tx *gorm.DB, order *Order) error {
+	if order.ID == 0 {
+		return nil
+	}
+	var reservations []InventoryReservation
+	if err := tx.Where("order_id = ?", order.ID).Limit(1).Find(&reservations).Error; err != nil {
+		return err
+	}
+	var reservation *InventoryReservation
+	if len(reservations) > 0 {
+		reservation = &reservations[0]
+	}
+
+	internal := order.IsInternal && order.ItemID != nil
+	if internal && order.Status == OrderStatusConfirmed {
+		if reservation != nil && reservation.ItemID == *order.ItemID && reservation.Quantity == order.Quantity {
+			return nil
+		}
+		change := order.Quantity
+		if reservation != nil {
+			if reservation.ItemID == *order.ItemID {
+				change -= reservation.Quantity
+			}
+			if err := tx.Delete(reservation).Error; err != nil {
+				return err
+			}
+		}
+		err := tx.Create(&InventoryReservation{OrderID: order.ID, ItemID: *order.ItemID, Quantity: order.Quantity}).Error
+		if err != nil {
+			return err
+		}
+		return alertLowStockOf(tx, *order.ItemID, change)
+	}
+
+	if reservation != nil {
+		if err := tx.Delete(reservation).Error; err != nil {
+			return err
+		}
+	}
+	if !internal || order.Status != OrderStatusCompleted {
+		return nil
+	}
+
+	var issued int64
+	err := tx.Model(&InventoryTransaction{}).Where("order_id = ? AND type = ?", order.ID, InventoryIssue).Count(&issued).Error
+	if err != nil || issued > 0 {
+		return err
+	}
+	err = tx.Create(&InventoryTransaction{
+		ItemID:   *order.ItemID,
+		Type:     InventoryIssue,
+		Quantity: -order.Quantity,
+		OrderID:  &order.ID,
+		Notes:    fmt.Sprintf("Order #%d on delivery #%d", order.ID, order.DeliveryID),
+	}).Error
+	if err != nil {
+		return err
+	}
+	if reservation != nil {
+		// The stock was already held, available stock does not change
+		return nil
+	}
+	return alertLowStockOf(tx, *order.ItemID, order.Quantity)
+}
+
+// Reserve stock for confirmed internal orders that have no reservation yet
+func ReserveConfirmedInternalOrders() (err error) {
+	var orders []Order
+	err = db.Db.Where("is_internal = ? AND item_id IS NOT NULL AND status = ?", true, OrderStatusConfirmed).
+		Where("id NOT IN (?)", db.Db.Model(&InventoryReservation{}).Select("order_id")).
+		Find(&orders).Error
+	if err != nil {
+		return err
+	}
+	for i := range orders {
+		if err := syncOrderInventory(db.Db, &orders[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release the reservation of a deleted order
+func releaseOrderInventory(tx *gorm.DB, order *Order) error {
+	if order.ID == 0 {
+		return nil
+	}
+	return tx.Where("order_id = ?", order.ID).Delete(&InventoryReservation{}).Error
+}
+
+// Sum the quantity of ledger entries or reservations per item
+func sumByItem(tx *gorm.DB, model any) (map[int]int, error) {
+	var rows []struct {
+		ItemID   int
+		Quantity int
+	}
+	err := tx.Model(model).Select("item_id, COALESCE(SUM(quantity), 0) AS quantity").Group("item_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[int]int, len(rows))
+	for _, row := range rows {
+		sums[row.ItemID] = row.Quantity
+	}
+	return sums, nil
+}
+
+func getInventoryLevel(tx *gorm.DB, item *Item) (InventoryLevel, error) {
+	var sums struct {
+		OnHand   int
+		Reserved int
+	}
+	err := tx.Raw("SELECT (SELECT COALESCE(SUM(quantity), 0) FROM inventory_transactions WHERE item_id = ?) AS on_hand, "+
+		"(SELECT COALESCE(SUM(quantity), 0) FROM inventory_reservations WHERE item_id = ?) AS reserved",
+		item.ID, item.ID).Scan(&sums).Error
+	if err != nil {
+		return InventoryLevel{}, err
+	}
+	return newInventoryLevel(item, sums.OnHand, sums.Reserved), nil
+}
+
+func newInventoryLevel(item *Item, onHand, reserved int) InventoryLevel {
+	level := InventoryLevel{
+		ItemID:       item.ID,
+		Item:         item.Name,
+		Unit:         item.Unit,
+		OnHand:       onHand,
+		Reserved:     reserved,
+		Available:    onHand - reserved,
+		ReorderLevel: item.ReorderLevel,
+	}
+	level.Low = level.ReorderLevel > 0 && level.Available < level.ReorderLevel
+	return level
+}
+
+func alertLowStockOf(tx *gorm.DB, itemID int, decrease int) error {
+	var item Item
+	if err := tx.First(&item, itemID).Error; err != nil {
+		return err
+	}
+	return alertLowStock(tx, &item, decrease)
+}
+
+// Alert admins through the outbox when a decrease in available stock takes the
+// item below its reorder level, so it is raised once per crossing
+func alertLowStock(tx *gorm.DB, item *Item, decrease int) error {
+	if item.ReorderLevel == 0 || decrease <= 0 {
+		return nil
+	}
+	level, err := getInventoryLevel(tx, item)
+	if err != nil {
+		return err
+	}
+	if !level.Low || level.Available+decrease < level.ReorderLevel {
+		return nil
+	}
+	log.Printf("Low stock: %d %s of %q available, reorder level is %d", level.Available, item.Unit, item.Name, item.ReorderLevel)
+	itemID := item.ID
+	return EnqueueOutbox(tx, &OutboxMessage{
+		Topic: OutboxLowStock,
+		Payload: OutboxPayload{
+			ItemID: &itemID,
+			Changes: []OutboxChange{{
+				Field:    "available",
+				OldValue: strconv.Itoa(level.Available + decrease),
+				NewValue: strconv.Itoa(level.Available),
+			}},
+		},
+	})
+}
@@ -0,0 +1,409 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Invoice statuses
+const (
+	InvoiceStatusSubmitted = "submitted"
+	InvoiceStatusApproved  = "approved"
+	InvoiceStatusDisputed  = "disputed"
+	InvoiceStatusPaid      = "paid"
+)
+
+// Allowed invoice status transitions. A disputed invoice goes back to submitted
+// when the vendor corrects it, paid is final.
+var invoiceStatusTransitions = map[string][]string{
+	InvoiceStatusSubmitted: {InvoiceStatusApproved, InvoiceStatusDisputed},
+	InvoiceStatusDisputed:  {InvoiceStatusSubmitted, InvoiceStatusApproved},
+	InvoiceStatusApproved:  {InvoiceStatusPaid, InvoiceStatusDisputed},
+	InvoiceStatusPaid:      {},
+}
+
+// Results of matching an invoice line against its order
+const (
+	InvoiceLineMatched   = "matched"
+	InvoiceLineMismatch  = "mismatch"
+	InvoiceLineUnmatched = "unmatched"
+)
+
+var (
+	ErrInvalidInvoiceTransition = errors.New("invalid invoice status transition")
+	ErrInvoiceLocked            = errors.New("invoice can only be changed while submitted or disputed")
+	ErrInvoiceMismatch          = errors.New("invoice has lines that do not match their orders")
+	ErrDuplicateInvoiceNumber   = errors.New("vendor already has an invoice with this number")
+)
+
+// Invoice is a vendor's bill for orders, reconciled against the order quantities,
+// unit costs and delivery completion before it is approved and paid
+type Invoice struct {
+	Model
+	Number string `gorm:"index" json:"number"` // vendor's invoice number, unique per vendor
+
+	// Belongs-to: Vendor
+	VendorID int     `gorm:"index" json:"vendorId"`
+	Vendor   *Vendor `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"vendor,omitempty"`
+
+	// Purchase order the invoice bills, lines without an order are matched against it
+	PurchaseOrderID *int `gorm:"index" json:"purchaseOrderId"`
+
+	InvoiceDate string `json:"invoiceDate"` // YYYY-MM-DD
+	DueDate     string `json:"dueDate"`     // YYYY-MM-DD
+
+	Lines []InvoiceLine `gorm:"serializer:json" json:"lines"`
+	Total float64       `json:"total"`
+
+	// Uploaded invoice document
+	FileID *uint `json:"fileId"`
+	File   *File `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"file,omitempty"`
+
+	Status        string     `gorm:"index" json:"status"` // submitted, approved, disputed, paid
+	HasMismatches bool       `gorm:"index" json:"hasMismatches"`
+	ReconciledAt  *time.Time `json:"reconciledAt"`
+
+	SubmittedByUserID uint       `json:"submittedByUserId"`
+	ApprovedByUserID  *uint      `json:"approvedByUserId"`
+	ApprovedAt        *time.Time `json:"approvedAt"`
+	DisputeReason     string     `json:"disputeReason"`
+	DisputedAt        *time.Time `json:"disputedAt"`
+	PaidAt            *time.Time `json:"paidAt"`
+	PaymentReference  string     `json:"paymentReference"`
+
+	Notes string `json:"notes"`
+}
+
+// InvoiceLine is one billed item. Match, Issues and the Ordered* fields are
+// filled in by reconciliation.
+type InvoiceLine struct {
+	OrderID  *int    `json:"orderId"`
+	Item     string  `json:"item"`
+	Quantity int     `json:"quantity"`
+	UnitCost float64 `json:"unitPrice"`
+	Total    float64 `json:"total"`
+
+	Match           string     `json:"match"` // matched, mismatch, unmatched
+	Issues          []string   `json:"issues"`
+	OrderedQuantity int        `json:"orderedQuantity"`
+	OrderedUnitCost float64    `json:"orderedUnitPrice"`
+	CompletedAt     *time.Time `json:"completedAt"`
+}
+
+// Columns written when an invoice is reconciled
+var invoiceReconcileColumns = []string{"Lines", "Total", "HasMismatches", "ReconciledAt"}
+
+// Can an invoice move from one status to another
+func CanTransitionInvoiceStatus(from, to string) bool {
+	return slices.Contains(invoiceStatusTransitions[from], to)
+}
+
+// Can the vendor still change the invoice
+func (invoice *Invoice) Editable() bool {
+	return invoice.Status == InvoiceStatusSubmitted || invoice.Status == InvoiceStatusDisputed
+}
+
+// Get the invoices of a vendor, optionally with given statuses, newest first
+func GetVendorInvoices(vendorID int, statuses []string) ([]Invoice, error) {
+	var invoices []Invoice
+	query := db.Db.Preload("File").Where("vendor_id = ?", vendorID)
+	if len(statuses) > 0 {
+		query = query.Where("status IN ?", statuses)
+	}
+	err := query.Order("id desc").Find(&invoices).Error
+	return invoices, err
+}
+
+// Get Invoice by ID, with its vendor and file
+func GetInvoiceByID(Invoice *Invoice, id uint) (err error) {
+	err = db.Db.Preload("Vendor").Preload("File").First(Invoice, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Invoice, reconciled against its orders
+func CreateInvoice(Invoice *Invoice) (err error) {
+	Invoice.Status = InvoiceStatusSubmitted
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := checkInvoiceNumber(tx, Invoice); err != nil {
+			return err
+		}
+		if err := reconcileInvoice(tx, Invoice); err != nil {
+			return err
+		}
+		return tx.Omit("Vendor", "File").Create(Invoice).Error
+	})
+}
+
+// Update Invoice while it can still be changed. The invoice is reconciled again
+// and a disputed invoice is submitted again.
+func UpdateInvoice(Invoice *Invoice) (err error) {
+	if !Invoice.Editable() {
+		return ErrInvoiceLocked
+	}
+	Invoice.Status = InvoiceStatusSubmitted
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := checkInvoiceNumber(tx, Invoice); err != nil {
+			return err
+		}
+		if err := reconcileInvoice(tx, Invoice); err != nil {
+			return err
+		}
+		return tx.Omit("Vendor", "File").Save(Invoice).Error
+	})
+}
+
+// Delete Invoice
+func DeleteInvoice(Invoice *Invoice) (err error) {
+	err = db.Db.Delete(Invoice).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Attach the uploaded invoice document
+func SetInvoiceFile(Invoice *Invoice, file *File) (err error) {
+	fileID := uint(file.ID)
+	Invoice.FileID, Invoice.File = &fileID, file
+	err = db.Db.Model(Invoice).UpdateColumn("file_id", fileID).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Match the invoice against its orders again, e.g. after deliveries were completed
+func ReconcileInvoice(Invoice *Invoice) (err error) {
+	if Invoice.Status == InvoiceStatusPaid {
+		return fmt.Errorf("%w: invoice is paid", ErrInvalidInvoiceTransition)
+	}
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := reconcileInvoice(tx, Invoice); err != nil {
+			return err
+		}
+		return tx.Model(Invoice).Select(invoiceReconcileColumns).Updates(Invoice).Error
+	})
+}
+
+// Approve an invoice. It is reconciled first and an invoice with mismatches is
+// only approved when forced.
+func ApproveInvoice(Invoice *Invoice, force bool, userID uint) (err error) {
+	if !CanTransitionInvoiceStatus(Invoice.Status, InvoiceStatusApproved) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidInvoiceTransition, Invoice.Status, InvoiceStatusApproved)
+	}
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := reconcileInvoice(tx, Invoice); err != nil {
+			return err
+		}
+		if Invoice.HasMismatches && !force {
+			return ErrInvoiceMismatch
+		}
+
+		now := time.Now()
+		Invoice.Status = InvoiceStatusApproved
+		Invoice.ApprovedAt = &now
+		Invoice.ApprovedByUserID = &userID
+		columns := append([]string{"Status", "ApprovedAt", "ApprovedByUserID"}, invoiceReconcileColumns...)
+		return tx.Model(Invoice).Select(columns).Updates(Invoice).Error
+	})
+}
+
+// Dispute an invoice with the reason sent back to the vendor
+func DisputeInvoice(Invoice *Invoice, reason string) (err error) {
+	if !CanTransitionInvoiceStatus(Invoice.Status, InvoiceStatusDisputed) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidInvoiceTransition, Invoice.Status, InvoiceStatusDisputed)
+	}
+	now := time.Now()
+	Invoice.Status = InvoiceStatusDisputed
+	Invoice.DisputeReason = reason
+	Invoice.DisputedAt = &now
+	Invoice.ApprovedAt = nil
+	Invoice.ApprovedByUserID = nil
+	err = db.Db.Model(Invoice).
+		Select("Status", "DisputeReason", "DisputedAt", "ApprovedAt", "ApprovedByUserID").
+		Updates(Invoice).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Mark an approved invoice as paid
+func PayInvoice(Invoice *Invoice, reference string) (err error) {
+	if !CanTransitionInvoiceStatus(Invoice.Status, InvoiceStatusPaid) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidInvoiceTransition, Invoice.Status, InvoiceStatusPaid)
+	}
+	now := time.Now()
+	Invoice.Status = InvoiceStatusPaid
+	Invoice.PaidAt = &now
+	Invoice.PaymentReference = reference
+	err = db.Db.Model(Invoice).Select("Status", "PaidAt", "PaymentReference").Updates(Invoice).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Check that the vendor has no other invoice with the same number
+func checkInvoiceNumber(tx *gorm.DB, invoice *Invoice) error {
+	var count int64
+	err := tx.Model(&Invoice{}).
+		Where("vendor_id = ? AND number = ? AND id != ?", invoice.VendorID, invoice.Number, invoice.ID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrDuplicateInvoiceNumber, invoice.Number)
+	}
+	return nil
+}
+
+// Match each line of the invoice against its order and flag differences in
+// quantity and unit cost, orders whose delivery was not completed and orders
+// billed twice. Lines without an order are matched by item name against the
+// orders on the invoice's purchase order.
+func reconcileInvoice(tx *gorm.DB, invoice *Invoice) error {
+	// Orders already billed on the vendor's other invoices, disputed ones excluded
+	var others []Invoice
+	err := tx.Select("id", "number", "lines").
+		Where("vendor_id = ? AND id != ? AND status != ?", invoice.VendorID, invoice.ID, InvoiceStatusDisputed).
+		Find(&others).Error
+	if err != nil {
+		return err
+	}
+	billed := map[int]string{}
+	for _, other := range others {
+		for _, line := range other.Lines {
+			if line.OrderID != nil {
+				billed[*line.OrderID] = other.Number
+			}
+		}
+	}
+
+	var ids []int
+	for _, line := range invoice.Lines {
+		if line.OrderID != nil {
+			ids = append(ids, *line.OrderID)
+		}
+	}
+	var orders []Order
+	if len(ids) > 0 {
+		if err := tx.Where("id IN ?", ids).Find(&orders).Error; err != nil {
+			return err
+		}
+	}
+	if invoice.PurchaseOrderID != nil {
+		var poOrders []Order
+		err := tx.Where("purchase_order_id = ? AND id NOT IN ?", *invoice.PurchaseOrderID, append(ids, 0)).
+			Order("id asc").Find(&poOrders).Error
+		if err != nil {
+			return err
+		}
+		orders = append(orders, poOrders...)
+	}
+	byID := map[int]*Order{}
+	for i := range orders {
+		byID[orders[i].ID] = &orders[i]
+	}
+
+	// Resolve lines without an order to the first unclaimed purchase order
+	// order with the same item
+	claimed := map[int]bool{}
+	for _, id := range ids {
+		claimed[id] = true
+	}
+	for i := range invoice.Lines {
+		line := &invoice.Lines[i]
+		if line.OrderID != nil || invoice.PurchaseOrderID == nil {
+			continue
+		}
+		for j := range orders {
+			order := &orders[j]
+			if claimed[order.ID] || order.PurchaseOrderID == nil || *order.PurchaseOrderID != *invoice.PurchaseOrderID {
+				continue
+			}
+			if strings.EqualFold(strings.TrimSpace(order.Item), strings.TrimSpace(line.Item)) {
+				id := order.ID
+				line.OrderID = &id
+				claimed[id] = true
+				break
+			}
+		}
+	}
+
+	now := time.Now()
+	seen := map[int]bool{}
+	invoice.Total = 0
+	invoice.HasMismatches = false
+	for i := range invoice.Lines {
+		line := &invoice.Lines[i]
+		line.Total = float64(line.Quantity) * line.UnitCost
+		invoice.Total += line.Total
+		line.Issues = nil
+		line.OrderedQuantity = 0
+		line.OrderedUnitCost = 0
+		line.CompletedAt = nil
+
+		var order *Order
+		if line.OrderID != nil {
+			order = byID[*line.OrderID]
+		}
+		switch {
+		case line.OrderID == nil:
+			line.Issues = append(line.Issues, "no matching order")
+		case order == nil:
+			line.Issues = append(line.Issues, fmt.Sprintf("order #%d does not exist", *line.OrderID))
+		case order.VendorID == nil || *order.VendorID != invoice.VendorID:
+			line.Issues = append(line.Issues, fmt.Sprintf("order #%d is not from this vendor", order.ID))
+			order = nil
+		}
+		if order == nil {
+			line.Match = InvoiceLineUnmatched
+			invoice.HasMismatches = true
+			continue
+		}
+
+		line.OrderedQuantity = order.Quantity
+		line.OrderedUnitCost = order.UnitCost
+		line.CompletedAt = order.CompletedAt
+		if line.Quantity != order.Quantity {
+			line.Issues = append(line.Issues, fmt.Sprintf("quantity %d invoiced, %d ordered", line.Quantity, order.Quantity))
+		}
+		if math.Abs(line.UnitCost-order.UnitCost) >= 0.005 {
+			line.Issues = append(line.Issues, fmt.Sprintf("unit price %.2f invoiced, %.2f ordered", line.UnitCost, order.UnitCost))
+		}
+		switch {
+		case order.Status == OrderStatusCancelled:
+			line.Issues = append(line.Issues, "order was cancelled")
+		case order.CompletedAt == nil:
+			line.Issues = append(line.Issues, "delivery not confirmed as completed")
+		}
+		if seen[order.ID] {
+			line.Issues = append(line.Issues, fmt.Sprintf("order #%d is billed twice on this invoice", order.ID))
+		}
+		seen[order.ID] = true
+		if number, ok := billed[order.ID]; ok {
+			line.Issues = append(line.Issues, fmt.Sprintf("order #%d is already billed on invoice %s", order.ID, number))
+		}
+
+		line.Match = InvoiceLineMatched
+		if len(line.Issues) > 0 {
+			line.Match = InvoiceLineMismatch
+			invoice.HasMismatches = true
+		}
+	}
+	invoice.ReconciledAt = &now
+	return nil
+}
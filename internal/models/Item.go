@@ -0,0 +1,341 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Item categories, matching Vendor.Type
+const (
+	ItemCategoryProduce     = "produce"
+	ItemCategoryShelfStable = "shelf_stable"
+	ItemCategoryPackaging   = "packaging"
+)
+
+// Review states of an item mapping
+const (
+	ItemMappingPending  = "pending"
+	ItemMappingApproved = "approved"
+	ItemMappingRejected = "rejected"
+)
+
+var (
+	ErrItemInUse   = errors.New("item is still in use")
+	ErrUnknownItem = errors.New("unknown item")
+)
+
+// Item is a catalog entry that orders refer to
+type Item struct {
+	Model
+	SKU        string   `gorm:"unique" json:"sku"`
+	Name       string   `gorm:"unique" json:"name"`
+	Unit       string   `json:"unit"`     // e.g. each, lb, case
+	Category   string   `json:"category"` // produce, shelf_stable, packaging
+	Perishable bool     `json:"perishable"`
+	Aliases    []string `gorm:"serializer:json" json:"aliases"` // other spellings, used for search and suggestions
+
+	// Available warehouse stock below which the item is low, no alert when 0
+	ReorderLevel int `json:"reorderLevel"`
+}
+
+// ItemMapping maps a free-text order item to a catalog item after admin review
+type ItemMapping struct {
+	Model
+	RawName    string `gorm:"unique" json:"rawName"` // normalized free text, e.g. "small produce"
+	OrderCount int    `json:"orderCount"`            // orders using this text when last scanned
+
+	SuggestedItemID *int  `json:"suggestedItemId"`
+	SuggestedItem   *Item `gorm:"foreignKey:SuggestedItemID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"suggestedItem,omitempty"`
+
+	ItemID *int  `json:"itemId"`
+	Item   *Item `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"item,omitempty"`
+
+	Status       string     `gorm:"index;default:pending" json:"status"` // pending, approved, rejected
+	ReviewedByID *uint      `json:"reviewedById"`
+	ReviewedAt   *time.Time `json:"reviewedAt"`
+}
+
+// Common abbreviations in hand-typed item names
+var itemAbbreviations = map[string]string{
+	"sm":  "small",
+	"med": "medium",
+	"lg":  "large",
+	"pkg": "package",
+}
+
+// Normalize free-text item names so that "Sm Produce" and "small  produce" match
+func NormalizeItemName(name string) string {
+	words := strings.Fields(strings.ToLower(name))
+	for i, word := range words {
+		word = strings.TrimSuffix(word, ".")
+		if full, ok := itemAbbreviations[word]; ok {
+			word = full
+		}
+		words[i] = word
+	}
+	return strings.Join(words, " ")
+}
+
+// Get Item by ID
+func GetItemByID(Item *Item, id uint) (err error) {
+	err = db.Db.First(Item, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Item
+func CreateItem(Item *Item) (err error) {
+	err = db.Db.Create(Item).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update Item, keeping the item name of referencing orders in sync
+func UpdateItem(Item *Item) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(Item).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Order{}).Where("item_id = ?", Item.ID).UpdateColumn("item", Item.Name).Error
+	})
+}
+
+// Delete Item
+func DeleteItem(Item *Item) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		uses, err := itemUses(tx, Item.ID)
+		if err != nil {
+			return err
+		}
+		if len(uses) > 0 {
+			return fmt.Errorf("%w: used by %s", ErrItemInUse, strings.Join(uses, ", "))
+		}
+
+		// What the foreign keys would do if they were enforced
+		err = tx.Model(&ItemMapping{}).Where("item_id = ?", Item.ID).Update("item_id", nil).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&ItemMapping{}).Where("suggested_item_id = ?", Item.ID).Update("suggested_item_id", nil).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("item_id = ?", Item.ID).Delete(&VendorPrice{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(Item).Error
+	})
+}
+
+// What still refers to an item, orders and stock would lose their item and
+// packages and schedules would create orders for a missing item
+func itemUses(tx *gorm.DB, itemID int) ([]string, error) {
+	var uses []string
+	for _, table := range []struct {
+		name  string
+		model any
+	}{
+		{"orders", &Order{}},
+		{"inventory transactions", &InventoryTransaction{}},
+		{"inventory reservations", &InventoryReservation{}},
+	} {
+		var count int64
+		if err := tx.Model(table.model).Where("item_id = ?", itemID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			uses = append(uses, table.name)
+		}
+	}
+
+	var versions []PackageVersion
+	if err := tx.Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if slices.ContainsFunc(version.Items, func(item PackageItem) bool { return item.ItemID != nil && *item.ItemID == itemID }) {
+			uses = append(uses, "package versions")
+			break
+		}
+	}
+
+	var schedules []DeliverySchedule
+	if err := tx.Find(&schedules).Error; err != nil {
+		return nil, err
+	}
+	for _, schedule := range schedules {
+		if slices.ContainsFunc(schedule.OrderTemplates, func(order ScheduledOrder) bool { return order.ItemID != nil && *order.ItemID == itemID }) {
+			uses = append(uses, "delivery schedules")
+			break
+		}
+	}
+	return uses, nil
+}
+
+// Find the catalog item whose name or alias matches free text, if any
+func MatchItem(tx *gorm.DB, name string) (*Item, error) {
+	normalized := NormalizeItemName(name)
+	if normalized == "" {
+		return nil, nil
+	}
+
+	var items []Item
+	if err := tx.Find(&items).Error; err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if NormalizeItemName(items[i].Name) == normalized || NormalizeItemName(items[i].SKU) == normalized {
+			return &items[i], nil
+		}
+		for _, alias := range items[i].Aliases {
+			if NormalizeItemName(alias) == normalized {
+				return &items[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Resolve the catalog item of an order: a set item ID takes its catalog name,
+// free text takes the item of an approved mapping
+func resolveOrderItem(tx *gorm.DB, order *Order) error {
+	if order.ItemID != nil {
+		var item Item
+		if err := tx.First(&item, *order.ItemID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: itemId %d", ErrUnknownItem, *order.ItemID)
+			}
+			return err
+		}
+		order.Item = item.Name
+		return nil
+	}
+	if order.Item == "" {
+		return nil
+	}
+
+	// Find instead of First, most order text has no mapping and that is not worth logging
+	var mapping ItemMapping
+	err := tx.Where("raw_name = ? AND status = ?", NormalizeItemName(order.Item), ItemMappingApproved).Limit(1).Find(&mapping).Error
+	if err != nil {
+		return err
+	}
+	if mapping.ItemID == nil {
+		return nil
+	}
+	order.ItemID = mapping.ItemID
+	return resolveOrderItem(tx, order)
+}
+
+// Collect free-text order items without a catalog item into pending mappings,
+// suggesting a catalog item where the name or an alias matches
+func ScanItemMappings() (created int, err error) {
+	var rows []struct {
+		Item  string
+		Count int
+	}
+	err = db.Db.Model(&Order{}).Select("item, COUNT(*) AS count").
+		Where("item_id IS NULL AND item != ''").Group("item").Scan(&rows).Error
+	if err != nil {
+		return 0, err
+	}
+
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[NormalizeItemName(row.Item)] += row.Count
+	}
+
+	for rawName, count := range counts {
+		var mapping ItemMapping
+		err := db.Db.Where("raw_name = ?", rawName).First(&mapping).Error
+		if err == nil {
+			mapping.OrderCount = count
+			if err := db.Db.Model(&mapping).Update("order_count", count).Error; err != nil {
+				return created, err
+			}
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return created, err
+		}
+
+		mapping = ItemMapping{RawName: rawName, OrderCount: count, Status: ItemMappingPending}
+		suggestion, err := MatchItem(db.Db, rawName)
+		if err != nil {
+			return created, err
+		}
+		if suggestion != nil {
+			mapping.SuggestedItemID = &suggestion.ID
+		}
+		if err := db.Db.Create(&mapping).Error; err != nil {
+			return created, err
+		}
+		created++
+	}
+	return created, nil
+}
+
+// Approve a mapping and link every order using its text to the catalog item
+func ApproveItemMapping(mapping *ItemMapping, itemID int, reviewerID uint) (updated int64, err error) {
+	err = db.Db.Transaction(func(tx *gorm.DB) error {
+		var item Item
+		if err := tx.First(&item, itemID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		mapping.ItemID = &item.ID
+		mapping.Status = ItemMappingApproved
+		mapping.ReviewedByID = &reviewerID
+		mapping.ReviewedAt = &now
+		if err := tx.Save(mapping).Error; err != nil {
+			return err
+		}
+
+		// Orders store the text as typed, so match on the normalized form
+		var names []string
+		if err := tx.Model(&Order{}).Where("item_id IS NULL").Distinct().Pluck("item", &names).Error; err != nil {
+			return err
+		}
+		var matching []string
+		for _, name := range names {
+			if NormalizeItemName(name) == mapping.RawName {
+				matching = append(matching, name)
+			}
+		}
+		if len(matching) == 0 {
+			return nil
+		}
+
+		result := tx.Model(&Order{}).Where("item_id IS NULL AND item IN ?", matching).
+			UpdateColumns(map[string]any{"item_id": item.ID, "item": item.Name})
+		updated = result.RowsAffected
+		return result.Error
+	})
+	return updated, err
+}
+
+// Reject a mapping, its orders keep their free text
+func RejectItemMapping(mapping *ItemMapping, reviewerID uint) (err error) {
+	now := time.Now()
+	mapping.Status = ItemMappingRejected
+	mapping.ReviewedByID = &reviewerID
+	mapping.ReviewedAt = &now
+	err = db.Db.Save(mapping).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Notification is an entry in a user's in-app inbox
+type Notification struct {
+	Model
+
+	UserID uint `gorm:"index" json:"userId"`
+
+	EventType string `json:"eventType"` // delivery.notify, delivery.updated, order.status_changed, order.updated, order.added, order.removed
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+
+	DeliveryID *int `gorm:"index" json:"deliveryId"`
+	OrderID    *int `json:"orderId"`
+
+	ReadAt *time.Time `gorm:"index" json:"readAt"`
+	Read   bool       `gorm:"-" json:"read"`
+}
+
+func (notification *Notification) AfterFind(tx *gorm.DB) (err error) {
+	notification.Read = notification.ReadAt != nil
+	return nil
+}
+
+// Create Notification
+func CreateNotification(Notification *Notification) (err error) {
+	err = db.Db.Create(Notification).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get a notification of a user by ID
+func GetUserNotificationByID(Notification *Notification, userID uint, id uint) (err error) {
+	err = db.Db.Where("user_id = ?", userID).First(Notification, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Count the unread notifications of a user
+func CountUnreadNotifications(userID uint) (int64, error) {
+	var count int64
+	err := db.Db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// Mark a notification read, keeping the time it was first read
+func MarkNotificationRead(notification *Notification) (err error) {
+	if notification.ReadAt != nil {
+		return nil
+	}
+	now := time.Now()
+	err = db.Db.Model(notification).UpdateColumn("read_at", now).Error
+	if err != nil {
+		return err
+	}
+	notification.ReadAt = &now
+	notification.Read = true
+	return nil
+}
+
+// Mark every unread notification of a user read
+func MarkAllNotificationsRead(userID uint) (int64, error) {
+	result := db.Db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID).
+		UpdateColumn("read_at", time.Now())
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+
+	"LindaBen_Phase_1_Project/internal/db"
+)
+
+// Notification send results
+const (
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+	NotificationSkipped = "skipped" // recipient has no address for the channel
+)
+
+// NotificationLog records one notification sent to one recipient over one channel
+type NotificationLog struct {
+	Model
+
+	DeliveryID *int `gorm:"index" json:"deliveryId"`
+
+	UserID *uint `gorm:"index" json:"userId"`
+	User   *User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"user,omitempty"`
+
+	Channel  string `json:"channel"` // email, sms
+	Address  string `json:"address"` // email address or phone number the message went to
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+	Status   string `gorm:"index" json:"status"` // sent, failed, skipped
+	Error    string `json:"error"`
+	SentByID *uint  `json:"sentById"`
+}
+
+// Get the users to notify about a delivery: the admins of its school and of
+// the vendors of its orders. The delivery needs School and Orders.Vendor loaded.
+func GetDeliveryRecipients(delivery *Delivery) ([]User, error) {
+	var vendorIDs []int
+	for _, order := range delivery.Orders {
+		if order.Vendor != nil {
+			vendorIDs = append(vendorIDs, order.Vendor.ID)
+		}
+	}
+	return getAdminsOf(delivery.SchoolID, nil, vendorIDs)
+}
+
+// Get the users to notify about an event of a delivery, scoped to their roles.
+// School admins hear about their school's deliveries, including one that moved
+// away from it. Vendor admins hear about their own orders only: the order the
+// event is about, or every order of the delivery for delivery events.
+func GetDeliveryEventRecipients(delivery *Delivery, order *Order, previousSchoolID *int) ([]User, error) {
+	var vendorIDs []int
+	if order != nil {
+		if order.VendorID != nil {
+			vendorIDs = append(vendorIDs, *order.VendorID)
+		}
+	} else {
+		for _, order := range delivery.Orders {
+			if order.VendorID != nil {
+				vendorIDs = append(vendorIDs, *order.VendorID)
+			}
+		}
+	}
+	return getAdminsOf(delivery.SchoolID, previousSchoolID, vendorIDs)
+}
+
+// Get the admins of schools and vendors, each user once, ordered by ID
+func getAdminsOf(schoolID *int, previousSchoolID *int, vendorIDs []int) ([]User, error) {
+	var roles []string
+	for _, id := range []*int{schoolID, previousSchoolID} {
+		if id != nil {
+			roles = append(roles, fmt.Sprintf("school_admin:%d", *id))
+		}
+	}
+	for _, id := range vendorIDs {
+		roles = append(roles, fmt.Sprintf("vendor_admin:%d", id))
+	}
+
+	slices.Sort(roles)
+	roles = slices.Compact(roles)
+
+	userMap := make(map[int]User)
+	for _, role := range roles {
+		admins, err := GetUsersByRole(role)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range *admins {
+			userMap[user.ID] = user
+		}
+	}
+
+	users := make([]User, 0, len(userMap))
+	for _, user := range userMap {
+		users = append(users, user)
+	}
+	slices.SortFunc(users, func(a, b User) int { return a.ID - b.ID })
+	return users, nil
+}
+
+// Get a delivery with what notifications are rendered from: its school and its orders' vendors
+func GetDeliveryForNotification(Delivery *Delivery, id int) (err error) {
+	err = db.Db.Preload("School").Preload("Orders.Vendor").First(Delivery, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get an order with its vendor for notifications
+func GetOrderForNotification(Order *Order, id int) (err error) {
+	err = db.Db.Preload("Vendor").First(Order, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Notification Log
+func CreateNotificationLog(NotificationLog *NotificationLog) (err error) {
+	err = db.Db.Create(NotificationLog).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the notifications sent about a delivery, newest first
+func GetDeliveryNotificationLogs(NotificationLogs *[]NotificationLog, deliveryID int) (err error) {
+	err = db.Db.Preload("User").Where("delivery_id = ?", deliveryID).Order("id desc").Find(NotificationLogs).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Channels a user can receive notifications on
+const (
+	NotificationChannelEmail  = "email"
+	NotificationChannelSMS    = "sms"
+	NotificationChannelInApp  = "in_app"
+	NotificationChannelDigest = "digest" // collected into the daily digest
+)
+
+var NotificationChannels = []string{NotificationChannelEmail, NotificationChannelSMS, NotificationChannelInApp, NotificationChannelDigest}
+
+// Events users can subscribe to, named like their outbox topics, and delivery reminders
+var NotificationEvents = []string{OutboxDeliveryUpdated, OutboxOrderStatusChanged, OutboxOrderUpdated, OutboxOrderAdded, OutboxOrderRemoved, OutboxOrderEscalated, OutboxLowStock, ReminderEvent}
+
+// Channels on for users who have not set a preference
+var defaultNotificationChannels = map[string]bool{
+	NotificationChannelEmail:  true,
+	NotificationChannelSMS:    false,
+	NotificationChannelInApp:  true,
+	NotificationChannelDigest: false,
+}
+
+var ErrInvalidNotificationPreference = errors.New("invalid notification preference")
+
+// NotificationPreference turns one event on one channel on or off for a user
+type NotificationPreference struct {
+	Model
+	UserID    uint   `gorm:"uniqueIndex:idx_notification_preference" json:"userId"`
+	EventType string `gorm:"uniqueIndex:idx_notification_preference" json:"eventType"`
+	Channel   string `gorm:"uniqueIndex:idx_notification_preference" json:"channel"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// NotificationPreferences looks up whether a user wants an event on a channel
+type NotificationPreferences map[string]map[string]bool
+
+func (preferences NotificationPreferences) Enabled(eventType string, channel string) bool {
+	if enabled, ok := preferences[eventType][channel]; ok {
+		return enabled
+	}
+	return defaultNotificationChannels[channel]
+}
+
+// Get the stored preferences of a user
+func GetNotificationPreferences(userID uint) (NotificationPreferences, error) {
+	var rows []NotificationPreference
+	if err := db.Db.Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	preferences := NotificationPreferences{}
+	for _, row := range rows {
+		if preferences[row.EventType] == nil {
+			preferences[row.EventType] = map[string]bool{}
+		}
+		preferences[row.EventType][row.Channel] = row.Enabled
+	}
+	return preferences, nil
+}
+
+// Get every event and channel of a user, defaults filled in
+func GetNotificationPreferenceList(userID uint) ([]NotificationPreference, error) {
+	preferences, err := GetNotificationPreferences(userID)
+	if err != nil {
+		return nil, err
+	}
+	var list []NotificationPreference
+	for _, eventType := range NotificationEvents {
+		for _, channel := range NotificationChannels {
+			list = append(list, NotificationPreference{
+				UserID:    userID,
+				EventType: eventType,
+				Channel:   channel,
+				Enabled:   preferences.Enabled(eventType, channel),
+			})
+		}
+	}
+	return list, nil
+}
+
+// Store preferences of a user, events and channels not given are left as they are
+func SetNotificationPreferences(userID uint, preferences []NotificationPreference) (err error) {
+	for _, preference := range preferences {
+		if !slices.Contains(NotificationEvents, preference.EventType) {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidNotificationPreference, preference.EventType)
+		}
+		if !slices.Contains(NotificationChannels, preference.Channel) {
+			return fmt.Errorf("%w: unknown channel %q", ErrInvalidNotificationPreference, preference.Channel)
+		}
+	}
+
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		for _, preference := range preferences {
+			row := NotificationPreference{UserID: userID, EventType: preference.EventType, Channel: preference.Channel, Enabled: preference.Enabled}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_id"}, {Name: "event_type"}, {Name: "channel"}},
+				DoUpdates: clause.AssignmentColumns([]string{"enabled", "updated_at"}),
+			}).Create(&row).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
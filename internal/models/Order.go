@@ -1,17 +1,49 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Order statuses
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusConfirmed = "confirmed"
+	OrderStatusCompleted = "completed"
+	OrderStatusCancelled = "cancelled"
+)
+
+// Allowed order status transitions, completed and cancelled are final
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPending:   {OrderStatusConfirmed, OrderStatusCancelled},
+	OrderStatusConfirmed: {OrderStatusCompleted, OrderStatusCancelled},
+	OrderStatusCompleted: {},
+	OrderStatusCancelled: {},
+}
+
+var (
+	ErrInvalidOrderStatus     = errors.New("invalid order status")
+	ErrInvalidOrderTransition = errors.New("invalid order status transition")
+	ErrOrderNotOnDelivery     = errors.New("order is not on this delivery")
 )
 
 type Order struct {
 	Model
-	Item     string  `json:"item"`
+	Item     string  `json:"item"` // catalog item name, or free text for orders not yet mapped
 	Quantity int     `json:"quantity"`
 	UnitCost float64 `json:"unitPrice"`
 
+	// Belongs-to: Item
+	ItemID      *int  `gorm:"index" json:"itemId"`
+	CatalogItem *Item `gorm:"foreignKey:ItemID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"catalogItem,omitempty"`
+
 	PackingTime  *time.Time `json:"packingTime"`
 	PurchaseTime *time.Time `json:"purchaseTime"`
 
@@ -21,14 +53,117 @@ type Order struct {
 	VendorID *int    `json:"vendorId"`
 	Vendor   *Vendor `json:"vendor"`
 
-	IsInternal bool `json:"isInternal"` // Use later in fetch api to differentiate between internal and external orders
+	IsInternal bool `json:"isInternal"` // fulfilled by the organization, follows Vendor.IsInternal
 
-	Status      string     `json:"status"` // "Pending", "Confirmed", "Completed", "Cancelled"
+	Status      string     `json:"status"` // pending, confirmed, completed, cancelled
+	ConfirmedAt *time.Time `json:"confirmedAt"`
 	CompletedAt *time.Time `json:"completedAt"`
+	CancelledAt *time.Time `json:"cancelledAt"`
+
+	CancellationReason string `json:"cancellationReason"`
+
+	// Vendor's answer to the order, see RespondToOrder
+	VendorResponse       string     `gorm:"index" json:"vendorResponse"` // accepted, rejected, change_proposed, empty while awaiting
+	VendorResponseReason string     `json:"vendorResponseReason"`
+	VendorRespondedAt    *time.Time `json:"vendorRespondedAt"`
+	ProposedQuantity     *int       `json:"proposedQuantity"`
+	ProposedUnitCost     *float64   `json:"proposedUnitPrice"`
+
+	// Purchase order the order was sent to its vendor on
+	PurchaseOrderID *int `gorm:"index" json:"purchaseOrderId"`
+
+	// Set when admins were alerted that the order is unconfirmed close to delivery
+	EscalatedAt *time.Time `json:"escalatedAt"`
+
+	// Latest time the vendor should confirm by, filled in for vendor inboxes
+	RespondBy *time.Time `gorm:"-" json:"respondBy,omitempty"`
 
 	Notes string `json:"notes"`
 }
 
+// Normalize a status to its canonical lowercase form
+func NormalizeOrderStatus(status string) string {
+	status = strings.ToLower(strings.TrimSpace(status))
+	if status == "canceled" {
+		return OrderStatusCancelled
+	}
+	return status
+}
+
+// Is the status a known order status
+func IsValidOrderStatus(status string) bool {
+	_, ok := orderStatusTransitions[status]
+	return ok
+}
+
+// Can an order move from one status to another
+func CanTransitionOrderStatus(from, to string) bool {
+	if from == to {
+		return true
+	}
+	return slices.Contains(orderStatusTransitions[from], to)
+}
+
+// Move the order to a new status, validating the transition and setting its timestamp
+func (order *Order) SetStatus(status string) error {
+	status = NormalizeOrderStatus(status)
+	if !IsValidOrderStatus(status) {
+		return fmt.Errorf("%w: %q", ErrInvalidOrderStatus, status)
+	}
+	current := NormalizeOrderStatus(order.Status)
+	if !CanTransitionOrderStatus(current, status) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidOrderTransition, current, status)
+	}
+	order.Status = status
+	order.stampStatus(time.Now())
+	return nil
+}
+
+// Fill in the timestamp belonging to the current status if it is missing
+func (order *Order) stampStatus(now time.Time) {
+	switch order.Status {
+	case OrderStatusConfirmed:
+		if order.ConfirmedAt == nil {
+			order.ConfirmedAt = &now
+		}
+	case OrderStatusCompleted:
+		if order.CompletedAt == nil {
+			order.CompletedAt = &now
+		}
+	case OrderStatusCancelled:
+		if order.CancelledAt == nil {
+			order.CancelledAt = &now
+		}
+	}
+}
+
+// Normalize status case, set status timestamps and resolve the vendor and catalog item on every write
+func (order *Order) BeforeSave(tx *gorm.DB) (err error) {
+	order.Status = NormalizeOrderStatus(order.Status)
+	if order.Status == "" {
+		order.Status = OrderStatusPending
+	}
+	if !IsValidOrderStatus(order.Status) {
+		return fmt.Errorf("%w: %q", ErrInvalidOrderStatus, order.Status)
+	}
+	order.stampStatus(time.Now())
+	if err := resolveFulfillment(tx, &order.VendorID, &order.IsInternal, order.ID == 0); err != nil {
+		return err
+	}
+	return resolveOrderItem(tx, order)
+}
+
+// Resolve the vendor and isInternal of an order before it is checked or saved,
+// see resolveFulfillment
+func ResolveOrderFulfillment(order *Order) error {
+	return resolveFulfillment(db.Db, &order.VendorID, &order.IsInternal, order.ID == 0)
+}
+
+// Default the unit cost of new orders from the vendor's price list
+func (order *Order) BeforeCreate(tx *gorm.DB) (err error) {
+	return applyListPrice(tx, order)
+}
+
 // Get Order by ID
 func GetOrderByID(Order *Order, id int) (err error) {
 	err = db.Db.First(Order, id).Error
@@ -38,38 +173,181 @@ func GetOrderByID(Order *Order, id int) (err error) {
 	return nil
 }
 
-// Update Order
+// Update Order, writing cleared values such as a removed vendor too
 func UpdateOrder(Order *Order) (err error) {
-	err = db.Db.Updates(Order).Error
+	err = db.Db.Select("*").Omit("Delivery", "Vendor", "CatalogItem").Updates(Order).Error
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Delete Order
-func DeleteOrder(Order *Order) (err error) {
-	err = db.Db.Delete(Order).Error
-	if err != nil {
+// Update Order and save its change logs in one transaction, queueing an
+// event for the change
+func UpdateOrderWithLogs(Order *Order, logs []OrderChangeLog) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if len(logs) > 0 {
+			if err := tx.Create(&logs).Error; err != nil {
+				return err
+			}
+		}
+		err := tx.Select("*").Omit("Delivery", "Vendor", "CatalogItem").Updates(Order).Error
+		if err != nil {
+			return err
+		}
+		return enqueueOrderChanged(tx, Order, logs)
+	})
+}
+
+// Transition an order to a new status and record the change
+func TransitionOrder(order *Order, status string, reason string, userID uint) (err error) {
+	oldStatus := order.Status
+	if err = order.SetStatus(status); err != nil {
 		return err
 	}
-	return nil
+	if order.Status == OrderStatusCancelled {
+		order.CancellationReason = reason
+	}
+
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Updates(order).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		logs := []OrderChangeLog{{
+			OrderID:        uint(order.ID),
+			ChangeByUserID: userID,
+			ChangedAt:      now,
+			FieldName:      "status",
+			OldValue:       oldStatus,
+			NewValue:       order.Status,
+		}}
+		if reason != "" {
+			logs = append(logs, OrderChangeLog{
+				OrderID:        uint(order.ID),
+				ChangeByUserID: userID,
+				ChangedAt:      now,
+				FieldName:      "reason",
+				NewValue:       reason,
+			})
+		}
+		if err := tx.Create(&logs).Error; err != nil {
+			return err
+		}
+		return enqueueOrderChanged(tx, order, logs)
+	})
 }
 
-// Add Order to Delivery
-func AddOrderToDelivery(delivery *Delivery, order *Order) (err error) {
-	err = db.Db.Model(delivery).Association("Orders").Append(order)
+// Normalize the case of existing order statuses and fill in missing completion times
+func NormalizeOrderStatuses() (err error) {
+	err = db.Db.Exec("UPDATE orders SET status = LOWER(TRIM(status)) WHERE status != LOWER(TRIM(status))").Error
+	if err != nil {
+		return err
+	}
+	err = db.Db.Exec("UPDATE orders SET status = ? WHERE status = 'canceled'", OrderStatusCancelled).Error
+	if err != nil {
+		return err
+	}
+	err = db.Db.Exec("UPDATE orders SET status = ? WHERE status = '' OR status IS NULL", OrderStatusPending).Error
+	if err != nil {
+		return err
+	}
+	// Best guess for rows completed before completion times were recorded
+	err = db.Db.Exec("UPDATE orders SET completed_at = updated_at WHERE status = ? AND completed_at IS NULL", OrderStatusCompleted).Error
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Delete Order, queueing an order.deleted event
+func DeleteOrder(Order *Order) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(Order).Error; err != nil {
+			return err
+		}
+		return enqueueOrderDeleted(tx, Order)
+	})
+}
+
+// Add Order to Delivery
+func AddOrderToDelivery(delivery *Delivery, order *Order) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if order.VendorID != nil && order.Status != OrderStatusCancelled {
+			err := CheckVendorCapacity(tx, *order.VendorID, delivery.ScheduledAt, 1, order.Quantity, []int{order.ID})
+			if err != nil {
+				return err
+			}
+		}
+
+		previousDeliveryID := order.DeliveryID
+		if err := tx.Model(delivery).Association("Orders").Append(order); err != nil {
+			return err
+		}
+		if previousDeliveryID != 0 && previousDeliveryID != delivery.ID {
+			if _, err := RefreshDeliveryStatus(tx, previousDeliveryID); err != nil {
+				return err
+			}
+			if err := enqueueOrderMoved(tx, OutboxOrderRemoved, order, previousDeliveryID); err != nil {
+				return err
+			}
+		}
+		if previousDeliveryID != delivery.ID {
+			if err := enqueueOrderMoved(tx, OutboxOrderAdded, order, delivery.ID); err != nil {
+				return err
+			}
+		}
+		status, err := RefreshDeliveryStatus(tx, delivery.ID)
+		if err != nil {
+			return err
+		}
+		delivery.Status = status
+		return nil
+	})
+}
+
 // Remove Order from Delivery
 func RemoveOrderFromDelivery(delivery *Delivery, order *Order) (err error) {
-	err = db.Db.Model(delivery).Association("Orders").Delete(order)
-	if err != nil {
+	if order.DeliveryID != delivery.ID {
+		return ErrOrderNotOnDelivery
+	}
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(delivery).Association("Orders").Delete(order); err != nil {
+			return err
+		}
+		if err := enqueueOrderMoved(tx, OutboxOrderRemoved, order, delivery.ID); err != nil {
+			return err
+		}
+		status, err := RefreshDeliveryStatus(tx, delivery.ID)
+		if err != nil {
+			return err
+		}
+		delivery.Status = status
+		return nil
+	})
+}
+
+// Recalculate the delivery status and sync warehouse stock whenever an order is written
+func (order *Order) AfterSave(tx *gorm.DB) (err error) {
+	if err := syncOrderInventory(tx, order); err != nil {
 		return err
 	}
-	return nil
+	if order.DeliveryID == 0 {
+		return nil
+	}
+	_, err = RefreshDeliveryStatus(tx, order.DeliveryID)
+	return err
+}
+
+// Recalculate the delivery status and release reserved stock when an order is removed
+func (order *Order) AfterDelete(tx *gorm.DB) (err error) {
+	if err := releaseOrderInventory(tx, order); err != nil {
+		return err
+	}
+	if order.DeliveryID == 0 {
+		return nil
+	}
+	_, err = RefreshDeliveryStatus(tx, order.DeliveryID)
+	return err
 }
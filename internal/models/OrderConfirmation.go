@@ -0,0 +1,272 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Vendor responses to an order
+const (
+	VendorResponseAccepted       = "accepted"
+	VendorResponseRejected       = "rejected"
+	VendorResponseChangeProposed = "change_proposed"
+)
+
+// Lead time of vendors without one of their own
+const DefaultVendorLeadTimeDays = 2
+
+var (
+	ErrOrderNotAwaitingResponse = errors.New("order is not awaiting a vendor response")
+	ErrNoProposedChange         = errors.New("order has no proposed change")
+)
+
+// Columns written when a vendor response changes, so cleared values are saved too
+var vendorResponseColumns = []string{"Status", "ConfirmedAt", "VendorResponse", "VendorResponseReason", "VendorRespondedAt", "ProposedQuantity", "ProposedUnitCost"}
+
+// Days before delivery by which the vendor must confirm
+func (vendor *Vendor) LeadTime() int {
+	if vendor.LeadTimeDays > 0 {
+		return vendor.LeadTimeDays
+	}
+	return DefaultVendorLeadTimeDays
+}
+
+// Get a vendor's orders with their delivery and school, soonest delivery first.
+// Each order's RespondBy is set from the vendor's lead time.
+func GetVendorOrders(vendor *Vendor, statuses []string) ([]Order, error) {
+	var orders []Order
+	query := db.Db.Preload("Delivery.School").
+		Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+		Where("orders.vendor_id = ?", vendor.ID)
+	if len(statuses) > 0 {
+		for i := range statuses {
+			statuses[i] = NormalizeOrderStatus(statuses[i])
+		}
+		query = query.Where("orders.status IN ?", statuses)
+	}
+	err := query.Order("deliveries.scheduled_at asc, orders.id asc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range orders {
+		if scheduledAt := orders[i].Delivery.ScheduledAt; scheduledAt != nil {
+			respondBy := scheduledAt.AddDate(0, 0, -vendor.LeadTime())
+			orders[i].RespondBy = &respondBy
+		}
+	}
+	return orders, nil
+}
+
+// Record a vendor's response to a pending order. Accepting confirms the order,
+// rejecting leaves it pending for admins to reassign, and proposing a change
+// leaves it pending until an admin approves or declines the proposal.
+func RespondToOrder(order *Order, response string, reason string, quantity *int, unitCost *float64, userID uint) (err error) {
+	if order.Status != OrderStatusPending {
+		return fmt.Errorf("%w: order is %s", ErrOrderNotAwaitingResponse, order.Status)
+	}
+
+	oldResponse := order.VendorResponse
+	now := time.Now()
+	order.VendorResponse = response
+	order.VendorResponseReason = reason
+	order.VendorRespondedAt = &now
+	order.ProposedQuantity = nil
+	order.ProposedUnitCost = nil
+
+	switch response {
+	case VendorResponseAccepted:
+		if err := order.SetStatus(OrderStatusConfirmed); err != nil {
+			return err
+		}
+	case VendorResponseRejected:
+	case VendorResponseChangeProposed:
+		order.ProposedQuantity = quantity
+		order.ProposedUnitCost = unitCost
+	default:
+		return fmt.Errorf("invalid vendor response %q", response)
+	}
+
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(order).Select(vendorResponseColumns).Updates(order).Error; err != nil {
+			return err
+		}
+
+		logs := []OrderChangeLog{{
+			OrderID:        uint(order.ID),
+			ChangeByUserID: userID,
+			ChangedAt:      now,
+			FieldName:      "vendorResponse",
+			OldValue:       oldResponse,
+			NewValue:       response,
+		}}
+		if response == VendorResponseAccepted {
+			logs = append(logs, OrderChangeLog{
+				OrderID:        uint(order.ID),
+				ChangeByUserID: userID,
+				ChangedAt:      now,
+				FieldName:      "status",
+				OldValue:       OrderStatusPending,
+				NewValue:       order.Status,
+			})
+		}
+		if reason != "" {
+			logs = append(logs, OrderChangeLog{
+				OrderID:        uint(order.ID),
+				ChangeByUserID: userID,
+				ChangedAt:      now,
+				FieldName:      "reason",
+				NewValue:       reason,
+			})
+		}
+		if err := tx.Create(&logs).Error; err != nil {
+			return err
+		}
+		return enqueueOrderChanged(tx, order, logs)
+	})
+}
+
+// Approve or decline a vendor's proposed change. Approving applies the proposed
+// quantity and unit cost and confirms the order; declining clears the proposal so
+// the vendor can respond again.
+func ResolveOrderProposal(order *Order, approve bool, userID uint) (err error) {
+	if order.Status != OrderStatusPending || order.VendorResponse != VendorResponseChangeProposed {
+		return ErrNoProposedChange
+	}
+
+	now := time.Now()
+	var logs []OrderChangeLog
+	addLog := func(field, old, new string) {
+		logs = append(logs, OrderChangeLog{
+			OrderID:        uint(order.ID),
+			ChangeByUserID: userID,
+			ChangedAt:      now,
+			FieldName:      field,
+			OldValue:       old,
+			NewValue:       new,
+		})
+	}
+
+	columns := vendorResponseColumns
+	if approve {
+		if order.ProposedQuantity != nil && *order.ProposedQuantity != order.Quantity {
+			addLog("quantity", strconv.Itoa(order.Quantity), strconv.Itoa(*order.ProposedQuantity))
+			order.Quantity = *order.ProposedQuantity
+		}
+		if order.ProposedUnitCost != nil && *order.ProposedUnitCost != order.UnitCost {
+			addLog("unitPrice", fmt.Sprintf("%f", order.UnitCost), fmt.Sprintf("%f", *order.ProposedUnitCost))
+			order.UnitCost = *order.ProposedUnitCost
+		}
+		if err := order.SetStatus(OrderStatusConfirmed); err != nil {
+			return err
+		}
+		addLog("status", OrderStatusPending, order.Status)
+		addLog("vendorResponse", order.VendorResponse, VendorResponseAccepted)
+		order.VendorResponse = VendorResponseAccepted
+		columns = append([]string{"Quantity", "UnitCost"}, columns...)
+	} else {
+		addLog("vendorResponse", order.VendorResponse, "")
+		order.VendorResponse = ""
+		order.VendorResponseReason = ""
+		order.VendorRespondedAt = nil
+	}
+	order.ProposedQuantity = nil
+	order.ProposedUnitCost = nil
+
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(order).Select(columns).Updates(order).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&logs).Error; err != nil {
+			return err
+		}
+		return enqueueOrderChanged(tx, order, logs)
+	})
+}
+
+// Clear the vendor response and escalation of an order, e.g. after it moved to another vendor
+func ResetVendorResponse(order *Order) (err error) {
+	order.VendorResponse = ""
+	order.VendorResponseReason = ""
+	order.VendorRespondedAt = nil
+	order.ProposedQuantity = nil
+	order.ProposedUnitCost = nil
+	order.EscalatedAt = nil
+	err = db.Db.Model(order).
+		Select("VendorResponse", "VendorResponseReason", "VendorRespondedAt", "ProposedQuantity", "ProposedUnitCost", "EscalatedAt").
+		Updates(order).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get pending orders that were escalated to admins, soonest delivery first
+func GetEscalatedOrders() ([]Order, error) {
+	var orders []Order
+	err := db.Db.Preload("Delivery.School").Preload("Vendor").
+		Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+		Where("orders.escalated_at IS NOT NULL AND orders.status = ?", OrderStatusPending).
+		Order("deliveries.scheduled_at asc, orders.id asc").Find(&orders).Error
+	return orders, err
+}
+
+// Escalate pending vendor orders whose delivery is within the vendor's lead time.
+// Orders are escalated once; deliveries already past are left alone. Internal
+// orders are confirmed by admins themselves and are not escalated.
+func EscalateUnconfirmedOrders(now time.Time) (escalated int, err error) {
+	var vendors []Vendor
+	if err := db.Db.Where("is_internal = ?", false).Find(&vendors).Error; err != nil {
+		return 0, err
+	}
+
+	for _, vendor := range vendors {
+		var orders []Order
+		err := db.Db.Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+			Where("orders.vendor_id = ? AND orders.status = ? AND orders.escalated_at IS NULL", vendor.ID, OrderStatusPending).
+			Where("deliveries.scheduled_at > ? AND deliveries.scheduled_at <= ?", now, now.AddDate(0, 0, vendor.LeadTime())).
+			Find(&orders).Error
+		if err != nil {
+			return escalated, err
+		}
+		if len(orders) == 0 {
+			continue
+		}
+
+		ids := make([]int, len(orders))
+		for i := range orders {
+			ids[i] = orders[i].ID
+		}
+		// Admins are notified through the outbox, once per order like the escalation
+		err = db.Db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Order{}).Where("id IN ?", ids).UpdateColumn("escalated_at", now).Error; err != nil {
+				return err
+			}
+			for _, order := range orders {
+				orderID, deliveryID := order.ID, order.DeliveryID
+				err := EnqueueOutbox(tx, &OutboxMessage{
+					Topic:      OutboxOrderEscalated,
+					DeliveryID: &deliveryID,
+					OrderID:    &orderID,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return escalated, err
+		}
+		log.Printf("Escalated %d unconfirmed orders of vendor %q to admins", len(orders), vendor.Name)
+		escalated += len(orders)
+	}
+	return escalated, nil
+}
@@ -0,0 +1,366 @@
+package models
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Outbox message statuses
+const (
+	OutboxPending    = "pending"
+	OutboxProcessing = "processing" // claimed by a worker
+	OutboxDone       = "done"
+	OutboxDead       = "dead" // gave up after too many attempts, see ReplayOutboxMessage
+)
+
+// Outbox topics
+const (
+	OutboxDeliveryNotify     = "delivery.notify"      // notification of a delivery requested by an admin
+	OutboxDeliveryCreated    = "delivery.created"     // a delivery was created
+	OutboxDeliveryUpdated    = "delivery.updated"     // a delivery's fields changed
+	OutboxDeliveryDeleted    = "delivery.deleted"     // a delivery was deleted
+	OutboxOrderStatusChanged = "order.status_changed" // an order moved to another status
+	OutboxOrderUpdated       = "order.updated"        // an order's other fields changed
+	OutboxOrderAdded         = "order.added"          // an order was added to a delivery
+	OutboxOrderRemoved       = "order.removed"        // an order was taken off a delivery
+	OutboxOrderDeleted       = "order.deleted"        // an order was deleted
+	OutboxOrderEscalated     = "order.escalated"      // a pending order was escalated to admins
+	OutboxLowStock           = "inventory.low_stock"  // an item's available stock fell below its reorder level
+	OutboxNotification       = "notification"         // a rendered message to one address
+	OutboxWebhook            = "webhook"              // an event posted to one webhook
+)
+
+var ErrOutboxNotReplayable = errors.New("only dead outbox messages can be replayed")
+
+// OutboxMessage is work written in the same transaction as the change that
+// caused it and carried out by the outbox worker afterwards
+type OutboxMessage struct {
+	Model
+
+	Topic   string        `gorm:"index" json:"topic"`
+	Payload OutboxPayload `gorm:"serializer:json" json:"payload"`
+
+	// What the message is about, for looking messages up
+	DeliveryID *int `gorm:"index" json:"deliveryId"`
+	OrderID    *int `gorm:"index" json:"orderId"`
+
+	// Event message this one was expanded from
+	ParentID *uint `gorm:"index" json:"parentId"`
+
+	Status        string     `gorm:"index" json:"status"` // pending, processing, done, dead
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"nextAttemptAt"`
+	LastError     string     `json:"lastError"`
+	ProcessedAt   *time.Time `json:"processedAt"`
+}
+
+// OutboxPayload holds what a topic needs, unused fields are left empty
+type OutboxPayload struct {
+	// Events
+	Changes     []OutboxChange `json:"changes,omitempty"`
+	ChangedByID *uint          `json:"changedById,omitempty"`
+	Note        string         `json:"note,omitempty"`
+	Channels    []string       `json:"channels,omitempty"`
+	SentByID    *uint          `json:"sentById,omitempty"`
+
+	// Who a deleted delivery or order concerned, as it can no longer be looked up
+	SchoolID  *int  `json:"schoolId,omitempty"`
+	VendorIDs []int `json:"vendorIds,omitempty"`
+	// When a deleted delivery was scheduled, for cancelling it in calendar feeds
+	ScheduledAt *time.Time `json:"scheduledAt,omitempty"`
+
+	// Notifications
+	EventType string `json:"eventType,omitempty"` // topic of the event the notification is about
+	UserID    *uint  `json:"userId,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Body      string `json:"body,omitempty"`
+
+	// Webhooks, with the event in EventType and the request body in Body
+	WebhookID *uint `json:"webhookId,omitempty"`
+
+	// Inventory alerts, with the available stock before and after in Changes
+	ItemID *int `json:"itemId,omitempty"`
+}
+
+// OutboxChange is one changed field of an event
+type OutboxChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+}
+
+// Add a message to the outbox as part of the caller's transaction
+func EnqueueOutbox(tx *gorm.DB, message *OutboxMessage) error {
+	message.ID = 0
+	message.Status = OutboxPending
+	message.Attempts = 0
+	if message.NextAttemptAt.IsZero() {
+		message.NextAttemptAt = time.Now()
+	}
+	return tx.Create(message).Error
+}
+
+// Delivery fields whose changes are sent by email and sms, other changes only
+// reach the in-app inbox
+var alertDeliveryFields = []string{"scheduledAt", "schoolId"}
+
+// Should an event go out by email and sms, rather than to the in-app inbox only
+func IsAlertEvent(topic string, changes []OutboxChange) bool {
+	switch topic {
+	case OutboxDeliveryUpdated:
+		return slices.ContainsFunc(changes, func(change OutboxChange) bool {
+			return slices.Contains(alertDeliveryFields, change.Field)
+		})
+	case OutboxOrderUpdated:
+		return false
+	}
+	return true
+}
+
+// Events that only concern admins, rather than the delivery's school and vendors
+func IsAdminEvent(topic string) bool {
+	return topic == OutboxOrderEscalated || topic == OutboxLowStock
+}
+
+// Queue a delivery.created event
+func enqueueDeliveryCreated(tx *gorm.DB, delivery *Delivery) error {
+	deliveryID := delivery.ID
+	return EnqueueOutbox(tx, &OutboxMessage{
+		Topic:      OutboxDeliveryCreated,
+		DeliveryID: &deliveryID,
+	})
+}
+
+// Queue a delivery.deleted event, before the delivery and its orders are gone
+func enqueueDeliveryDeleted(tx *gorm.DB, delivery *Delivery) error {
+	var vendorIDs []int
+	err := tx.Model(&Order{}).Where("delivery_id = ? AND vendor_id IS NOT NULL", delivery.ID).
+		Distinct().Order("vendor_id").Pluck("vendor_id", &vendorIDs).Error
+	if err != nil {
+		return err
+	}
+	deliveryID := delivery.ID
+	return EnqueueOutbox(tx, &OutboxMessage{
+		Topic:      OutboxDeliveryDeleted,
+		DeliveryID: &deliveryID,
+		Payload:    OutboxPayload{SchoolID: delivery.SchoolID, VendorIDs: vendorIDs, ScheduledAt: delivery.ScheduledAt},
+	})
+}
+
+// Queue a delivery.updated event for the change logs of a delivery update
+func enqueueDeliveryUpdated(tx *gorm.DB, delivery *Delivery, logs []DeliveryChangeLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	deliveryID := delivery.ID
+	changedByID := logs[0].ChangeByUserID
+	message := OutboxMessage{
+		Topic:      OutboxDeliveryUpdated,
+		DeliveryID: &deliveryID,
+		Payload:    OutboxPayload{ChangedByID: &changedByID},
+	}
+	for _, log := range logs {
+		message.Payload.Changes = append(message.Payload.Changes, OutboxChange{Field: log.FieldName, OldValue: log.OldValue, NewValue: log.NewValue})
+	}
+	return EnqueueOutbox(tx, &message)
+}
+
+// Queue an order.status_changed event for the change logs of an order when they
+// include its status, an order.updated event otherwise
+func enqueueOrderChanged(tx *gorm.DB, order *Order, logs []OrderChangeLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	topic := OutboxOrderUpdated
+	if slices.ContainsFunc(logs, func(log OrderChangeLog) bool { return log.FieldName == "status" }) {
+		topic = OutboxOrderStatusChanged
+	}
+	orderID := order.ID
+	changedByID := logs[0].ChangeByUserID
+	message := OutboxMessage{
+		Topic:   topic,
+		OrderID: &orderID,
+		Payload: OutboxPayload{ChangedByID: &changedByID},
+	}
+	if order.DeliveryID != 0 {
+		deliveryID := order.DeliveryID
+		message.DeliveryID = &deliveryID
+	}
+	for _, log := range logs {
+		message.Payload.Changes = append(message.Payload.Changes, OutboxChange{Field: log.FieldName, OldValue: log.OldValue, NewValue: log.NewValue})
+	}
+	return EnqueueOutbox(tx, &message)
+}
+
+// Queue an order.added or order.removed event
+func enqueueOrderMoved(tx *gorm.DB, topic string, order *Order, deliveryID int) error {
+	orderID := order.ID
+	return EnqueueOutbox(tx, &OutboxMessage{
+		Topic:      topic,
+		DeliveryID: &deliveryID,
+		OrderID:    &orderID,
+	})
+}
+
+// Queue an order.deleted event
+func enqueueOrderDeleted(tx *gorm.DB, order *Order) error {
+	orderID := order.ID
+	message := OutboxMessage{Topic: OutboxOrderDeleted, OrderID: &orderID}
+	if order.DeliveryID != 0 {
+		deliveryID := order.DeliveryID
+		message.DeliveryID = &deliveryID
+	}
+	if order.VendorID != nil {
+		message.Payload.VendorIDs = []int{*order.VendorID}
+	}
+	return EnqueueOutbox(tx, &message)
+}
+
+// Queue a notification of a delivery to its recipients, requested by an admin
+func QueueDeliveryNotification(deliveryID int, note string, channels []string, sentByID *uint) (*OutboxMessage, error) {
+	message := OutboxMessage{
+		Topic:      OutboxDeliveryNotify,
+		DeliveryID: &deliveryID,
+		Payload:    OutboxPayload{Note: note, Channels: channels, SentByID: sentByID},
+	}
+	if err := EnqueueOutbox(db.Db, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Claim up to limit due messages for processing. A message is claimed by one
+// worker only, even when several poll at once.
+func ClaimOutboxMessages(limit int, now time.Time) ([]OutboxMessage, error) {
+	var due []OutboxMessage
+	err := db.Db.Where("status = ? AND next_attempt_at <= ?", OutboxPending, now).
+		Order("next_attempt_at asc, id asc").Limit(limit).Find(&due).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []OutboxMessage
+	for _, message := range due {
+		result := db.Db.Model(&OutboxMessage{}).
+			Where("id = ? AND status = ?", message.ID, OutboxPending).
+			UpdateColumn("status", OutboxProcessing)
+		if result.Error != nil {
+			return claimed, result.Error
+		}
+		if result.RowsAffected == 1 {
+			message.Status = OutboxProcessing
+			claimed = append(claimed, message)
+		}
+	}
+	return claimed, nil
+}
+
+// Mark a message done and enqueue the messages it expanded into, atomically
+func CompleteOutboxMessage(message *OutboxMessage, followUps []OutboxMessage) error {
+	now := time.Now()
+	done := *message
+	done.Status = OutboxDone
+	done.Attempts++
+	done.LastError = ""
+	done.ProcessedAt = &now
+
+	err := db.Db.Transaction(func(tx *gorm.DB) error {
+		parentID := uint(message.ID)
+		for i := range followUps {
+			followUps[i].ParentID = &parentID
+			if err := EnqueueOutbox(tx, &followUps[i]); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&done).Select("Status", "Attempts", "LastError", "ProcessedAt").Updates(&done).Error
+	})
+	if err != nil {
+		return err
+	}
+	*message = done
+	return nil
+}
+
+// Record a failed attempt, retrying at retryAt or dead-lettering the message when retryAt is nil
+func FailOutboxMessage(message *OutboxMessage, cause error, retryAt *time.Time) error {
+	message.Attempts++
+	message.LastError = cause.Error()
+	if retryAt == nil {
+		now := time.Now()
+		message.Status = OutboxDead
+		message.ProcessedAt = &now
+	} else {
+		message.Status = OutboxPending
+		message.NextAttemptAt = *retryAt
+	}
+	return db.Db.Model(message).Select("Status", "Attempts", "LastError", "NextAttemptAt", "ProcessedAt").Updates(message).Error
+}
+
+// Return messages left claimed by a worker that stopped, e.g. on a crash, to the queue
+func ReleaseClaimedOutboxMessages() (int64, error) {
+	result := db.Db.Model(&OutboxMessage{}).Where("status = ?", OutboxProcessing).
+		UpdateColumn("status", OutboxPending)
+	return result.RowsAffected, result.Error
+}
+
+// Get outbox messages, newest first, optionally of one status and topic
+func GetOutboxMessages(OutboxMessages *[]OutboxMessage, status string, topic string, limit int) (err error) {
+	query := db.Db.Order("id desc")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if topic != "" {
+		query = query.Where("topic = ?", topic)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err = query.Find(OutboxMessages).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get Outbox Message by ID
+func GetOutboxMessageByID(OutboxMessage *OutboxMessage, id uint) (err error) {
+	err = db.Db.First(OutboxMessage, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Put a dead message back in the queue with a fresh set of attempts
+func ReplayOutboxMessage(message *OutboxMessage) error {
+	if message.Status != OutboxDead {
+		return ErrOutboxNotReplayable
+	}
+	message.Status = OutboxPending
+	message.Attempts = 0
+	message.NextAttemptAt = time.Now()
+	message.ProcessedAt = nil
+	return db.Db.Model(message).Select("Status", "Attempts", "NextAttemptAt", "ProcessedAt").Updates(message).Error
+}
+
+// Put every dead message, optionally of one topic, back in the queue
+func ReplayDeadOutboxMessages(topic string) (int64, error) {
+	query := db.Db.Model(&OutboxMessage{}).Where("status = ?", OutboxDead)
+	if topic != "" {
+		query = query.Where("topic = ?", topic)
+	}
+	result := query.UpdateColumns(map[string]any{
+		"status":          OutboxPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+		"processed_at":    nil,
+	})
+	return result.RowsAffected, result.Error
+}
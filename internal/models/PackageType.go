@@ -0,0 +1,216 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// How a package item quantity scales
+const (
+	PackageItemPerStudent = "student"
+	PackageItemPerBox     = "box"
+)
+
+var ErrPackageTypeInUse = errors.New("package type has versions used by deliveries")
+
+// PackageType is a kind of package delivered to schools, e.g. "standard"
+type PackageType struct {
+	Model
+	Code        string `gorm:"unique" json:"code"` // matches Delivery.PackageType
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Students served by one box, used for items counted per box
+	StudentsPerBox int `gorm:"default:1" json:"studentsPerBox"`
+
+	// One-to-many, versions are never edited so past deliveries keep their contents
+	Versions []PackageVersion `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"versions,omitempty"`
+}
+
+// PackageVersion is the bill of materials of a package type from a given date on
+type PackageVersion struct {
+	Model
+	PackageTypeID int `gorm:"uniqueIndex:idx_package_version" json:"packageTypeId"`
+	Version       int `gorm:"uniqueIndex:idx_package_version" json:"version"`
+
+	// Applies to deliveries scheduled on or after this date, always applies when empty
+	EffectiveFrom *time.Time `json:"effectiveFrom"`
+
+	Items []PackageItem `gorm:"serializer:json" json:"items"`
+	Notes string        `json:"notes"`
+}
+
+// PackageItem is one line of a package's bill of materials
+type PackageItem struct {
+	ItemID     *int    `json:"itemId"`
+	Item       string  `json:"item"`
+	Quantity   float64 `json:"quantity"`
+	Per        string  `json:"per"` // student, box
+	UnitCost   float64 `json:"unitPrice"`
+	VendorID   *int    `json:"vendorId"` // preferred vendor
+	IsInternal bool    `json:"isInternal"`
+}
+
+// Get all Package Types
+func GetAllPackageTypes(PackageType *[]PackageType) (err error) {
+	err = db.Db.Find(PackageType).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get Package Type by ID, with its versions
+func GetPackageTypeByID(PackageType *PackageType, id uint) (err error) {
+	err = db.Db.Preload("Versions", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("version asc")
+	}).First(PackageType, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Package Type
+func CreatePackageType(PackageType *PackageType) (err error) {
+	err = db.Db.Create(PackageType).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update Package Type, versions are added separately
+func UpdatePackageType(PackageType *PackageType) (err error) {
+	err = db.Db.Omit("Versions").Save(PackageType).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete Package Type, unless deliveries were built from one of its versions
+func DeletePackageType(PackageType *PackageType) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		var used int64
+		err := tx.Model(&Delivery{}).Where("package_version_id IN (?)",
+			tx.Model(&PackageVersion{}).Select("id").Where("package_type_id = ?", PackageType.ID)).
+			Count(&used).Error
+		if err != nil {
+			return err
+		}
+		if used > 0 {
+			return ErrPackageTypeInUse
+		}
+		return tx.Select("Versions").Delete(PackageType).Error
+	})
+}
+
+// Add a new version to a package type, numbered after the latest one
+func AddPackageVersion(PackageType *PackageType, version *PackageVersion) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		var latest int
+		err := tx.Model(&PackageVersion{}).Where("package_type_id = ?", PackageType.ID).
+			Select("COALESCE(MAX(version), 0)").Scan(&latest).Error
+		if err != nil {
+			return err
+		}
+		version.ID = 0
+		version.PackageTypeID = PackageType.ID
+		version.Version = latest + 1
+		return tx.Create(version).Error
+	})
+}
+
+// Get the version of a package type in effect on a date, the latest one without a date
+func GetEffectivePackageVersion(code string, on *time.Time) (*PackageType, *PackageVersion, error) {
+	var packageType PackageType
+	err := db.Db.Where("code = ?", code).First(&packageType).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var version PackageVersion
+	query := db.Db.Where("package_type_id = ?", packageType.ID)
+	if on != nil {
+		query = query.Where("effective_from IS NULL OR effective_from <= ?", *on)
+	}
+	err = query.Order("version desc").First(&version).Error
+	if err != nil {
+		return &packageType, nil, err
+	}
+	return &packageType, &version, nil
+}
+
+// Resolve the vendor of each item before the version is written, see resolveFulfillment
+func (version *PackageVersion) BeforeSave(tx *gorm.DB) (err error) {
+	for i := range version.Items {
+		item := &version.Items[i]
+		if err := resolveFulfillment(tx, &item.VendorID, &item.IsInternal, true); err != nil {
+			return fmt.Errorf("item %q: %w", item.Item, err)
+		}
+	}
+	return nil
+}
+
+// Order lines for a package version delivered to a number of students
+func (version *PackageVersion) Orders(packageType *PackageType, headcount int) []Order {
+	studentsPerBox := max(packageType.StudentsPerBox, 1)
+	boxes := int(math.Ceil(float64(headcount) / float64(studentsPerBox)))
+
+	var orders []Order
+	for _, item := range version.Items {
+		units := boxes
+		if item.Per == PackageItemPerStudent {
+			units = headcount
+		}
+		orders = append(orders, Order{
+			ItemID:     item.ItemID,
+			Item:       item.Item,
+			Quantity:   int(math.Ceil(item.Quantity * float64(units))),
+			UnitCost:   item.UnitCost,
+			VendorID:   item.VendorID,
+			IsInternal: item.IsInternal,
+			Status:     OrderStatusPending,
+		})
+	}
+	return orders
+}
+
+// Generate the order lines of a delivery without orders from its package definition
+// and school headcount. Deliveries of package types not in the catalog, or for schools
+// without a headcount, are left as is.
+func ApplyPackageContents(Delivery *Delivery) (err error) {
+	if len(Delivery.Orders) > 0 || Delivery.PackageType == "" || Delivery.SchoolID == nil {
+		return nil
+	}
+
+	packageType, version, err := GetEffectivePackageVersion(Delivery.PackageType, Delivery.ScheduledAt)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var school School
+	err = db.Db.First(&school, *Delivery.SchoolID).Error
+	if err != nil {
+		return err
+	}
+
+	// Without a headcount every quantity would be 0, the orders are left to be added by hand
+	if school.Headcount <= 0 {
+		return nil
+	}
+
+	Delivery.PackageVersionID = &version.ID
+	Delivery.Orders = version.Orders(packageType, school.Headcount)
+	return nil
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+	"LindaBen_Phase_1_Project/internal/pdf"
+
+	"gorm.io/gorm"
+)
+
+var ErrNoOrdersForPurchaseOrder = errors.New("no confirmed orders without a purchase order in this period")
+
+// PurchaseOrder groups a vendor's confirmed orders over a date range into one
+// numbered document sent to the vendor
+type PurchaseOrder struct {
+	Model
+	Number string `gorm:"unique" json:"number"` // PO-000001
+
+	// Belongs-to: Vendor
+	VendorID int     `gorm:"index" json:"vendorId"`
+	Vendor   *Vendor `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"vendor,omitempty"`
+
+	PeriodStart string `json:"periodStart"` // YYYY-MM-DD, delivery dates covered
+	PeriodEnd   string `json:"periodEnd"`   // YYYY-MM-DD, inclusive
+
+	// Lines as sent, later changes to the orders do not alter the document
+	Lines []PurchaseOrderLine `gorm:"serializer:json" json:"lines"`
+	Total float64             `json:"total"`
+
+	PdfFileID *uint `json:"pdfFileId"`
+	PdfFile   *File `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"pdfFile,omitempty"`
+	CsvFileID *uint `json:"csvFileId"`
+	CsvFile   *File `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"csvFile,omitempty"`
+}
+
+// PurchaseOrderLine is one order on a purchase order with its destination
+type PurchaseOrderLine struct {
+	OrderID     int        `json:"orderId"`
+	ItemID      *int       `json:"itemId"`
+	Item        string     `json:"item"`
+	Quantity    int        `json:"quantity"`
+	UnitCost    float64    `json:"unitPrice"`
+	Total       float64    `json:"total"`
+	DeliveryID  int        `json:"deliveryId"`
+	ScheduledAt *time.Time `json:"scheduledAt"`
+	School      string     `json:"school"`
+	Address     string     `json:"address"`
+}
+
+// Get the purchase orders of a vendor, newest first
+func GetVendorPurchaseOrders(vendorID int) ([]PurchaseOrder, error) {
+	var purchaseOrders []PurchaseOrder
+	err := db.Db.Preload("PdfFile").Preload("CsvFile").
+		Where("vendor_id = ?", vendorID).Order("id desc").Find(&purchaseOrders).Error
+	return purchaseOrders, err
+}
+
+// Get Purchase Order by ID, with its files
+func GetPurchaseOrderByID(PurchaseOrder *PurchaseOrder, id uint) (err error) {
+	err = db.Db.Preload("Vendor").Preload("PdfFile").Preload("CsvFile").First(PurchaseOrder, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create a purchase order from the vendor's confirmed orders on deliveries scheduled
+// in [from, to] that are not on another purchase order yet, render it as PDF and CSV
+// and link the orders to it
+func CreatePurchaseOrder(vendor *Vendor, from, to time.Time) (*PurchaseOrder, error) {
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.Local)
+
+	purchaseOrder := &PurchaseOrder{
+		VendorID:    vendor.ID,
+		Vendor:      vendor,
+		PeriodStart: start.Format("2006-01-02"),
+		PeriodEnd:   end.Format("2006-01-02"),
+	}
+
+	// Files written before the transaction fails are removed again
+	var files []*File
+	err := db.Db.Transaction(func(tx *gorm.DB) error {
+		var orders []Order
+		err := tx.Preload("Delivery.School").
+			Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+			Where("orders.vendor_id = ? AND orders.status = ? AND orders.purchase_order_id IS NULL", vendor.ID, OrderStatusConfirmed).
+			Where("deliveries.scheduled_at >= ? AND deliveries.scheduled_at < ?", start, end.AddDate(0, 0, 1)).
+			Order("deliveries.scheduled_at asc, orders.id asc").Find(&orders).Error
+		if err != nil {
+			return err
+		}
+		if len(orders) == 0 {
+			return ErrNoOrdersForPurchaseOrder
+		}
+
+		ids := make([]int, len(orders))
+		for i, order := range orders {
+			ids[i] = order.ID
+			line := PurchaseOrderLine{
+				OrderID:     order.ID,
+				ItemID:      order.ItemID,
+				Item:        order.Item,
+				Quantity:    order.Quantity,
+				UnitCost:    order.UnitCost,
+				Total:       float64(order.Quantity) * order.UnitCost,
+				DeliveryID:  order.DeliveryID,
+				ScheduledAt: order.Delivery.ScheduledAt,
+			}
+			if school := order.Delivery.School; school != nil {
+				line.School = school.Name
+				line.Address = school.Address
+			}
+			purchaseOrder.Lines = append(purchaseOrder.Lines, line)
+			purchaseOrder.Total += line.Total
+		}
+
+		if err := tx.Omit("Vendor").Create(purchaseOrder).Error; err != nil {
+			return err
+		}
+		purchaseOrder.Number = fmt.Sprintf("PO-%06d", purchaseOrder.ID)
+
+		pdfFile, err := SaveGeneratedFile(tx, purchaseOrder.Number+".pdf", purchaseOrder.PDF())
+		if err != nil {
+			return err
+		}
+		files = append(files, pdfFile)
+		csvData, err := purchaseOrder.CSV()
+		if err != nil {
+			return err
+		}
+		csvFile, err := SaveGeneratedFile(tx, purchaseOrder.Number+".csv", csvData)
+		if err != nil {
+			return err
+		}
+		files = append(files, csvFile)
+		pdfID, csvID := uint(pdfFile.ID), uint(csvFile.ID)
+		purchaseOrder.PdfFileID, purchaseOrder.PdfFile = &pdfID, pdfFile
+		purchaseOrder.CsvFileID, purchaseOrder.CsvFile = &csvID, csvFile
+
+		err = tx.Model(purchaseOrder).Select("Number", "PdfFileID", "CsvFileID").Updates(purchaseOrder).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Order{}).Where("id IN ?", ids).UpdateColumn("purchase_order_id", purchaseOrder.ID).Error
+	})
+	if err != nil {
+		for _, file := range files {
+			RemoveFileContent(file)
+		}
+		return nil, err
+	}
+	purchaseOrder.setFileUrls()
+	return purchaseOrder, nil
+}
+
+// The files are private, they are downloaded from the purchase order
+func (purchaseOrder *PurchaseOrder) AfterFind(tx *gorm.DB) (err error) {
+	purchaseOrder.setFileUrls()
+	return nil
+}
+
+func (purchaseOrder *PurchaseOrder) setFileUrls() {
+	baseUrl := fmt.Sprintf("%s/api/vendors/%d/purchase-orders/%d/",
+		strings.TrimRight(os.Getenv("BASE_URL"), "/"), purchaseOrder.VendorID, purchaseOrder.ID)
+	if file := purchaseOrder.PdfFile; file != nil && file.Private {
+		file.Url = baseUrl + "pdf"
+	}
+	if file := purchaseOrder.CsvFile; file != nil && file.Private {
+		file.Url = baseUrl + "csv"
+	}
+}
+
+// Delete a purchase order and release its orders so they can go on a new one
+func DeletePurchaseOrder(PurchaseOrder *PurchaseOrder) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Order{}).Where("purchase_order_id = ?", PurchaseOrder.ID).UpdateColumn("purchase_order_id", nil).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(PurchaseOrder).Error
+	})
+}
+
+// Render the purchase order as CSV, one row per line
+func (purchaseOrder *PurchaseOrder) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"purchaseOrder", "orderId", "item", "quantity", "unitPrice", "total", "deliveryId", "scheduledAt", "school", "address"})
+	for _, line := range purchaseOrder.Lines {
+		scheduledAt := ""
+		if line.ScheduledAt != nil {
+			scheduledAt = line.ScheduledAt.In(time.Local).Format(time.RFC3339)
+		}
+		w.Write([]string{
+			purchaseOrder.Number,
+			strconv.Itoa(line.OrderID),
+			line.Item,
+			strconv.Itoa(line.Quantity),
+			strconv.FormatFloat(line.UnitCost, 'f', 2, 64),
+			strconv.FormatFloat(line.Total, 'f', 2, 64),
+			strconv.Itoa(line.DeliveryID),
+			scheduledAt,
+			line.School,
+			line.Address,
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Render the purchase order as a printable PDF
+func (purchaseOrder *PurchaseOrder) PDF() []byte {
+	doc := pdf.New()
+	vendorName := ""
+	if purchaseOrder.Vendor != nil {
+		vendorName = purchaseOrder.Vendor.Name
+	}
+
+	doc.Line("PURCHASE ORDER %s", purchaseOrder.Number)
+	doc.Line("")
+	doc.Line("Vendor:     %s", vendorName)
+	if purchaseOrder.Vendor != nil && purchaseOrder.Vendor.Address != "" {
+		doc.Line("            %s", purchaseOrder.Vendor.Address)
+	}
+	doc.Line("Deliveries: %s to %s", purchaseOrder.PeriodStart, purchaseOrder.PeriodEnd)
+	doc.Line("Issued:     %s", time.Now().Format("2006-01-02"))
+	doc.Line("")
+
+	// Lines are grouped by delivery so each destination is printed once
+	lastDelivery := 0
+	for _, line := range purchaseOrder.Lines {
+		if line.DeliveryID != lastDelivery {
+			lastDelivery = line.DeliveryID
+			when := "unscheduled"
+			if line.ScheduledAt != nil {
+				when = line.ScheduledAt.In(time.Local).Format("Mon 2006-01-02 15:04")
+			}
+			doc.Line("")
+			doc.Line("Delivery #%d, %s", line.DeliveryID, when)
+			doc.Line("  %s", line.School)
+			if line.Address != "" {
+				doc.Line("  %s", line.Address)
+			}
+			doc.Line("  %-40s %8s %10s %12s", "Item", "Qty", "Unit", "Total")
+			doc.Line("  %s", strings.Repeat("-", 73))
+		}
+		doc.Line("  %-40s %8d %10.2f %12.2f", truncate(line.Item, 40), line.Quantity, line.UnitCost, line.Total)
+	}
+
+	doc.Line("")
+	doc.Line("  %-40s %8s %10s %12.2f", "TOTAL", "", "", purchaseOrder.Total)
+	return doc.Bytes()
+}
+
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "~"
+}
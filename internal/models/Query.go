@@ -6,6 +6,8 @@ import (
 	"math"
 	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type UserFilterParams struct {
@@ -60,6 +62,24 @@ type DeliveryFilterParams struct {
 	Expand        []string `form:"expand"`
 }
 
+type ItemFilterParams struct {
+	Search     *string  `form:"search"`
+	Category   []string `form:"category"`
+	Perishable *bool    `form:"perishable"`
+	Page       *int     `form:"page"`
+	PageSize   *int     `form:"pageSize"`
+	SortBy     *string  `form:"sortBy"`
+	SortOrder  *string  `form:"sortOrder"`
+}
+
+type NotificationFilterParams struct {
+	Unread     *bool   `form:"unread"`
+	EventType  *string `form:"eventType"`
+	DeliveryID *int    `form:"deliveryId"`
+	Page       *int    `form:"page"`
+	PageSize   *int    `form:"pageSize"`
+}
+
 func QueryUsers(filters UserFilterParams) (PaginatedResponse[User], error) {
 	var users []User
 	query := db.Db.Model(&User{}).Preload("Avatar")
@@ -287,6 +307,80 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 	}
 
 	// Filters
+	query, err := filterDeliveries(query, filters)
+	if err != nil {
+		return PaginatedResponse[Delivery]{}, err
+	}
+
+	// Total counts
+	var total int64
+	query.Count(&total)
+	var totalUnfiltered int64
+	db.Db.Model(&Delivery{}).Count(&totalUnfiltered)
+
+	// Pagination
+	page := 1
+	pageSize := 10
+	if filters.Page != nil {
+		page = *filters.Page
+	}
+	if filters.PageSize != nil {
+		pageSize = *filters.PageSize
+	}
+	offset := (page - 1) * pageSize
+	query = query.Offset(offset).Limit(pageSize)
+
+	// Sorting
+	sortBy := "deliveries.id"
+	sortOrder := "asc"
+	if filters.SortBy != nil {
+		switch *filters.SortBy {
+		case "scheduledAt":
+			sortBy = "deliveries.scheduled_at"
+		case "packageType":
+			sortBy = "deliveries.package_type"
+		case "status":
+			sortBy = "deliveries.status"
+		case "notes":
+			sortBy = "deliveries.notes"
+		case "contract":
+			sortBy = "deliveries.contract"
+		case "schoolId":
+			sortBy = "deliveries.school_id"
+		}
+	}
+	if filters.SortOrder != nil {
+		o := strings.ToLower(*filters.SortOrder)
+		if o == "asc" || o == "desc" {
+			sortOrder = o
+		}
+	}
+	query = query.Order(fmt.Sprintf("%s %s", sortBy, sortOrder))
+
+	// Execute
+	if err := query.Find(&delivery).Error; err != nil {
+		return PaginatedResponse[Delivery]{}, err
+	}
+
+	totalPages := int(math.Ceil(float64(total) / float64(pageSize)))
+
+	response := PaginatedResponse[Delivery]{
+		Data: delivery,
+		Meta: PaginationMeta{
+			Total:           int(total),
+			TotalUnfiltered: int(totalUnfiltered),
+			Page:            page,
+			PageSize:        pageSize,
+			TotalPages:      totalPages,
+		},
+	}
+
+	return response, nil
+
+}
+
+// Apply the search and filters of a deliveries query, but not its paging and sorting
+func filterDeliveries(query *gorm.DB, filters DeliveryFilterParams) (*gorm.DB, error) {
 	if filters.Search != nil && *filters.Search != "" {
 		s := "%" + strings.ToLower(*filters.Search) + "%"
 		query = query.Joins("LEFT JOIN schools ON schools.id = deliveries.school_id")
@@ -297,7 +391,7 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 		if err != nil {
 			from, err = time.Parse("2006-01-02", *filters.ScheduledFrom)
 			if err != nil {
-				return PaginatedResponse[Delivery]{}, fmt.Errorf("invalid scheduledFrom: %w", err)
+				return nil, fmt.Errorf("invalid scheduledFrom: %w", err)
 			}
 		}
 		query = query.Where("deliveries.scheduled_at >= ?", from)
@@ -307,7 +401,7 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 		if err != nil {
 			to, err = time.Parse("2006-01-02", *filters.ScheduledTo)
 			if err != nil {
-				return PaginatedResponse[Delivery]{}, fmt.Errorf("invalid scheduledTo: %w", err)
+				return nil, fmt.Errorf("invalid scheduledTo: %w", err)
 			}
 		}
 		query = query.Where("deliveries.scheduled_at <= ?", to)
@@ -322,25 +416,15 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 		query = query.Where("deliveries.package_type IN ?", filters.PackageType)
 	}
 	if len(filters.Status) > 0 {
-		var parts []string
+		var statuses []string
 		for _, st := range filters.Status {
-			s := strings.ToLower(strings.TrimSpace(st))
-			if s == "" {
-				continue
-			}
-			switch s {
-			case "pending":
-				parts = append(parts, "EXISTS (SELECT 1 FROM orders WHERE orders.delivery_id = deliveries.id AND LOWER(orders.status) = 'pending')")
-			case "confirmed":
-				parts = append(parts, "NOT EXISTS (SELECT 1 FROM orders WHERE orders.delivery_id = deliveries.id AND LOWER(orders.status) = 'pending') AND EXISTS (SELECT 1 FROM orders WHERE orders.delivery_id = deliveries.id AND LOWER(orders.status) = 'confirmed')")
-			case "completed":
-				parts = append(parts, "NOT EXISTS (SELECT 1 FROM orders WHERE orders.delivery_id = deliveries.id AND LOWER(orders.status) IN ('pending','confirmed')) AND EXISTS (SELECT 1 FROM orders WHERE orders.delivery_id = deliveries.id AND LOWER(orders.status) = 'completed')")
-			case "cancelled":
-				parts = append(parts, "NOT EXISTS (SELECT 1 FROM orders WHERE orders.delivery_id = deliveries.id AND LOWER(orders.status) IN ('pending','confirmed','completed')) AND EXISTS (SELECT 1 FROM orders WHERE orders.delivery_id = deliveries.id AND LOWER(orders.status) = 'cancelled')")
+			if s := strings.ToLower(strings.TrimSpace(st)); s != "" {
+				statuses = append(statuses, s)
 			}
 		}
-		if len(parts) > 0 {
-			query = query.Where("(" + strings.Join(parts, " OR ") + ") AND deliveries.contract != 'hold'")
+		// Held deliveries have no meaningful status until they are released
+		if len(statuses) > 0 {
+			query = query.Where("deliveries.status IN ? AND deliveries.contract != ?", statuses, ContractHold)
 		}
 	}
 	if len(filters.VendorID) > 0 {
@@ -350,12 +434,31 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 		}
 		query = query.Where("(" + strings.Join(parts, " OR ") + ")")
 	}
+	return query, nil
+}
+
+func QueryItems(filters ItemFilterParams) (PaginatedResponse[Item], error) {
+	var items []Item
+	query := db.Db.Model(&Item{})
+
+	// Filters
+	if filters.Search != nil && *filters.Search != "" {
+		s := "%" + strings.ToLower(*filters.Search) + "%"
+		normalized := "%" + NormalizeItemName(*filters.Search) + "%"
+		query = query.Where("LOWER(name) LIKE ? OR LOWER(sku) LIKE ? OR LOWER(aliases) LIKE ? OR LOWER(name) LIKE ?", s, s, s, normalized)
+	}
+	if len(filters.Category) > 0 {
+		query = query.Where("category IN ?", filters.Category)
+	}
+	if filters.Perishable != nil {
+		query = query.Where("perishable = ?", *filters.Perishable)
+	}
 
 	// Total counts
 	var total int64
 	query.Count(&total)
 	var totalUnfiltered int64
-	db.Db.Model(&Delivery{}).Count(&totalUnfiltered)
+	db.Db.Model(&Item{}).Count(&totalUnfiltered)
 
 	// Pagination
 	page := 1
@@ -370,20 +473,12 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 	query = query.Offset(offset).Limit(pageSize)
 
 	// Sorting
-	sortBy := "deliveries.id"
+	sortBy := "name"
 	sortOrder := "asc"
 	if filters.SortBy != nil {
 		switch *filters.SortBy {
-		case "scheduledAt":
-			sortBy = "deliveries.scheduled_to"
-		case "packageType":
-			sortBy = "deliveries.box_type"
-		case "notes":
-			sortBy = "deliveries.notes"
-		case "contract":
-			sortBy = "deliveries.contract"
-		case "schoolId":
-			sortBy = "deliveries.school_id"
+		case "sku", "name", "unit", "category", "perishable", "id":
+			sortBy = *filters.SortBy
 		}
 	}
 	if filters.SortOrder != nil {
@@ -395,14 +490,14 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 	query = query.Order(fmt.Sprintf("%s %s", sortBy, sortOrder))
 
 	// Execute
-	if err := query.Find(&delivery).Error; err != nil {
-		return PaginatedResponse[Delivery]{}, err
+	if err := query.Find(&items).Error; err != nil {
+		return PaginatedResponse[Item]{}, err
 	}
 
 	totalPages := int(math.Ceil(float64(total) / float64(pageSize)))
 
-	response := PaginatedResponse[Delivery]{
-		Data: delivery,
+	response := PaginatedResponse[Item]{
+		Data: items,
 		Meta: PaginationMeta{
 			Total:           int(total),
 			TotalUnfiltered: int(totalUnfiltered),
@@ -415,3 +510,61 @@ func QueryDeliveries(filters DeliveryFilterParams) (PaginatedResponse[Delivery],
 	return response, nil
 
 }
+
+// Query the notifications of a user, newest first
+func QueryNotifications(userID uint, filters NotificationFilterParams) (PaginatedResponse[Notification], error) {
+	notifications := []Notification{}
+	query := db.Db.Model(&Notification{}).Where("user_id = ?", userID)
+
+	// Filters
+	if filters.Unread != nil {
+		if *filters.Unread {
+			query = query.Where("read_at IS NULL")
+		} else {
+			query = query.Where("read_at IS NOT NULL")
+		}
+	}
+	if filters.EventType != nil && *filters.EventType != "" {
+		query = query.Where("event_type = ?", *filters.EventType)
+	}
+	if filters.DeliveryID != nil {
+		query = query.Where("delivery_id = ?", *filters.DeliveryID)
+	}
+
+	// Total counts
+	var total int64
+	query.Count(&total)
+	var totalUnfiltered int64
+	db.Db.Model(&Notification{}).Where("user_id = ?", userID).Count(&totalUnfiltered)
+
+	// Pagination
+	page := 1
+	pageSize := 20
+	if filters.Page != nil && *filters.Page > 0 {
+		page = *filters.Page
+	}
+	if filters.PageSize != nil && *filters.PageSize > 0 {
+		pageSize = *filters.PageSize
+	}
+	query = query.Offset((page - 1) * pageSize).Limit(pageSize).Order("id desc")
+
+	// Execute
+	if err := query.Find(&notifications).Error; err != nil {
+		return PaginatedResponse[Notification]{}, err
+	}
+
+	totalPages := int(math.Ceil(float64(total) / float64(pageSize)))
+
+	response := PaginatedResponse[Notification]{
+		Data: notifications,
+		Meta: PaginationMeta{
+			Total:           int(total),
+			TotalUnfiltered: int(totalUnfiltered),
+			Page:            page,
+			PageSize:        pageSize,
+			TotalPages:      totalPages,
+		},
+	}
+
+	return response, nil
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence is the subset of an iCalendar RRULE supported by delivery schedules,
+// e.g. "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH;UNTIL=20260612"
+type Recurrence struct {
+	Freq     string // DAILY, WEEKLY, MONTHLY
+	Interval int
+	ByDay    []time.Weekday
+	Count    int
+	Until    *time.Time
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Parse an RRULE string, the "RRULE:" prefix is optional
+func ParseRecurrence(rule string) (Recurrence, error) {
+	r := Recurrence{Interval: 1}
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+
+	for part := range strings.SplitSeq(rule, ";") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return Recurrence{}, fmt.Errorf("invalid recurrence part %q", part)
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return Recurrence{}, fmt.Errorf("invalid INTERVAL %q", value)
+			}
+			r.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return Recurrence{}, fmt.Errorf("invalid COUNT %q", value)
+			}
+			r.Count = n
+		case "UNTIL":
+			until, err := parseRRuleDate(value)
+			if err != nil {
+				return Recurrence{}, fmt.Errorf("invalid UNTIL %q", value)
+			}
+			r.Until = &until
+		case "BYDAY":
+			for day := range strings.SplitSeq(value, ",") {
+				weekday, ok := rruleWeekdays[strings.ToUpper(day)]
+				if !ok {
+					return Recurrence{}, fmt.Errorf("invalid BYDAY %q", day)
+				}
+				r.ByDay = append(r.ByDay, weekday)
+			}
+		default:
+			return Recurrence{}, fmt.Errorf("unsupported recurrence part %q", key)
+		}
+	}
+
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY":
+	case "":
+		return Recurrence{}, fmt.Errorf("recurrence FREQ is required")
+	default:
+		return Recurrence{}, fmt.Errorf("unsupported FREQ %q", r.Freq)
+	}
+	return r, nil
+}
+
+func parseRRuleDate(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// Occurrences of the recurrence starting at start that fall within [from, to].
+// Every occurrence keeps the clock time and location of start.
+func (r Recurrence) Between(start, from, to time.Time) []time.Time {
+	var occurrences []time.Time
+	n := 0
+
+	// emit reports whether iteration should continue
+	emit := func(t time.Time) bool {
+		if t.Before(start) {
+			return true
+		}
+		if t.After(to) || (r.Until != nil && t.After(endOfDay(*r.Until))) {
+			return false
+		}
+		n++
+		if r.Count > 0 && n > r.Count {
+			return false
+		}
+		if !t.Before(from) {
+			occurrences = append(occurrences, t)
+		}
+		return true
+	}
+
+	switch r.Freq {
+	case "DAILY":
+		for t := start; emit(t); t = t.AddDate(0, 0, r.Interval) {
+		}
+	case "WEEKLY":
+		days := r.ByDay
+		if len(days) == 0 {
+			days = []time.Weekday{start.Weekday()}
+		}
+		// Weeks start on Monday, as in RRULE's default WKST
+		weekStart := start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		for week := weekStart; ; week = week.AddDate(0, 0, 7*r.Interval) {
+			for offset := range 7 {
+				t := week.AddDate(0, 0, offset)
+				if !slices.Contains(days, t.Weekday()) {
+					continue
+				}
+				if !emit(t) {
+					return occurrences
+				}
+			}
+		}
+	case "MONTHLY":
+		for i := 0; ; i += r.Interval {
+			t := time.Date(start.Year(), start.Month()+time.Month(i), start.Day(), start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+			if t.After(to) {
+				break
+			}
+			// Skip months that do not have the start day (e.g. the 31st)
+			if t.Day() != start.Day() {
+				continue
+			}
+			if !emit(t) {
+				break
+			}
+		}
+	}
+	return occurrences
+}
+
+func endOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 0, t.Location())
+}
@@ -2,6 +2,9 @@ package models
 
 import (
 	"LindaBen_Phase_1_Project/internal/db"
+	"fmt"
+	"strings"
+	"time"
 )
 
 type School struct {
@@ -10,8 +13,113 @@ type School struct {
 	Address    string     `json:"address"`
 	Coordinate Coordinate `gorm:"embedded" json:"coordinate"`
 
+	// Number of students served, used as the default order quantity
+	Headcount int `json:"headcount"`
+
+	// Receiving hours in local time, "HH:MM", used when no receiving windows are set
+	ReceivingFrom string `json:"receivingFrom"`
+	ReceivingTo   string `json:"receivingTo"`
+	// Receiving windows per weekday, the first window of a day is the preferred drop-off time
+	ReceivingWindows []ReceivingWindow `gorm:"serializer:json" json:"receivingWindows"`
+
+	DockInstructions string `json:"dockInstructions"` // dock, entrance and parking instructions for drivers
+
 	ContactID *uint `json:"contactId"`
 	Contact   *User `gorm:"foreignKey:ContactID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;" json:"contact"` //Belongs to User
+
+	// Additional people to reach at the school
+	Contacts []SchoolContact `gorm:"serializer:json" json:"contacts"`
+}
+
+// ReceivingWindow is a time range in which a school accepts deliveries on a weekday
+type ReceivingWindow struct {
+	Weekday string `json:"weekday"` // mon, tue, wed, thu, fri, sat, sun
+	From    string `json:"from"`    // HH:MM, local time
+	To      string `json:"to"`      // HH:MM, local time
+}
+
+// SchoolContact is a person to reach at a school who is not necessarily a user
+type SchoolContact struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"` // e.g. principal, front office, cafeteria
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parse a weekday name such as "mon" or "Monday"
+func ParseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) >= 3 {
+		if weekday, ok := weekdayNames[name[:3]]; ok {
+			return weekday, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("invalid weekday %q", name)
+}
+
+// Validate receiving windows and hours
+func (school *School) ValidateReceivingHours() error {
+	for _, clock := range []string{school.ReceivingFrom, school.ReceivingTo} {
+		if _, err := time.Parse("15:04", clock); clock != "" && err != nil {
+			return fmt.Errorf("invalid receiving time %q", clock)
+		}
+	}
+	for _, window := range school.ReceivingWindows {
+		if _, err := ParseWeekday(window.Weekday); err != nil {
+			return err
+		}
+		from, err := time.Parse("15:04", window.From)
+		if err != nil {
+			return fmt.Errorf("invalid receiving window time %q", window.From)
+		}
+		to, err := time.Parse("15:04", window.To)
+		if err != nil {
+			return fmt.Errorf("invalid receiving window time %q", window.To)
+		}
+		if to.Before(from) {
+			return fmt.Errorf("receiving window on %s ends before it starts", window.Weekday)
+		}
+	}
+	return nil
+}
+
+// Receiving windows that apply on a weekday. Without windows for that day,
+// the general receiving hours are used when the school has no windows at all.
+func (school *School) ReceivingWindowsOn(weekday time.Weekday) []ReceivingWindow {
+	var windows []ReceivingWindow
+	for _, window := range school.ReceivingWindows {
+		if day, err := ParseWeekday(window.Weekday); err == nil && day == weekday {
+			windows = append(windows, window)
+		}
+	}
+	if len(windows) == 0 && len(school.ReceivingWindows) == 0 && (school.ReceivingFrom != "" || school.ReceivingTo != "") {
+		windows = append(windows, ReceivingWindow{From: school.ReceivingFrom, To: school.ReceivingTo})
+	}
+	return windows
+}
+
+// Preferred drop-off time on the day of date, in local time
+func (school *School) DefaultDeliveryTime(date time.Time) (time.Time, bool) {
+	local := date.In(time.Local)
+	windows := school.ReceivingWindowsOn(local.Weekday())
+	if len(windows) == 0 || windows[0].From == "" {
+		return time.Time{}, false
+	}
+	clock, err := time.Parse("15:04", windows[0].From)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(local.Year(), local.Month(), local.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local), true
 }
 
 // Get all Schools
@@ -12,6 +12,18 @@ type Vendor struct {
 
 	Type string `json:"type"` // "produce", "shelf_stable", "packaging"
 
+	// The organization itself, which fulfills internal orders from its own stock
+	IsInternal bool `gorm:"index" json:"isInternal"`
+
+	// Days before delivery by which orders must be confirmed, DefaultVendorLeadTimeDays when 0
+	LeadTimeDays int `json:"leadTimeDays"`
+
+	// Capacity rules, 0 and empty mean unlimited
+	MaxOrdersPerDay int      `json:"maxOrdersPerDay"`
+	MaxUnitsPerDay  int      `json:"maxUnitsPerDay"`
+	ServiceDays     []string `gorm:"serializer:json" json:"serviceDays"`   // mon, tue, ...; every day when empty
+	BlackoutDates   []string `gorm:"serializer:json" json:"blackoutDates"` // YYYY-MM-DD days the vendor cannot deliver
+
 	ContactID *uint
 	Contact   *User `gorm:"foreignKey:ContactID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"` //Belongs to User
 }
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+var ErrVendorCapacity = errors.New("vendor capacity exceeded")
+
+// VendorCapacityError explains why a vendor cannot take more orders on a day and
+// lists vendors of the same type that can
+type VendorCapacityError struct {
+	VendorID     int      `json:"vendorId"`
+	Day          string   `json:"day"` // YYYY-MM-DD
+	Reason       string   `json:"reason"`
+	Alternatives []Vendor `json:"alternatives"`
+}
+
+func (e *VendorCapacityError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrVendorCapacity, e.Reason)
+}
+
+func (e *VendorCapacityError) Unwrap() error {
+	return ErrVendorCapacity
+}
+
+// Validate the vendor's capacity rules
+func (vendor *Vendor) ValidateCapacity() error {
+	if vendor.MaxOrdersPerDay < 0 || vendor.MaxUnitsPerDay < 0 || vendor.LeadTimeDays < 0 {
+		return errors.New("capacity limits and lead time must not be negative")
+	}
+	for _, day := range vendor.ServiceDays {
+		if _, err := ParseWeekday(day); err != nil {
+			return err
+		}
+	}
+	for _, day := range vendor.BlackoutDates {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			return fmt.Errorf("invalid blackout date %q", day)
+		}
+	}
+	return nil
+}
+
+// Does the vendor deliver on the day, ignoring its capacity
+func (vendor *Vendor) ServesOn(local time.Time) bool {
+	if slices.Contains(vendor.BlackoutDates, local.Format("2006-01-02")) {
+		return false
+	}
+	if len(vendor.ServiceDays) == 0 {
+		return true
+	}
+	for _, day := range vendor.ServiceDays {
+		if weekday, err := ParseWeekday(day); err == nil && weekday == local.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// Count the vendor's non-cancelled orders and units on deliveries scheduled on a
+// local day, leaving out the given orders
+func vendorLoad(tx *gorm.DB, vendorID int, local time.Time, excludeOrderIDs []int) (orders int, units int, err error) {
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+
+	var load struct {
+		Orders int
+		Units  int
+	}
+	query := tx.Model(&Order{}).
+		Select("COUNT(*) AS orders, COALESCE(SUM(orders.quantity), 0) AS units").
+		Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+		Where("orders.vendor_id = ? AND orders.status != ?", vendorID, OrderStatusCancelled).
+		Where("deliveries.scheduled_at >= ? AND deliveries.scheduled_at < ?", start, start.AddDate(0, 0, 1))
+	if len(excludeOrderIDs) > 0 {
+		query = query.Where("orders.id NOT IN ?", excludeOrderIDs)
+	}
+	err = query.Scan(&load).Error
+	return load.Orders, load.Units, err
+}
+
+// Why the vendor cannot take the given orders and units on the day, empty when it can
+func vendorCapacityProblem(tx *gorm.DB, vendor *Vendor, local time.Time, orders, units int, excludeOrderIDs []int) (string, error) {
+	day := local.Format("2006-01-02")
+	if !vendor.ServesOn(local) {
+		return fmt.Sprintf("%s does not deliver on %s %s", vendor.Name, local.Weekday(), day), nil
+	}
+	if vendor.MaxOrdersPerDay == 0 && vendor.MaxUnitsPerDay == 0 {
+		return "", nil
+	}
+
+	bookedOrders, bookedUnits, err := vendorLoad(tx, vendor.ID, local, excludeOrderIDs)
+	if err != nil {
+		return "", err
+	}
+	if vendor.MaxOrdersPerDay > 0 && bookedOrders+orders > vendor.MaxOrdersPerDay {
+		return fmt.Sprintf("%s has %d of %d orders booked on %s, %d more do not fit", vendor.Name, bookedOrders, vendor.MaxOrdersPerDay, day, orders), nil
+	}
+	if vendor.MaxUnitsPerDay > 0 && bookedUnits+units > vendor.MaxUnitsPerDay {
+		return fmt.Sprintf("%s has %d of %d units booked on %s, %d more do not fit", vendor.Name, bookedUnits, vendor.MaxUnitsPerDay, day, units), nil
+	}
+	return "", nil
+}
+
+// Check that a vendor can take more orders and units on the day of a delivery.
+// Orders already counted, e.g. the one being updated, are left out of the load.
+// Returns a *VendorCapacityError with alternatives when it cannot.
+func CheckVendorCapacity(tx *gorm.DB, vendorID int, scheduledAt *time.Time, orders, units int, excludeOrderIDs []int) error {
+	if scheduledAt == nil {
+		return nil
+	}
+	local := scheduledAt.In(time.Local)
+
+	var vendor Vendor
+	if err := tx.First(&vendor, vendorID).Error; err != nil {
+		return err
+	}
+	reason, err := vendorCapacityProblem(tx, &vendor, local, orders, units, excludeOrderIDs)
+	if err != nil || reason == "" {
+		return err
+	}
+
+	alternatives, err := FindAvailableVendors(tx, vendor.Type, local, orders, units, vendor.ID)
+	if err != nil {
+		return err
+	}
+	return &VendorCapacityError{
+		VendorID:     vendor.ID,
+		Day:          local.Format("2006-01-02"),
+		Reason:       reason,
+		Alternatives: alternatives,
+	}
+}
+
+// Find vendors of a type that can take the given orders and units on a day
+func FindAvailableVendors(tx *gorm.DB, vendorType string, local time.Time, orders, units int, excludeVendorID int) ([]Vendor, error) {
+	var candidates []Vendor
+	err := tx.Where("type = ? AND id != ?", vendorType, excludeVendorID).Order("name asc").Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	available := []Vendor{}
+	for i := range candidates {
+		reason, err := vendorCapacityProblem(tx, &candidates[i], local, orders, units, nil)
+		if err != nil {
+			return nil, err
+		}
+		if reason == "" {
+			available = append(available, candidates[i])
+		}
+	}
+	return available, nil
+}
+
+// Check the capacity of every vendor of a delivery's orders
+func checkDeliveryCapacity(tx *gorm.DB, Delivery *Delivery) error {
+	type load struct{ orders, units int }
+	loads := map[int]*load{}
+	var vendorIDs, existing []int
+	for _, order := range Delivery.Orders {
+		if order.VendorID == nil || NormalizeOrderStatus(order.Status) == OrderStatusCancelled {
+			continue
+		}
+		if loads[*order.VendorID] == nil {
+			loads[*order.VendorID] = &load{}
+			vendorIDs = append(vendorIDs, *order.VendorID)
+		}
+		loads[*order.VendorID].orders++
+		loads[*order.VendorID].units += order.Quantity
+		if order.ID > 0 {
+			existing = append(existing, order.ID)
+		}
+	}
+
+	for _, vendorID := range vendorIDs {
+		err := CheckVendorCapacity(tx, vendorID, Delivery.ScheduledAt, loads[vendorID].orders, loads[vendorID].units, existing)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the capacity of the vendors of a delivery's stored orders when the
+// delivery moves to another time, leaving its own orders out of the load
+func checkRescheduledCapacity(tx *gorm.DB, delivery *Delivery) error {
+	var stored Delivery
+	if err := tx.Preload("Orders").First(&stored, delivery.ID).Error; err != nil {
+		return err
+	}
+	if stored.ScheduledAt == nil && delivery.ScheduledAt == nil ||
+		stored.ScheduledAt != nil && delivery.ScheduledAt != nil && stored.ScheduledAt.Equal(*delivery.ScheduledAt) {
+		return nil
+	}
+	stored.ScheduledAt = delivery.ScheduledAt
+	return checkDeliveryCapacity(tx, &stored)
+}
+
+// Check the capacity of an order's vendor on its delivery's day, leaving the order itself out
+func CheckOrderCapacity(order *Order) error {
+	if order.VendorID == nil || order.DeliveryID == 0 || NormalizeOrderStatus(order.Status) == OrderStatusCancelled {
+		return nil
+	}
+	var delivery Delivery
+	if err := db.Db.Select("id", "scheduled_at").First(&delivery, order.DeliveryID).Error; err != nil {
+		return err
+	}
+	return CheckVendorCapacity(db.Db, *order.VendorID, delivery.ScheduledAt, 1, order.Quantity, []int{order.ID})
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"LindaBen_Phase_1_Project/internal/db"
+
+	"gorm.io/gorm"
+)
+
+var ErrOverlappingVendorPrice = errors.New("price overlaps an existing price of this vendor and item")
+
+// VendorPrice is a vendor's list price of a catalog item over a range of days
+type VendorPrice struct {
+	Model
+
+	// Belongs-to: Vendor
+	VendorID int     `gorm:"index" json:"vendorId"`
+	Vendor   *Vendor `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"vendor,omitempty"`
+
+	// Belongs-to: Item
+	ItemID int   `gorm:"index" json:"itemId"`
+	Item   *Item `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"item,omitempty"`
+
+	Price         float64 `json:"price"`                      // per Item.Unit
+	EffectiveFrom string  `gorm:"index" json:"effectiveFrom"` // YYYY-MM-DD
+	EffectiveTo   string  `json:"effectiveTo"`                // YYYY-MM-DD, inclusive, open-ended when empty
+	Notes         string  `json:"notes"`
+}
+
+// PriceDeviation is an order whose unit cost differs from the vendor's list price
+type PriceDeviation struct {
+	Order            Order      `json:"order"`
+	ScheduledAt      *time.Time `json:"scheduledAt"`
+	ListPrice        float64    `json:"listPrice"`
+	Difference       float64    `json:"difference"`       // unit cost minus list price
+	DeviationPercent float64    `json:"deviationPercent"` // difference relative to the list price
+}
+
+// Get the price list of a vendor, optionally only for one item
+func GetVendorPrices(vendorID int, itemID *int) ([]VendorPrice, error) {
+	var prices []VendorPrice
+	query := db.Db.Preload("Item").Where("vendor_id = ?", vendorID)
+	if itemID != nil {
+		query = query.Where("item_id = ?", *itemID)
+	}
+	err := query.Order("item_id asc, effective_from asc").Find(&prices).Error
+	return prices, err
+}
+
+// Get Vendor Price by ID
+func GetVendorPriceByID(VendorPrice *VendorPrice, id uint) (err error) {
+	err = db.Db.First(VendorPrice, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Vendor Price, rejecting ranges that overlap another price of the same item
+func CreateVendorPrice(VendorPrice *VendorPrice) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := checkVendorPriceOverlap(tx, VendorPrice); err != nil {
+			return err
+		}
+		return tx.Create(VendorPrice).Error
+	})
+}
+
+// Update Vendor Price, rejecting ranges that overlap another price of the same item
+func UpdateVendorPrice(VendorPrice *VendorPrice) (err error) {
+	return db.Db.Transaction(func(tx *gorm.DB) error {
+		if err := checkVendorPriceOverlap(tx, VendorPrice); err != nil {
+			return err
+		}
+		return tx.Omit("Vendor", "Item").Save(VendorPrice).Error
+	})
+}
+
+// Delete Vendor Price
+func DeleteVendorPrice(VendorPrice *VendorPrice) (err error) {
+	err = db.Db.Delete(VendorPrice).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Does the price apply on the given YYYY-MM-DD day
+func (price *VendorPrice) Covers(day string) bool {
+	return price.EffectiveFrom <= day && (price.EffectiveTo == "" || day <= price.EffectiveTo)
+}
+
+func checkVendorPriceOverlap(tx *gorm.DB, price *VendorPrice) error {
+	query := tx.Model(&VendorPrice{}).
+		Where("vendor_id = ? AND item_id = ? AND id != ?", price.VendorID, price.ItemID, price.ID).
+		Where("effective_to = '' OR effective_to >= ?", price.EffectiveFrom)
+	if price.EffectiveTo != "" {
+		query = query.Where("effective_from <= ?", price.EffectiveTo)
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrOverlappingVendorPrice
+	}
+	return nil
+}
+
+// Get the list price of an item from a vendor in effect on a day, nil when there is none
+func GetListPrice(tx *gorm.DB, vendorID int, itemID int, on time.Time) (*VendorPrice, error) {
+	day := on.In(time.Local).Format("2006-01-02")
+
+	var price VendorPrice
+	err := tx.Where("vendor_id = ? AND item_id = ? AND effective_from <= ?", vendorID, itemID, day).
+		Where("effective_to = '' OR effective_to >= ?", day).
+		Order("effective_from desc").Limit(1).Find(&price).Error
+	if err != nil || price.ID == 0 {
+		return nil, err
+	}
+	return &price, nil
+}
+
+// Default the unit cost of a new order from the vendor's price list on the delivery
+// date, or today for deliveries without a date. Costs set by hand are kept.
+func applyListPrice(tx *gorm.DB, order *Order) error {
+	if order.UnitCost != 0 || order.ItemID == nil || order.VendorID == nil {
+		return nil
+	}
+
+	on := time.Now()
+	if order.DeliveryID != 0 {
+		var delivery Delivery
+		err := tx.Select("id", "scheduled_at").First(&delivery, order.DeliveryID).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if delivery.ScheduledAt != nil {
+			on = *delivery.ScheduledAt
+		}
+	}
+
+	price, err := GetListPrice(tx, *order.VendorID, *order.ItemID, on)
+	if err != nil || price == nil {
+		return err
+	}
+	order.UnitCost = price.Price
+	return nil
+}
+
+// Find non-cancelled orders whose unit cost deviates from the vendor's list price on
+// the delivery date by at least threshold percent. Orders without a catalog item,
+// a vendor or a list price are not reported.
+func GetPriceDeviations(threshold float64, from, to *time.Time, vendorID *int) ([]PriceDeviation, error) {
+	var orders []Order
+	query := db.Db.Preload("Delivery").Preload("Vendor").Preload("CatalogItem").
+		Joins("JOIN deliveries ON deliveries.id = orders.delivery_id").
+		Where("orders.item_id IS NOT NULL AND orders.vendor_id IS NOT NULL AND orders.status != ?", OrderStatusCancelled)
+	if from != nil {
+		query = query.Where("deliveries.scheduled_at >= ?", *from)
+	}
+	if to != nil {
+		query = query.Where("deliveries.scheduled_at <= ?", *to)
+	}
+	if vendorID != nil {
+		query = query.Where("orders.vendor_id = ?", *vendorID)
+	}
+	if err := query.Order("deliveries.scheduled_at asc, orders.id asc").Find(&orders).Error; err != nil {
+		return nil, err
+	}
+
+	deviations := []PriceDeviation{}
+	for _, order := range orders {
+		on := order.CreatedAt
+		if order.Delivery.ScheduledAt != nil {
+			on = *order.Delivery.ScheduledAt
+		}
+		price, err := GetListPrice(db.Db, *order.VendorID, *order.ItemID, on)
+		if err != nil {
+			return nil, err
+		}
+		if price == nil {
+			continue
+		}
+
+		difference := order.UnitCost - price.Price
+		if math.Abs(difference) < 0.005 {
+			continue
+		}
+		percent := 100.0
+		if price.Price != 0 {
+			percent = difference / price.Price * 100
+		}
+		if math.Abs(percent) < threshold {
+			continue
+		}
+
+		deviations = append(deviations, PriceDeviation{
+			Order:            order,
+			ScheduledAt:      order.Delivery.ScheduledAt,
+			ListPrice:        price.Price,
+			Difference:       math.Round(difference*100) / 100,
+			DeviationPercent: math.Round(percent*10) / 10,
+		})
+	}
+	return deviations, nil
+}
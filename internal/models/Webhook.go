@@ -0,0 +1,196 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"LindaBen_Phase_1_Project/internal/db"
+)
+
+// Events webhooks can subscribe to, named like their outbox topics
+var WebhookEvents = []string{OutboxDeliveryCreated, OutboxDeliveryUpdated, OutboxDeliveryDeleted, OutboxOrderStatusChanged, OutboxOrderUpdated, OutboxOrderAdded, OutboxOrderRemoved, OutboxOrderDeleted}
+
+// Event of the test request sent from the ping endpoint
+const WebhookPing = "ping"
+
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// Webhook posts the events it subscribes to to a URL, signed with its secret
+type Webhook struct {
+	Model
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"` // HMAC-SHA256 key of the X-Webhook-Signature header, generated when empty
+	Events      []string `gorm:"serializer:json" json:"events"`
+	Active      bool     `json:"active"`
+	Description string   `json:"description"`
+}
+
+// WebhookDelivery is one attempt to post an event to a webhook
+type WebhookDelivery struct {
+	Model
+	WebhookID       uint   `gorm:"index" json:"webhookId"`
+	OutboxMessageID uint   `gorm:"index" json:"outboxMessageId"`
+	EventID         *uint  `json:"eventId"` // outbox event the request is about, the same on every attempt and replay
+	Event           string `json:"event"`
+	URL             string `json:"url"`
+	Attempt         int    `json:"attempt"`
+	RequestBody     string `json:"requestBody"`
+	StatusCode      int    `json:"statusCode"` // 0 when no response was received
+	ResponseBody    string `json:"responseBody"`
+	Error           string `json:"error"`
+	DurationMs      int64  `json:"durationMs"`
+	Success         bool   `json:"success"`
+}
+
+// Check the URL and events of a webhook
+func (webhook *Webhook) Validate() error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidWebhook)
+	}
+	if len(webhook.Events) == 0 {
+		return fmt.Errorf("%w: subscribe to at least one event", ErrInvalidWebhook)
+	}
+	for _, event := range webhook.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Get all Webhooks
+func GetAllWebhooks(Webhook *[]Webhook) (err error) {
+	err = db.Db.Order("id asc").Find(Webhook).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get Webhook by ID
+func GetWebhookByID(Webhook *Webhook, id uint) (err error) {
+	err = db.Db.First(Webhook, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create Webhook, generating its secret if none is given
+func CreateWebhook(Webhook *Webhook) (err error) {
+	if Webhook.Secret == "" {
+		if Webhook.Secret, err = newWebhookSecret(); err != nil {
+			return err
+		}
+	}
+	err = db.Db.Create(Webhook).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Update Webhook
+func UpdateWebhook(Webhook *Webhook) (err error) {
+	if Webhook.Secret == "" {
+		if Webhook.Secret, err = newWebhookSecret(); err != nil {
+			return err
+		}
+	}
+	err = db.Db.Save(Webhook).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete Webhook, queued requests to it are dropped when they come up
+func DeleteWebhook(Webhook *Webhook) (err error) {
+	err = db.Db.Delete(Webhook).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the active webhooks subscribed to an event
+func GetWebhooksForEvent(event string) ([]Webhook, error) {
+	var webhooks []Webhook
+	if err := db.Db.Where("active = ?", true).Order("id asc").Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(webhooks, func(webhook Webhook) bool {
+		return !slices.Contains(webhook.Events, event)
+	}), nil
+}
+
+// Create Webhook Delivery
+func CreateWebhookDelivery(WebhookDelivery *WebhookDelivery) (err error) {
+	err = db.Db.Create(WebhookDelivery).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the delivery log of a webhook, newest first
+func GetWebhookDeliveries(WebhookDeliveries *[]WebhookDelivery, webhookID uint, limit int) (err error) {
+	query := db.Db.Where("webhook_id = ?", webhookID).Order("id desc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err = query.Find(WebhookDeliveries).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get an entry of a webhook's delivery log by ID
+func GetWebhookDeliveryByID(WebhookDelivery *WebhookDelivery, webhookID uint, id uint) (err error) {
+	err = db.Db.Where("webhook_id = ?", webhookID).First(WebhookDelivery, id).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Queue the request of a logged delivery again, with the same body and event ID
+func ReplayWebhookDelivery(WebhookDelivery *WebhookDelivery) (*OutboxMessage, error) {
+	webhookID := WebhookDelivery.WebhookID
+	message := OutboxMessage{
+		Topic:    OutboxWebhook,
+		ParentID: WebhookDelivery.EventID,
+		Payload:  OutboxPayload{WebhookID: &webhookID, EventType: WebhookDelivery.Event, Body: WebhookDelivery.RequestBody},
+	}
+	if err := EnqueueOutbox(db.Db, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Queue a ping to a webhook
+func QueueWebhookPing(webhook *Webhook, body string) (*OutboxMessage, error) {
+	webhookID := uint(webhook.ID)
+	message := OutboxMessage{
+		Topic:   OutboxWebhook,
+		Payload: OutboxPayload{WebhookID: &webhookID, EventType: WebhookPing, Body: body},
+	}
+	if err := EnqueueOutbox(db.Db, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
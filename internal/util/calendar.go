@@ -0,0 +1,186 @@
+package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Length of a delivery in calendars, deliveries only have a start time
+const calendarEventDuration = time.Hour
+
+// How often calendar apps should fetch the feed again
+const calendarRefreshInterval = "PT1H"
+
+const icsTimeFormat = "20060102T150405Z"
+
+// Link to a user's calendar feed, to subscribe to in a calendar app
+func CalendarFeedURL(feed *models.CalendarFeed) string {
+	baseUrl := strings.TrimRight(os.Getenv("BASE_URL"), "/")
+	return baseUrl + "/api/calendar/" + url.PathEscape(feed.Token) + ".ics"
+}
+
+// Domain of event UIDs, the host of BASE_URL, so UIDs stay the same across fetches
+func calendarUIDDomain() string {
+	if u, err := url.Parse(os.Getenv("BASE_URL")); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "lindaben"
+}
+
+// Escape a TEXT value
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// Write a content line, folded at 75 octets without splitting UTF-8 characters
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// Latest change to a delivery or its orders, order status changes leave the
+// delivery's own timestamp alone
+func deliveryModifiedAt(delivery *models.Delivery) time.Time {
+	modified := delivery.UpdatedAt
+	for _, order := range delivery.Orders {
+		if order.UpdatedAt.After(modified) {
+			modified = order.UpdatedAt
+		}
+	}
+	return modified
+}
+
+// Summary of the orders a recipient is concerned with, one per line
+func calendarOrderSummary(orders []models.Order) string {
+	var lines []string
+	for _, order := range orders {
+		line := fmt.Sprintf("%d × %s", order.Quantity, order.Item)
+		var details []string
+		if order.Vendor != nil {
+			details = append(details, order.Vendor.Name)
+		}
+		if order.Status != "" {
+			details = append(details, models.NormalizeOrderStatus(order.Status))
+		}
+		if len(details) > 0 {
+			line += " (" + strings.Join(details, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func writeCalendarEvent(b *strings.Builder, user models.User, delivery *models.Delivery, now time.Time) {
+	school := "school not set"
+	var address string
+	if delivery.School != nil {
+		school = delivery.School.Name
+		address = delivery.School.Address
+	}
+	summary := "Delivery to " + school
+	if delivery.PackageType != "" {
+		summary += " (" + delivery.PackageType + ")"
+	}
+
+	var description []string
+	if delivery.PackageType != "" {
+		description = append(description, "Package: "+delivery.PackageType)
+	}
+	description = append(description, "Status: "+delivery.Status)
+	if orders := calendarOrderSummary(recipientOrders(user, delivery)); orders != "" {
+		description = append(description, "Orders:\n"+orders)
+	}
+	if delivery.Notes != "" {
+		description = append(description, "Notes: "+delivery.Notes)
+	}
+
+	status := "CONFIRMED"
+	switch delivery.Status {
+	case models.DeliveryStatusCancelled:
+		status = "CANCELLED"
+	case models.DeliveryStatusDraft:
+		status = "TENTATIVE"
+	}
+	modified := deliveryModifiedAt(delivery).UTC()
+
+	writeICSLine(b, "BEGIN:VEVENT")
+	writeICSLine(b, "UID:"+calendarEventUID(delivery.ID))
+	writeICSLine(b, "DTSTAMP:"+now.UTC().Format(icsTimeFormat))
+	writeICSLine(b, "LAST-MODIFIED:"+modified.Format(icsTimeFormat))
+	writeICSLine(b, "SEQUENCE:"+strconv.FormatInt(max(modified.Unix(), 0), 10))
+	writeICSLine(b, "DTSTART:"+delivery.ScheduledAt.UTC().Format(icsTimeFormat))
+	writeICSLine(b, "DTEND:"+delivery.ScheduledAt.Add(calendarEventDuration).UTC().Format(icsTimeFormat))
+	writeICSLine(b, "SUMMARY:"+icsText(summary))
+	if address != "" {
+		writeICSLine(b, "LOCATION:"+icsText(address))
+	}
+	writeICSLine(b, "DESCRIPTION:"+icsText(strings.Join(description, "\n")))
+	writeICSLine(b, "STATUS:"+status)
+	writeICSLine(b, "END:VEVENT")
+}
+
+// UID of a delivery's event, the same for as long as the delivery exists and after it is deleted
+func calendarEventUID(deliveryID int) string {
+	return "delivery-" + strconv.Itoa(deliveryID) + "@" + calendarUIDDomain()
+}
+
+// Write a deleted delivery as a cancelled event, with a SEQUENCE past every
+// version of the delivery so calendar apps take the cancellation
+func writeDeletedCalendarEvent(b *strings.Builder, delivery *models.DeletedDelivery, now time.Time) {
+	deleted := delivery.DeletedAt.UTC()
+
+	writeICSLine(b, "BEGIN:VEVENT")
+	writeICSLine(b, "UID:"+calendarEventUID(delivery.ID))
+	writeICSLine(b, "DTSTAMP:"+now.UTC().Format(icsTimeFormat))
+	writeICSLine(b, "LAST-MODIFIED:"+deleted.Format(icsTimeFormat))
+	writeICSLine(b, "SEQUENCE:"+strconv.FormatInt(max(deleted.Unix(), 0), 10))
+	writeICSLine(b, "DTSTART:"+delivery.ScheduledAt.UTC().Format(icsTimeFormat))
+	writeICSLine(b, "DTEND:"+delivery.ScheduledAt.Add(calendarEventDuration).UTC().Format(icsTimeFormat))
+	writeICSLine(b, "SUMMARY:"+icsText("Deleted delivery"))
+	writeICSLine(b, "DESCRIPTION:"+icsText("This delivery was deleted."))
+	writeICSLine(b, "STATUS:CANCELLED")
+	writeICSLine(b, "END:VEVENT")
+}
+
+// Render the iCalendar feed of a user's deliveries. Every delivery keeps the
+// same UID, and its SEQUENCE grows with each change, so calendar apps update
+// the event in place; cancelled and deleted deliveries stay in the feed as
+// STATUS:CANCELLED.
+func RenderCalendar(user models.User, deliveries []models.Delivery, deleted []models.DeletedDelivery, now time.Time) string {
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//LindaBen//Deliveries//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME:LindaBen deliveries")
+	writeICSLine(&b, "REFRESH-INTERVAL;VALUE=DURATION:"+calendarRefreshInterval)
+	writeICSLine(&b, "X-PUBLISHED-TTL:"+calendarRefreshInterval)
+	for i := range deliveries {
+		if deliveries[i].ScheduledAt == nil {
+			continue
+		}
+		writeCalendarEvent(&b, user, &deliveries[i], now)
+	}
+	for i := range deleted {
+		writeDeletedCalendarEvent(&b, &deleted[i], now)
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.String()
+}
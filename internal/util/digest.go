@@ -0,0 +1,257 @@
+package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	_ "time/tzdata" // digest timezones are looked up by name on hosts without zoneinfo
+)
+
+// Digest event type, for the notification log
+const EventDigest = "digest"
+
+var digestWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// DigestSchedule is the local time digests go out at, weekly digests on one day of the week
+type DigestSchedule struct {
+	Location *time.Location
+	Hour     int
+	Minute   int
+	Weekday  time.Weekday
+}
+
+// Read the schedule from DIGEST_TIME (HH:MM), DIGEST_TIMEZONE (e.g. America/Toronto)
+// and DIGEST_WEEKDAY (mon ... sun), defaulting to 07:00 on Mondays in the server's timezone
+func DigestScheduleFromEnv() DigestSchedule {
+	schedule := DigestSchedule{Location: time.Local, Hour: 7, Weekday: time.Monday}
+	if name := os.Getenv("DIGEST_TIMEZONE"); name != "" {
+		if location, err := time.LoadLocation(name); err == nil {
+			schedule.Location = location
+		} else {
+			log.Printf("Invalid DIGEST_TIMEZONE %q, using %s: %v", name, schedule.Location, err)
+		}
+	}
+	if value := os.Getenv("DIGEST_TIME"); value != "" {
+		if t, err := time.Parse("15:04", value); err == nil {
+			schedule.Hour, schedule.Minute = t.Hour(), t.Minute()
+		} else {
+			log.Printf("Invalid DIGEST_TIME %q, using %02d:%02d", value, schedule.Hour, schedule.Minute)
+		}
+	}
+	if value := os.Getenv("DIGEST_WEEKDAY"); value != "" {
+		if weekday, ok := digestWeekdays[strings.ToLower(value)]; ok {
+			schedule.Weekday = weekday
+		} else {
+			log.Printf("Invalid DIGEST_WEEKDAY %q, using %s", value, schedule.Weekday)
+		}
+	}
+	return schedule
+}
+
+// The last time a digest of a frequency was due, at or before now
+func (schedule DigestSchedule) LastDue(frequency string, now time.Time) time.Time {
+	local := now.In(schedule.Location)
+	due := time.Date(local.Year(), local.Month(), local.Day(), schedule.Hour, schedule.Minute, 0, 0, schedule.Location)
+	if due.After(local) {
+		due = due.AddDate(0, 0, -1)
+	}
+	if frequency == models.DigestWeekly {
+		due = due.AddDate(0, 0, -((int(due.Weekday()) - int(schedule.Weekday) + 7) % 7))
+	}
+	return due
+}
+
+// The due time before a due time
+func (schedule DigestSchedule) previousDue(frequency string, due time.Time) time.Time {
+	if frequency == models.DigestWeekly {
+		return due.AddDate(0, 0, -7)
+	}
+	return due.AddDate(0, 0, -1)
+}
+
+// Link that turns the digest off without signing in
+func DigestUnsubscribeURL(subscription *models.DigestSubscription) string {
+	baseUrl := strings.TrimRight(os.Getenv("BASE_URL"), "/")
+	return baseUrl + "/api/digests/unsubscribe?token=" + url.QueryEscape(subscription.Token)
+}
+
+// A delivery in the digest with the orders the recipient is concerned with
+type digestDelivery struct {
+	Delivery models.Delivery
+	Orders   []models.Order
+}
+
+type digestMessageData struct {
+	Recipient      models.User
+	Frequency      string
+	Digest         models.Digest
+	Upcoming       []digestDelivery
+	UnsubscribeURL string
+}
+
+var digestSubjectTemplate = template.Must(template.New("digest.subject").Funcs(templateFuncs).Parse(
+	`Your {{.Frequency}} delivery digest: {{len .Upcoming}} upcoming, {{len .Digest.AwaitingConfirmation}} awaiting confirmation`))
+
+var digestEmailTemplate = template.Must(template.New("digest.email").Funcs(templateFuncs).Parse(`Hello {{.Recipient.Name}},
+
+Here is your {{.Frequency}} digest of deliveries.
+
+Upcoming deliveries, next 7 days:
+{{- range .Upcoming}}
+- #{{.Delivery.ID}} on {{date .Delivery.ScheduledAt}}{{with .Delivery.School}} to {{.Name}}{{end}}, {{.Delivery.Status}}
+{{- range .Orders}}
+    {{.Quantity}} x {{.Item}}{{with .Vendor}} from {{.Name}}{{end}} ({{.Status}})
+{{- end}}
+{{- else}}
+None.
+{{- end}}
+{{if or .Digest.DeliveryChanges .Digest.OrderChanges}}
+Changes since {{date .Digest.Since}}:
+{{- range .Digest.DeliveryChanges}}
+- Delivery #{{.DeliveryID}} {{.FieldName}}: {{orEmpty .OldValue}} -> {{orEmpty .NewValue}}, by {{.ChangedByUser.Name}}
+{{- end}}
+{{- range .Digest.OrderChanges}}
+- Order #{{.OrderID}} {{.FieldName}}: {{orEmpty .OldValue}} -> {{orEmpty .NewValue}}, by {{.ChangedByUser.Name}}
+{{- end}}
+{{end}}
+{{- if .Digest.AwaitingConfirmation}}
+Orders awaiting vendor confirmation:
+{{- range .Digest.AwaitingConfirmation}}
+- Order #{{.ID}}, {{.Quantity}} x {{.Item}}{{with .Vendor}} from {{.Name}}{{end}}, for delivery #{{.DeliveryID}} on {{date .Delivery.ScheduledAt}}
+{{- end}}
+{{end}}
+{{- if .Digest.ProposedChanges}}
+Vendor change proposals awaiting review:
+{{- range .Digest.ProposedChanges}}
+- Order #{{.ID}}, {{.Quantity}} x {{.Item}}{{with .Vendor}} from {{.Name}}{{end}}, for delivery #{{.DeliveryID}}
+{{- end}}
+{{end}}
+To stop receiving this digest, open {{.UnsubscribeURL}}
+`))
+
+// Render the digest email of a subscription, dates in the schedule's timezone
+func RenderDigest(subscription *models.DigestSubscription, digest models.Digest, schedule DigestSchedule) (subject string, body string, err error) {
+	data := digestMessageData{
+		Recipient:      *subscription.User,
+		Frequency:      subscription.Frequency,
+		Digest:         digest,
+		UnsubscribeURL: DigestUnsubscribeURL(subscription),
+	}
+	for _, delivery := range digest.Upcoming {
+		data.Upcoming = append(data.Upcoming, digestDelivery{Delivery: delivery, Orders: recipientOrders(*subscription.User, &delivery)})
+	}
+
+	funcs := template.FuncMap{"date": func(t any) string {
+		switch t := t.(type) {
+		case *time.Time:
+			if t == nil {
+				return "not scheduled yet"
+			}
+			return t.In(schedule.Location).Format("Mon Jan 2, 2006 at 3:04 PM")
+		case time.Time:
+			return t.In(schedule.Location).Format("Mon Jan 2, 2006 at 3:04 PM")
+		}
+		return fmt.Sprint(t)
+	}}
+
+	var b strings.Builder
+	if err = template.Must(digestSubjectTemplate.Clone()).Funcs(funcs).Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	subject = b.String()
+	b.Reset()
+	err = template.Must(digestEmailTemplate.Clone()).Funcs(funcs).Execute(&b, data)
+	return subject, b.String(), err
+}
+
+// Compile the digest of a subscription as it would go out now, covering the
+// time since the last digest or since the previous due time if none was sent
+func PreviewDigest(subscription *models.DigestSubscription, schedule DigestSchedule, now time.Time) (models.Digest, error) {
+	preferences, err := models.GetNotificationPreferences(subscription.UserID)
+	if err != nil {
+		return models.Digest{}, err
+	}
+	since := schedule.previousDue(subscription.Frequency, schedule.LastDue(subscription.Frequency, now))
+	if subscription.LastSentAt != nil {
+		since = *subscription.LastSentAt
+	}
+	return models.BuildDigest(subscription.User, preferences, since, now)
+}
+
+// Queue the digests due at now by email, returning how many were queued.
+// Subscribers get their first digest at the first due time after they subscribed,
+// and empty digests are not sent. A subscriber whose digest fails is logged and
+// skipped, so it is tried again next time without holding up the others.
+func (notifier *Notifier) SendDueDigests(schedule DigestSchedule, now time.Time) (int, error) {
+	channels, err := notifier.selectChannels([]string{ChannelEmail})
+	if err != nil {
+		return 0, err
+	}
+	email := channels[0]
+
+	subscriptions, err := models.GetDigestSubscriptions()
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		last := subscription.CreatedAt
+		if subscription.LastSentAt != nil {
+			last = *subscription.LastSentAt
+		}
+		if !last.Before(schedule.LastDue(subscription.Frequency, now)) {
+			continue
+		}
+
+		sent, err := queueDigest(email, subscription, schedule, now)
+		if err != nil {
+			log.Printf("Failed to queue the digest of user %d: %v", subscription.UserID, err)
+			continue
+		}
+		if sent {
+			queued++
+		}
+	}
+	return queued, nil
+}
+
+// Queue the digest of one subscription, reporting whether it had anything to send
+func queueDigest(email Channel, subscription *models.DigestSubscription, schedule DigestSchedule, now time.Time) (bool, error) {
+	digest, err := PreviewDigest(subscription, schedule, now)
+	if err != nil {
+		return false, err
+	}
+	var message *models.OutboxMessage
+	if !digest.IsEmpty() {
+		subject, body, err := RenderDigest(subscription, digest, schedule)
+		if err != nil {
+			return false, err
+		}
+		userID := subscription.UserID
+		message = &models.OutboxMessage{
+			Topic: models.OutboxNotification,
+			Payload: models.OutboxPayload{
+				EventType: EventDigest,
+				UserID:    &userID,
+				Channel:   email.Name(),
+				Address:   email.Address(*subscription.User),
+				Subject:   subject,
+				Body:      body,
+			},
+		}
+	}
+	if err := models.QueueDigest(subscription, message, now); err != nil {
+		return false, err
+	}
+	return message != nil, nil
+}
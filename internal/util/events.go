@@ -0,0 +1,269 @@
+package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Events pushed to live streams, named like their outbox topics
+var StreamEventTypes = []string{
+	models.OutboxDeliveryCreated, models.OutboxDeliveryUpdated, models.OutboxDeliveryDeleted,
+	models.OutboxOrderStatusChanged, models.OutboxOrderUpdated, models.OutboxOrderAdded, models.OutboxOrderRemoved, models.OutboxOrderDeleted,
+}
+
+// Events buffered for Last-Event-ID resume, without EVENTS_BUFFER_SIZE
+const defaultEventBufferSize = 1000
+
+// Events waiting to be written to one stream before it is dropped as too slow
+const streamBacklog = 64
+
+// Interval of the comments keeping idle streams open through proxies,
+// EVENTS_HEARTBEAT or 25s
+func EventsHeartbeat() time.Duration {
+	return envDuration("EVENTS_HEARTBEAT", 25*time.Second)
+}
+
+// StreamEvent is a change pushed to live streams
+type StreamEvent struct {
+	ID      uint64          // position in the stream, the SSE id
+	EventID uint            // outbox event the change came from
+	Type    string          // the SSE event name
+	Data    json.RawMessage // the SSE data
+
+	// Who may see the event besides admins
+	SchoolIDs []int
+	VendorIDs []int
+}
+
+// StreamEventData is what a change is about, clients fetch what they need
+type StreamEventData struct {
+	DeliveryID  *int                  `json:"deliveryId,omitempty"`
+	OrderID     *int                  `json:"orderId,omitempty"`
+	Changes     []models.OutboxChange `json:"changes,omitempty"`
+	ChangedByID *uint                 `json:"changedById,omitempty"`
+}
+
+// EventBroker fans changes out to live streams and keeps the latest ones in a
+// ring buffer, so that a reconnecting stream can resume where it left off
+type EventBroker struct {
+	mu            sync.Mutex
+	size          int
+	ring          []StreamEvent
+	seq           uint64
+	published     map[uint]bool // outbox events in the ring, retried events are published once
+	subscriptions map[*EventSubscription]bool
+}
+
+// EventSubscription receives the events a user may see until it is closed.
+// Events is closed when the broker drops a subscriber that falls behind.
+type EventSubscription struct {
+	Events  <-chan StreamEvent
+	events  chan StreamEvent
+	visible func(event *StreamEvent) bool
+	broker  *EventBroker
+}
+
+func NewEventBroker(size int) *EventBroker {
+	return &EventBroker{
+		size:          max(size, 1),
+		published:     map[uint]bool{},
+		subscriptions: map[*EventSubscription]bool{},
+	}
+}
+
+var (
+	defaultEventBroker     *EventBroker
+	defaultEventBrokerOnce sync.Once
+)
+
+// The broker of this server, buffering EVENTS_BUFFER_SIZE events
+func DefaultEventBroker() *EventBroker {
+	defaultEventBrokerOnce.Do(func() {
+		defaultEventBroker = NewEventBroker(envInt("EVENTS_BUFFER_SIZE", defaultEventBufferSize))
+	})
+	return defaultEventBroker
+}
+
+// Can a user see an event: admins see everything, school admins their schools'
+// deliveries and vendor admins their vendors' orders
+func streamEventVisible(user *models.User) func(event *StreamEvent) bool {
+	var admin bool
+	var schoolIDs, vendorIDs []int
+	for _, role := range models.ParseRoles(user.Roles) {
+		switch {
+		case role.Role == "admin":
+			admin = true
+		case role.Role == "school_admin" && role.EntityID != nil:
+			schoolIDs = append(schoolIDs, int(*role.EntityID))
+		case role.Role == "vendor_admin" && role.EntityID != nil:
+			vendorIDs = append(vendorIDs, int(*role.EntityID))
+		}
+	}
+	return func(event *StreamEvent) bool {
+		if admin {
+			return true
+		}
+		return slices.ContainsFunc(event.SchoolIDs, func(id int) bool { return slices.Contains(schoolIDs, id) }) ||
+			slices.ContainsFunc(event.VendorIDs, func(id int) bool { return slices.Contains(vendorIDs, id) })
+	}
+}
+
+// Add an event to the ring and send it to the subscribers who may see it.
+// An outbox event already in the ring is not published again.
+func (broker *EventBroker) Publish(event StreamEvent) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if event.EventID != 0 {
+		if broker.published[event.EventID] {
+			return
+		}
+		broker.published[event.EventID] = true
+	}
+	broker.seq++
+	event.ID = broker.seq
+	broker.ring = append(broker.ring, event)
+	if len(broker.ring) > broker.size {
+		delete(broker.published, broker.ring[0].EventID)
+		broker.ring = slices.Delete(broker.ring, 0, 1)
+	}
+
+	for subscription := range broker.subscriptions {
+		if !subscription.visible(&event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			// Too far behind, the client reconnects and resumes from the ring
+			broker.drop(subscription)
+		}
+	}
+}
+
+// Subscribe a user to the events they may see. With the ID of the last event the
+// client received, the events since then are returned to be sent first; reset is
+// true when they are no longer buffered, e.g. after a restart, and the client
+// should reload instead.
+func (broker *EventBroker) Subscribe(user *models.User, lastEventID *uint64) (subscription *EventSubscription, missed []StreamEvent, reset bool) {
+	events := make(chan StreamEvent, streamBacklog)
+	subscription = &EventSubscription{Events: events, events: events, visible: streamEventVisible(user), broker: broker}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.subscriptions[subscription] = true
+
+	if lastEventID == nil || *lastEventID == broker.seq {
+		return subscription, nil, false
+	}
+	oldest := broker.seq + 1
+	if len(broker.ring) > 0 {
+		oldest = broker.ring[0].ID
+	}
+	if *lastEventID > broker.seq || *lastEventID+1 < oldest {
+		return subscription, nil, true
+	}
+	for _, event := range broker.ring {
+		if event.ID > *lastEventID && subscription.visible(&event) {
+			missed = append(missed, event)
+		}
+	}
+	return subscription, missed, false
+}
+
+// Stop receiving events
+func (subscription *EventSubscription) Close() {
+	subscription.broker.mu.Lock()
+	defer subscription.broker.mu.Unlock()
+	subscription.broker.drop(subscription)
+}
+
+func (broker *EventBroker) drop(subscription *EventSubscription) {
+	if broker.subscriptions[subscription] {
+		delete(broker.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+// The ID of the latest event
+func (broker *EventBroker) LastEventID() uint64 {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.seq
+}
+
+// Publish an outbox event to live streams, scoped to the school of its delivery,
+// including one it moved away from, and to the vendors of the orders it is about
+func (broker *EventBroker) publishEvent(event *models.OutboxMessage) ([]models.OutboxMessage, error) {
+	var schoolIDs, vendorIDs []int
+	if event.Payload.SchoolID != nil {
+		schoolIDs = append(schoolIDs, *event.Payload.SchoolID)
+	}
+	if id := previousSchoolID(event.Payload.Changes); id != nil {
+		schoolIDs = append(schoolIDs, *id)
+	}
+	vendorIDs = append(vendorIDs, event.Payload.VendorIDs...)
+
+	if event.DeliveryID != nil {
+		var delivery models.Delivery
+		err := models.GetDeliveryForNotification(&delivery, *event.DeliveryID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if delivery.SchoolID != nil {
+			schoolIDs = append(schoolIDs, *delivery.SchoolID)
+		}
+		if event.OrderID == nil {
+			for _, order := range delivery.Orders {
+				if order.VendorID != nil {
+					vendorIDs = append(vendorIDs, *order.VendorID)
+				}
+			}
+		}
+	}
+	if event.OrderID != nil {
+		var order models.Order
+		err := models.GetOrderByID(&order, *event.OrderID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if order.VendorID != nil {
+			vendorIDs = append(vendorIDs, *order.VendorID)
+		}
+	}
+
+	data, err := json.Marshal(StreamEventData{
+		DeliveryID:  event.DeliveryID,
+		OrderID:     event.OrderID,
+		Changes:     event.Payload.Changes,
+		ChangedByID: event.Payload.ChangedByID,
+	})
+	if err != nil {
+		return nil, permanent(err)
+	}
+	slices.Sort(schoolIDs)
+	slices.Sort(vendorIDs)
+	broker.Publish(StreamEvent{
+		EventID:   uint(event.ID),
+		Type:      event.Topic,
+		Data:      data,
+		SchoolIDs: slices.Compact(schoolIDs),
+		VendorIDs: slices.Compact(vendorIDs),
+	})
+	return nil, nil
+}
+
+// Outbox handlers that push changes to live streams
+func (broker *EventBroker) OutboxHandlers() map[string]OutboxHandler {
+	handlers := map[string]OutboxHandler{}
+	for _, eventType := range StreamEventTypes {
+		handlers[eventType] = broker.publishEvent
+	}
+	return handlers
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -81,9 +82,16 @@ func ValidateRoleJWT(context *gin.Context, allowedRoles ...string) error {
 	rolesArray := models.ParseRoles(roles)
 	fmt.Println("User roles from token:", rolesArray)
 
+	// A bare role allows it for any entity, "role:id" only for that entity
 	for _, allowedRole := range allowedRoles {
-		if strings.Contains(roles, allowedRole) {
-			return nil
+		for _, role := range rolesArray {
+			name, id, scoped := strings.Cut(allowedRole, ":")
+			if role.Role != name {
+				continue
+			}
+			if !scoped || (role.EntityID != nil && strconv.FormatUint(uint64(*role.EntityID), 10) == id) {
+				return nil
+			}
 		}
 	}
 
@@ -1 +1,750 @@
 package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Notification channels
+const (
+	ChannelEmail = models.NotificationChannelEmail
+	ChannelSMS   = models.NotificationChannelSMS
+	ChannelInApp = models.NotificationChannelInApp
+)
+
+var (
+	ErrNoNotificationChannels = errors.New("no notification channels configured")
+	ErrUnknownChannel         = errors.New("unknown notification channel")
+	ErrInvalidEmailAddress    = errors.New("invalid email address")
+)
+
+// Message is a rendered notification to a single address
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+
+	// What the message is about, for channels that keep it
+	UserID     *uint
+	EventType  string
+	DeliveryID *int
+	OrderID    *int
+}
+
+// Channel delivers messages to one kind of address
+type Channel interface {
+	Name() string
+	// Address of the user on this channel, empty when the user cannot be reached
+	Address(user models.User) string
+	Send(message Message) error
+}
+
+// SMTPConfig is the mail server email notifications are sent through
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string // no authentication when empty
+	Password string
+	From     string
+}
+
+// Read the mail server from SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM
+func SMTPConfigFromEnv() SMTPConfig {
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		port = 25
+	}
+	return SMTPConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+// EmailChannel sends plain text email over SMTP, using STARTTLS when the server offers it
+type EmailChannel struct {
+	Config SMTPConfig
+}
+
+func (channel EmailChannel) Name() string { return ChannelEmail }
+
+func (channel EmailChannel) Address(user models.User) string { return strings.TrimSpace(user.Email) }
+
+func (channel EmailChannel) Send(message Message) error {
+	var auth smtp.Auth
+	if channel.Config.Username != "" {
+		auth = smtp.PlainAuth("", channel.Config.Username, channel.Config.Password, channel.Config.Host)
+	}
+	data, err := formatEmail(channel.Config.From, message)
+	if err != nil {
+		// The address does not change on retry
+		return permanent(err)
+	}
+	addr := net.JoinHostPort(channel.Config.Host, strconv.Itoa(channel.Config.Port))
+	return smtp.SendMail(addr, auth, channel.Config.From, []string{message.To}, data)
+}
+
+// Line breaks would end a header early and start another one
+var headerLineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// Build an RFC 5322 message with CRLF line endings. The recipient must be a bare
+// address, so that it cannot add headers or recipients.
+func formatEmail(from string, message Message) ([]byte, error) {
+	address, err := mail.ParseAddress(message.To)
+	if err != nil || address.Name != "" || address.Address != message.To {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidEmailAddress, message.To)
+	}
+
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + message.To + "\r\n")
+	b.WriteString("Subject: " + headerLineBreaks.Replace(message.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	body := strings.ReplaceAll(message.Body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
+
+// SMSProvider sends a text message through an SMS gateway
+type SMSProvider interface {
+	SendSMS(to string, body string) error
+}
+
+// SMSChannel sends text messages through a provider
+type SMSChannel struct {
+	Provider SMSProvider
+}
+
+func (channel SMSChannel) Name() string { return ChannelSMS }
+
+func (channel SMSChannel) Address(user models.User) string { return strings.TrimSpace(user.Phone) }
+
+func (channel SMSChannel) Send(message Message) error {
+	return channel.Provider.SendSMS(message.To, message.Body)
+}
+
+// HTTPSMSProvider posts {"from", "to", "body"} as JSON to a gateway, with the token as a bearer token
+type HTTPSMSProvider struct {
+	URL    string
+	Token  string
+	From   string
+	Client *http.Client
+}
+
+func (provider HTTPSMSProvider) SendSMS(to string, body string) error {
+	payload, err := json.Marshal(map[string]string{"from": provider.From, "to": to, "body": body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, provider.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if provider.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+provider.Token)
+	}
+
+	client := provider.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("sms provider returned %s", res.Status)
+	}
+	return nil
+}
+
+// InAppChannel puts messages in the recipient's in-app inbox
+type InAppChannel struct{}
+
+func (channel InAppChannel) Name() string { return ChannelInApp }
+
+func (channel InAppChannel) Address(user models.User) string { return strconv.Itoa(user.ID) }
+
+func (channel InAppChannel) Send(message Message) error {
+	if message.UserID == nil {
+		return permanent(errors.New("in-app notification without a user"))
+	}
+	return models.CreateNotification(&models.Notification{
+		UserID:     *message.UserID,
+		EventType:  message.EventType,
+		Title:      message.Subject,
+		Body:       message.Body,
+		DeliveryID: message.DeliveryID,
+		OrderID:    message.OrderID,
+	})
+}
+
+// Notifier renders notifications and sends them over its channels
+type Notifier struct {
+	Channels []Channel
+}
+
+// Build a notifier from the environment: the in-app inbox always, email when
+// SMTP_HOST is set and sms when SMS_PROVIDER_URL is set
+func NewNotifierFromEnv() *Notifier {
+	notifier := &Notifier{Channels: []Channel{InAppChannel{}}}
+	if config := SMTPConfigFromEnv(); config.Host != "" {
+		notifier.Channels = append(notifier.Channels, EmailChannel{Config: config})
+	}
+	if url := os.Getenv("SMS_PROVIDER_URL"); url != "" {
+		notifier.Channels = append(notifier.Channels, SMSChannel{Provider: HTTPSMSProvider{
+			URL:   url,
+			Token: os.Getenv("SMS_PROVIDER_TOKEN"),
+			From:  os.Getenv("SMS_FROM"),
+		}})
+	}
+	return notifier
+}
+
+var (
+	defaultNotifier     *Notifier
+	defaultNotifierOnce sync.Once
+)
+
+// The notifier configured from the environment, built on first use
+func DefaultNotifier() *Notifier {
+	defaultNotifierOnce.Do(func() {
+		defaultNotifier = NewNotifierFromEnv()
+	})
+	return defaultNotifier
+}
+
+// Channels limited to the given names, all channels when none are given
+func (notifier *Notifier) selectChannels(names []string) ([]Channel, error) {
+	if len(notifier.Channels) == 0 {
+		return nil, ErrNoNotificationChannels
+	}
+	if len(names) == 0 {
+		return notifier.Channels, nil
+	}
+	var channels []Channel
+	for _, name := range names {
+		index := slices.IndexFunc(notifier.Channels, func(channel Channel) bool { return channel.Name() == name })
+		if index < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownChannel, name)
+		}
+		channels = append(channels, notifier.Channels[index])
+	}
+	return channels, nil
+}
+
+// Check that the named channels are configured, all channels when none are given
+func (notifier *Notifier) CheckChannels(names []string) error {
+	_, err := notifier.selectChannels(names)
+	return err
+}
+
+// DeliveryMessageData is what delivery message templates are rendered from
+type DeliveryMessageData struct {
+	Recipient models.User
+	Delivery  models.Delivery
+	School    *models.School
+	Orders    []models.Order // the orders the recipient is concerned with
+	Order     *models.Order  // the order an order event is about
+	Changes   []models.OutboxChange
+	Note      string
+}
+
+// InventoryMessageData is what inventory alert templates are rendered with
+type InventoryMessageData struct {
+	Recipient models.User
+	Item      models.Item
+	Changes   []models.OutboxChange
+}
+
+var templateFuncs = template.FuncMap{
+	"date": func(t *time.Time) string {
+		if t == nil {
+			return "not scheduled yet"
+		}
+		return t.In(time.Local).Format("Mon Jan 2, 2006 at 3:04 PM")
+	},
+	"orEmpty": func(s string) string {
+		if s == "" {
+			return "(none)"
+		}
+		return s
+	},
+}
+
+// Subject, email body and sms body of a kind of message
+type messageTemplates struct {
+	subject *template.Template
+	email   *template.Template
+	sms     *template.Template
+}
+
+func newMessageTemplates(name, subject, email, sms string) messageTemplates {
+	return messageTemplates{
+		subject: template.Must(template.New(name + ".subject").Funcs(templateFuncs).Parse(subject)),
+		email:   template.Must(template.New(name + ".email").Funcs(templateFuncs).Parse(email)),
+		sms:     template.Must(template.New(name + ".sms").Funcs(templateFuncs).Parse(sms)),
+	}
+}
+
+// Delivery details shared by the email templates
+const deliveryDetailsTemplate = `Scheduled: {{date .Delivery.ScheduledAt}}
+Status: {{.Delivery.Status}}
+{{- with .Delivery.PackageType}}
+Package: {{.}}{{end}}
+{{- with .School}}
+School: {{.Name}}
+{{- with .Address}}
+Address: {{.}}{{end}}
+{{- with .DockInstructions}}
+Dock instructions: {{.}}{{end}}
+{{- end}}
+{{if .Orders}}
+Orders:
+{{- range .Orders}}
+- {{.Quantity}} x {{.Item}}{{with .Vendor}} from {{.Name}}{{end}} ({{.Status}})
+{{- end}}
+{{end}}`
+
+// Message templates by outbox topic
+var topicMessageTemplates = map[string]messageTemplates{
+	models.OutboxDeliveryNotify: newMessageTemplates("delivery.notify",
+		`Delivery #{{.Delivery.ID}}{{with .School}} to {{.Name}}{{end}} on {{date .Delivery.ScheduledAt}}`,
+		`Hello {{.Recipient.Name}},
+
+This is a notice about delivery #{{.Delivery.ID}}.
+
+`+deliveryDetailsTemplate+`
+{{- with .Note}}
+{{.}}
+{{end}}
+{{- with .Delivery.Notes}}
+Notes: {{.}}
+{{end}}`,
+		`Delivery #{{.Delivery.ID}}{{with .School}} to {{.Name}}{{end}}: {{date .Delivery.ScheduledAt}}, {{len .Orders}} order(s).{{with .Note}} {{.}}{{end}}`),
+
+	models.OutboxDeliveryUpdated: newMessageTemplates("delivery.updated",
+		`Delivery #{{.Delivery.ID}}{{with .School}} to {{.Name}}{{end}} was updated`,
+		`Hello {{.Recipient.Name}},
+
+Delivery #{{.Delivery.ID}} was updated:
+{{range .Changes}}
+- {{.Field}}: {{orEmpty .OldValue}} -> {{orEmpty .NewValue}}
+{{- end}}
+
+`+deliveryDetailsTemplate,
+		`Delivery #{{.Delivery.ID}}{{with .School}} to {{.Name}}{{end}} on {{date .Delivery.ScheduledAt}} was updated:{{range $i, $c := .Changes}}{{if $i}},{{end}} {{$c.Field}}{{end}}.`),
+
+	models.OutboxOrderStatusChanged: newMessageTemplates("order.status_changed",
+		`Order #{{.Order.ID}} for delivery #{{.Delivery.ID}} is {{.Order.Status}}`,
+		`Hello {{.Recipient.Name}},
+
+Order #{{.Order.ID}}, {{.Order.Quantity}} x {{.Order.Item}}{{with .Order.Vendor}} from {{.Name}}{{end}}, is now {{.Order.Status}}.
+{{- range .Changes}}{{if eq .Field "reason"}}
+Reason: {{.NewValue}}{{end}}{{end}}
+
+`+deliveryDetailsTemplate,
+		`Order #{{.Order.ID}} ({{.Order.Item}}) for delivery #{{.Delivery.ID}} is now {{.Order.Status}}.`),
+
+	models.OutboxOrderUpdated: newMessageTemplates("order.updated",
+		`Order #{{.Order.ID}}{{with .Delivery.ID}} for delivery #{{.}}{{end}} was updated`,
+		`Hello {{.Recipient.Name}},
+
+Order #{{.Order.ID}}, {{.Order.Quantity}} x {{.Order.Item}}{{with .Order.Vendor}} from {{.Name}}{{end}}, was updated:
+{{range .Changes}}
+- {{.Field}}: {{orEmpty .OldValue}} -> {{orEmpty .NewValue}}
+{{- end}}
+
+`+deliveryDetailsTemplate,
+		`Order #{{.Order.ID}} ({{.Order.Item}}) was updated:{{range $i, $c := .Changes}}{{if $i}},{{end}} {{$c.Field}}{{end}}.`),
+
+	models.OutboxOrderAdded: newMessageTemplates("order.added",
+		`Order #{{.Order.ID}} was added to delivery #{{.Delivery.ID}}`,
+		`Hello {{.Recipient.Name}},
+
+Order #{{.Order.ID}}, {{.Order.Quantity}} x {{.Order.Item}}{{with .Order.Vendor}} from {{.Name}}{{end}}, was added to delivery #{{.Delivery.ID}}.
+
+`+deliveryDetailsTemplate,
+		`Order #{{.Order.ID}} ({{.Order.Item}}) was added to delivery #{{.Delivery.ID}} on {{date .Delivery.ScheduledAt}}.`),
+
+	models.OutboxOrderRemoved: newMessageTemplates("order.removed",
+		`Order #{{.Order.ID}} was removed from delivery #{{.Delivery.ID}}`,
+		`Hello {{.Recipient.Name}},
+
+Order #{{.Order.ID}}, {{.Order.Quantity}} x {{.Order.Item}}{{with .Order.Vendor}} from {{.Name}}{{end}}, was removed from delivery #{{.Delivery.ID}}.
+
+`+deliveryDetailsTemplate,
+		`Order #{{.Order.ID}} ({{.Order.Item}}) was removed from delivery #{{.Delivery.ID}} on {{date .Delivery.ScheduledAt}}.`),
+
+	models.OutboxOrderEscalated: newMessageTemplates("order.escalated",
+		`Order #{{.Order.ID}}{{with .Order.Vendor}} from {{.Name}}{{end}} is not confirmed yet`,
+		`Hello {{.Recipient.Name}},
+
+Order #{{.Order.ID}}, {{.Order.Quantity}} x {{.Order.Item}}{{with .Order.Vendor}} from {{.Name}}{{end}}, is still pending within the vendor's lead time. Please follow up with the vendor or move the order to another one.
+
+`+deliveryDetailsTemplate,
+		`Order #{{.Order.ID}} ({{.Order.Item}}){{with .Order.Vendor}} from {{.Name}}{{end}} for delivery #{{.Delivery.ID}} on {{date .Delivery.ScheduledAt}} is not confirmed yet.`),
+
+	models.OutboxLowStock: newMessageTemplates("inventory.low_stock",
+		`Low stock: {{.Item.Name}}`,
+		`Hello {{.Recipient.Name}},
+
+Available warehouse stock of {{.Item.Name}} fell below its reorder level of {{.Item.ReorderLevel}}{{with .Item.Unit}} {{.}}{{end}}:
+{{range .Changes}}
+- {{.Field}}: {{.OldValue}} -> {{.NewValue}}
+{{- end}}
+
+Please restock it.
+`,
+		`Low stock: {{.Item.Name}} is below its reorder level of {{.Item.ReorderLevel}}{{range .Changes}}, {{.NewValue}} {{.Field}}{{end}}.`),
+
+	reminderTemplateKey(models.ReminderAudienceSchool): newMessageTemplates("delivery.reminder.school",
+		`Reminder: delivery{{with .School}} to {{.Name}}{{end}} on {{date .Delivery.ScheduledAt}}`,
+		`Hello {{.Recipient.Name}},
+
+This is a reminder that delivery #{{.Delivery.ID}} is coming up. Please make sure someone is there to receive it.
+
+`+deliveryDetailsTemplate+`
+{{- with .Delivery.Notes}}
+Notes: {{.}}
+{{end}}`,
+		`Reminder: delivery #{{.Delivery.ID}}{{with .School}} to {{.Name}}{{end}} on {{date .Delivery.ScheduledAt}}, {{len .Orders}} order(s).`),
+
+	reminderTemplateKey(models.ReminderAudienceVendor): newMessageTemplates("delivery.reminder.vendor",
+		`Reminder: your order(s) for delivery #{{.Delivery.ID}} on {{date .Delivery.ScheduledAt}}`,
+		`Hello {{.Recipient.Name}},
+
+This is a reminder that your order(s) for delivery #{{.Delivery.ID}} are due. Please make sure they are ready in time.
+
+`+deliveryDetailsTemplate,
+		`Reminder: {{len .Orders}} order(s) for delivery #{{.Delivery.ID}}{{with .School}} to {{.Name}}{{end}} due {{date .Delivery.ScheduledAt}}.`),
+}
+
+// Render the message of a topic for a channel
+func renderMessage(topic string, channel string, data any) (subject string, body string, err error) {
+	templates, ok := topicMessageTemplates[topic]
+	if !ok {
+		return "", "", fmt.Errorf("no message templates for %q", topic)
+	}
+	var b strings.Builder
+	if channel == ChannelSMS {
+		err = templates.sms.Execute(&b, data)
+		return "", b.String(), err
+	}
+	if err = templates.subject.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	subject = b.String()
+	b.Reset()
+	// The inbox shows the short text under the subject
+	if channel == ChannelInApp {
+		err = templates.sms.Execute(&b, data)
+	} else {
+		err = templates.email.Execute(&b, data)
+	}
+	return subject, b.String(), err
+}
+
+// The orders a recipient is concerned with. Vendor admins who are not also
+// admins of the school only see their vendors' orders.
+func recipientOrders(user models.User, delivery *models.Delivery) []models.Order {
+	vendorIDs := map[int]bool{}
+	for _, role := range models.ParseRoles(user.Roles) {
+		switch {
+		case role.Role == "admin":
+			return delivery.Orders
+		case role.Role == "school_admin" && role.EntityID != nil && delivery.SchoolID != nil && int(*role.EntityID) == *delivery.SchoolID:
+			return delivery.Orders
+		case role.Role == "vendor_admin" && role.EntityID != nil:
+			vendorIDs[int(*role.EntityID)] = true
+		}
+	}
+	var orders []models.Order
+	for _, order := range delivery.Orders {
+		if order.VendorID != nil && vendorIDs[*order.VendorID] {
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
+
+// Expand a delivery event into one notification per recipient and channel,
+// rendered now so that retries send the same message. Change events go to the
+// recipients in scope on the channels they chose, skipping whoever made the
+// change; admins see every change in their inbox. Admin events only go to
+// admins, on the channels they chose. Only alert events go out by email and sms. A notification an admin asked for goes to every recipient of
+// the delivery on the requested channels.
+func (notifier *Notifier) expandDeliveryEvent(event *models.OutboxMessage) ([]models.OutboxMessage, error) {
+	if event.DeliveryID == nil {
+		return nil, nil
+	}
+	requested := event.Topic == models.OutboxDeliveryNotify
+	channels, err := notifier.selectChannels(event.Payload.Channels)
+	if errors.Is(err, ErrNoNotificationChannels) && !requested {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	var delivery models.Delivery
+	if err := models.GetDeliveryForNotification(&delivery, *event.DeliveryID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// The order may no longer be on the delivery when it was removed
+	var order *models.Order
+	if event.OrderID != nil {
+		order = &models.Order{}
+		if err := models.GetOrderForNotification(order, *event.OrderID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	var recipients []models.User
+	inAppOnly := map[int]bool{}
+	if requested {
+		recipients, err = models.GetDeliveryRecipients(&delivery)
+	} else if models.IsAdminEvent(event.Topic) {
+		var admins *[]models.User
+		admins, err = models.GetUsersByRole("admin")
+		if admins != nil {
+			recipients = *admins
+		}
+	} else {
+		recipients, err = models.GetDeliveryEventRecipients(&delivery, order, previousSchoolID(event.Payload.Changes))
+		if err == nil {
+			var admins *[]models.User
+			admins, err = models.GetUsersByRole("admin")
+			if admins != nil {
+				for _, admin := range *admins {
+					if !slices.ContainsFunc(recipients, func(user models.User) bool { return user.ID == admin.ID }) {
+						recipients = append(recipients, admin)
+						inAppOnly[admin.ID] = true
+					}
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	alert := requested || models.IsAlertEvent(event.Topic, event.Payload.Changes)
+
+	var notifications []models.OutboxMessage
+	for _, user := range recipients {
+		if !requested && event.Payload.ChangedByID != nil && uint(user.ID) == *event.Payload.ChangedByID {
+			continue
+		}
+		var preferences models.NotificationPreferences
+		if !requested {
+			if preferences, err = models.GetNotificationPreferences(uint(user.ID)); err != nil {
+				return nil, err
+			}
+		}
+
+		data := DeliveryMessageData{
+			Recipient: user,
+			Delivery:  delivery,
+			School:    delivery.School,
+			Orders:    recipientOrders(user, &delivery),
+			Order:     order,
+			Changes:   event.Payload.Changes,
+			Note:      event.Payload.Note,
+		}
+		for _, channel := range channels {
+			if channel.Name() != ChannelInApp && (!alert || inAppOnly[user.ID]) {
+				continue
+			}
+			if !requested && !preferences.Enabled(event.Topic, channel.Name()) {
+				continue
+			}
+			subject, body, err := renderMessage(event.Topic, channel.Name(), data)
+			if err != nil {
+				return nil, permanent(err)
+			}
+			userID := uint(user.ID)
+			notifications = append(notifications, models.OutboxMessage{
+				Topic:      models.OutboxNotification,
+				DeliveryID: event.DeliveryID,
+				OrderID:    event.OrderID,
+				Payload: models.OutboxPayload{
+					EventType: event.Topic,
+					UserID:    &userID,
+					Channel:   channel.Name(),
+					Address:   channel.Address(user),
+					Subject:   subject,
+					Body:      body,
+					SentByID:  event.Payload.SentByID,
+				},
+			})
+		}
+	}
+	return notifications, nil
+}
+
+// Expand an inventory alert into one notification per admin and channel they
+// chose, like an admin event about a delivery
+func (notifier *Notifier) expandInventoryEvent(event *models.OutboxMessage) ([]models.OutboxMessage, error) {
+	if event.Payload.ItemID == nil {
+		return nil, nil
+	}
+	channels, err := notifier.selectChannels(event.Payload.Channels)
+	if errors.Is(err, ErrNoNotificationChannels) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	var item models.Item
+	if err := models.GetItemByID(&item, uint(*event.Payload.ItemID)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	admins, err := models.GetUsersByRole("admin")
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []models.OutboxMessage
+	for _, user := range *admins {
+		preferences, err := models.GetNotificationPreferences(uint(user.ID))
+		if err != nil {
+			return nil, err
+		}
+		data := InventoryMessageData{Recipient: user, Item: item, Changes: event.Payload.Changes}
+		for _, channel := range channels {
+			if !preferences.Enabled(event.Topic, channel.Name()) {
+				continue
+			}
+			subject, body, err := renderMessage(event.Topic, channel.Name(), data)
+			if err != nil {
+				return nil, permanent(err)
+			}
+			userID := uint(user.ID)
+			notifications = append(notifications, models.OutboxMessage{
+				Topic: models.OutboxNotification,
+				Payload: models.OutboxPayload{
+					EventType: event.Topic,
+					UserID:    &userID,
+					Channel:   channel.Name(),
+					Address:   channel.Address(user),
+					Subject:   subject,
+					Body:      body,
+				},
+			})
+		}
+	}
+	return notifications, nil
+}
+
+// The school a delivery moved away from, if the changes include one
+func previousSchoolID(changes []models.OutboxChange) *int {
+	for _, change := range changes {
+		if change.Field != "schoolId" {
+			continue
+		}
+		if id, err := strconv.Atoi(change.OldValue); err == nil {
+			return &id
+		}
+	}
+	return nil
+}
+
+// Send a rendered notification and record the attempt. Recipients without an
+// address for the channel are recorded as skipped.
+func (notifier *Notifier) sendNotification(message *models.OutboxMessage) ([]models.OutboxMessage, error) {
+	payload := message.Payload
+	channels, err := notifier.selectChannels([]string{payload.Channel})
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	entry := models.NotificationLog{
+		DeliveryID: message.DeliveryID,
+		UserID:     payload.UserID,
+		Channel:    payload.Channel,
+		Address:    payload.Address,
+		Subject:    payload.Subject,
+		Body:       payload.Body,
+		SentByID:   payload.SentByID,
+	}
+	var sendErr error
+	if payload.Address == "" {
+		entry.Status = models.NotificationSkipped
+		entry.Error = "no " + payload.Channel + " address"
+	} else {
+		sendErr = channels[0].Send(Message{
+			To:         payload.Address,
+			Subject:    payload.Subject,
+			Body:       payload.Body,
+			UserID:     payload.UserID,
+			EventType:  payload.EventType,
+			DeliveryID: message.DeliveryID,
+			OrderID:    message.OrderID,
+		})
+		if sendErr != nil {
+			entry.Status = models.NotificationFailed
+			entry.Error = sendErr.Error()
+		} else {
+			entry.Status = models.NotificationSent
+		}
+	}
+
+	// Once sent, a retry would send the message again, so a failed log write only loses the entry
+	if err := models.CreateNotificationLog(&entry); err != nil {
+		log.Printf("Failed to log %s notification to user %v: %v", entry.Channel, entry.UserID, err)
+		if entry.Status == models.NotificationSkipped {
+			return nil, err
+		}
+	}
+	return nil, sendErr
+}
+
+// Outbox handlers that notify the recipients of deliveries
+func (notifier *Notifier) OutboxHandlers() map[string]OutboxHandler {
+	return map[string]OutboxHandler{
+		models.OutboxDeliveryNotify:     notifier.expandDeliveryEvent,
+		models.OutboxDeliveryUpdated:    notifier.expandDeliveryEvent,
+		models.OutboxOrderStatusChanged: notifier.expandDeliveryEvent,
+		models.OutboxOrderUpdated:       notifier.expandDeliveryEvent,
+		models.OutboxOrderAdded:         notifier.expandDeliveryEvent,
+		models.OutboxOrderRemoved:       notifier.expandDeliveryEvent,
+		models.OutboxOrderEscalated:     notifier.expandDeliveryEvent,
+		models.OutboxLowStock:           notifier.expandInventoryEvent,
+		models.OutboxNotification:       notifier.sendNotification,
+	}
+}
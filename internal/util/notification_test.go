@@ -0,0 +1,360 @@
+package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/db"
+	"LindaBen_Phase_1_Project/internal/models"
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpStub is an SMTP server on a local port that accepts every message
+type smtpStub struct {
+	listener net.Listener
+	host     string
+	port     int
+
+	mu       sync.Mutex
+	messages []smtpStubMessage
+}
+
+type smtpStubMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	stub := &smtpStub{listener: listener, host: host}
+	stub.port, _ = strconv.Atoi(port)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (stub *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 stub ESMTP")
+
+	var message smtpStubMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			text.PrintfLine("250 stub")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message = smtpStubMessage{From: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			text.PrintfLine("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			message.To = append(message.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			text.PrintfLine("250 OK")
+		case command == "DATA":
+			text.PrintfLine("354 go ahead")
+			lines, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			message.Data = strings.Join(lines, "\r\n")
+			stub.mu.Lock()
+			stub.messages = append(stub.messages, message)
+			stub.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case command == "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (stub *smtpStub) Messages() []smtpStubMessage {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	return append([]smtpStubMessage(nil), stub.messages...)
+}
+
+func (stub *smtpStub) Channel() EmailChannel {
+	return EmailChannel{Config: SMTPConfig{Host: stub.host, Port: stub.port, From: "noreply@example.com"}}
+}
+
+// Split a message into its headers and body
+func parseEmail(t *testing.T, data string) (textproto.MIMEHeader, string) {
+	t.Helper()
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(data + "\r\n")))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("invalid headers: %v\n%s", err, data)
+	}
+	_, body, _ := strings.Cut(data, "\r\n\r\n")
+	return header, body
+}
+
+func TestEmailChannelSend(t *testing.T) {
+	stub := newSMTPStub(t)
+
+	err := stub.Channel().Send(Message{
+		To:      "school@example.com",
+		Subject: "Delivery #1 to Elm",
+		Body:    "Hello,\nline two\r\nline three",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := stub.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	message := messages[0]
+	if message.From != "noreply@example.com" {
+		t.Errorf("MAIL FROM = %q", message.From)
+	}
+	if len(message.To) != 1 || message.To[0] != "school@example.com" {
+		t.Errorf("RCPT TO = %q", message.To)
+	}
+	header, body := parseEmail(t, message.Data)
+	if got := header.Get("To"); got != "school@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	if got := header.Get("Subject"); got != "Delivery #1 to Elm" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := header.Get("Content-Type"); got != "text/plain; charset=UTF-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if body != "Hello,\r\nline two\r\nline three" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestEmailChannelSendRejectsInvalidRecipient(t *testing.T) {
+	stub := newSMTPStub(t)
+
+	err := stub.Channel().Send(Message{To: "school@example.com\r\nBcc: someone@example.com", Subject: "Hi"})
+	if !errors.Is(err, ErrInvalidEmailAddress) || !errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("err = %v, want a permanent invalid address error", err)
+	}
+	if messages := stub.Messages(); len(messages) != 0 {
+		t.Fatalf("sent %d messages to an invalid address", len(messages))
+	}
+}
+
+func TestFormatEmailSubjectLineBreaks(t *testing.T) {
+	for _, subject := range []string{
+		"Delivery\r\nBcc: someone@example.com",
+		"Delivery\rBcc: someone@example.com",
+		"Delivery\nBcc: someone@example.com",
+	} {
+		data, err := formatEmail("noreply@example.com", Message{To: "school@example.com", Subject: subject})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _ := parseEmail(t, string(data))
+		if got := header.Get("Bcc"); got != "" {
+			t.Errorf("subject %q added a Bcc header %q", subject, got)
+		}
+		if got := header.Get("Subject"); got != "Delivery Bcc: someone@example.com" {
+			t.Errorf("subject %q became %q", subject, got)
+		}
+	}
+}
+
+func TestFormatEmailValidatesRecipient(t *testing.T) {
+	for _, to := range []string{
+		"",
+		"not an address",
+		"school@example.com\r\nBcc: someone@example.com",
+		"school@example.com\nBcc: someone@example.com",
+		"school@example.com, someone@example.com",
+		"Elm School <school@example.com>",
+	} {
+		if _, err := formatEmail("noreply@example.com", Message{To: to}); !errors.Is(err, ErrInvalidEmailAddress) {
+			t.Errorf("formatEmail accepted recipient %q, err = %v", to, err)
+		}
+	}
+}
+
+// Open a fresh in-memory database with the tables notifications use
+func setupNotificationDB(t *testing.T) {
+	t.Helper()
+	db.InitDb(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+	err := db.Db.AutoMigrate(&models.User{}, &models.File{}, &models.School{}, &models.Vendor{}, &models.Item{},
+		&models.Delivery{}, &models.Order{}, &models.DeliveryChangeLog{}, &models.OrderChangeLog{},
+		&models.ItemMapping{}, &models.VendorPrice{}, &models.InventoryTransaction{}, &models.InventoryReservation{},
+		&models.PackageType{}, &models.PackageVersion{}, &models.NotificationLog{}, &models.OutboxMessage{},
+		&models.NotificationPreference{}, &models.Notification{}, &models.DeliveryReminder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.Db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+}
+
+func TestSendNotificationLogsEachRecipient(t *testing.T) {
+	setupNotificationDB(t)
+	stub := newSMTPStub(t)
+	notifier := &Notifier{Channels: []Channel{stub.Channel()}}
+
+	school := models.School{Name: "Elm"}
+	vendor := models.Vendor{Name: "Farm"}
+	db.Db.Create(&school)
+	db.Db.Create(&vendor)
+	schoolAdmin := models.User{Name: "Sam", Email: "sam@example.com", Roles: fmt.Sprintf("school_admin:%d", school.ID)}
+	vendorAdmin := models.User{Name: "Val", Email: "", Roles: fmt.Sprintf("vendor_admin:%d", vendor.ID)}
+	db.Db.Create(&schoolAdmin)
+	db.Db.Create(&vendorAdmin)
+
+	scheduledAt := time.Now().Add(48 * time.Hour)
+	delivery := models.Delivery{SchoolID: &school.ID, ScheduledAt: &scheduledAt, Orders: []models.Order{
+		{Item: "apples", Quantity: 3, VendorID: &vendor.ID, Status: models.OrderStatusPending},
+	}}
+	if err := models.CreateDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	event := models.OutboxMessage{Topic: models.OutboxDeliveryNotify, DeliveryID: &delivery.ID}
+	notifications, err := notifier.expandDeliveryEvent(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 2 {
+		t.Fatalf("expanded into %d notifications, want one per recipient", len(notifications))
+	}
+	for i := range notifications {
+		if _, err := notifier.sendNotification(&notifications[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var logs []models.NotificationLog
+	if err := db.Db.Order("id").Find(&logs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("got %d notification logs, want 2", len(logs))
+	}
+	byUser := map[uint]models.NotificationLog{}
+	for _, entry := range logs {
+		if entry.UserID == nil {
+			t.Fatalf("log %d has no user", entry.ID)
+		}
+		if entry.DeliveryID == nil || *entry.DeliveryID != delivery.ID {
+			t.Errorf("log %d has delivery %v, want %d", entry.ID, entry.DeliveryID, delivery.ID)
+		}
+		if entry.Channel != ChannelEmail {
+			t.Errorf("log %d has channel %q", entry.ID, entry.Channel)
+		}
+		byUser[*entry.UserID] = entry
+	}
+
+	sent := byUser[uint(schoolAdmin.ID)]
+	if sent.Status != models.NotificationSent || sent.Address != "sam@example.com" || sent.Error != "" {
+		t.Errorf("school admin log = %+v, want sent to sam@example.com", sent)
+	}
+	if !strings.Contains(sent.Subject, "Elm") || sent.Body == "" {
+		t.Errorf("school admin log has subject %q and body %q", sent.Subject, sent.Body)
+	}
+	skipped := byUser[uint(vendorAdmin.ID)]
+	if skipped.Status != models.NotificationSkipped || skipped.Error != "no email address" {
+		t.Errorf("vendor admin log = %+v, want skipped without an address", skipped)
+	}
+
+	messages := stub.Messages()
+	if len(messages) != 1 || messages[0].To[0] != "sam@example.com" {
+		t.Fatalf("sent %+v, want one email to sam@example.com", messages)
+	}
+}
+
+func TestSendNotificationLogsFailure(t *testing.T) {
+	setupNotificationDB(t)
+	stub := newSMTPStub(t)
+	notifier := &Notifier{Channels: []Channel{stub.Channel()}}
+
+	userID := uint(7)
+	message := models.OutboxMessage{
+		Topic: models.OutboxNotification,
+		Payload: models.OutboxPayload{
+			EventType: models.OutboxDeliveryUpdated,
+			UserID:    &userID,
+			Channel:   ChannelEmail,
+			Address:   "sam@example.com\r\nBcc: someone@example.com",
+			Subject:   "Delivery updated",
+			Body:      "Hello",
+		},
+	}
+	_, err := notifier.sendNotification(&message)
+	if !errors.Is(err, ErrPermanentFailure) {
+		t.Fatalf("err = %v, want a permanent failure", err)
+	}
+
+	var logs []models.NotificationLog
+	if err := db.Db.Find(&logs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("got %d notification logs, want 1", len(logs))
+	}
+	if entry := logs[0]; entry.Status != models.NotificationFailed || entry.UserID == nil || *entry.UserID != userID ||
+		!strings.Contains(entry.Error, ErrInvalidEmailAddress.Error()) {
+		t.Errorf("log = %+v, want a failure for user %d", entry, userID)
+	}
+	if messages := stub.Messages(); len(messages) != 0 {
+		t.Fatalf("sent %d messages to an invalid address", len(messages))
+	}
+}
+
+func TestSendNotificationDoesNotResendWhenLogFails(t *testing.T) {
+	setupNotificationDB(t)
+	stub := newSMTPStub(t)
+	notifier := &Notifier{Channels: []Channel{stub.Channel()}}
+	if err := db.Db.Migrator().DropTable(&models.NotificationLog{}); err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uint(7)
+	message := models.OutboxMessage{
+		Topic: models.OutboxNotification,
+		Payload: models.OutboxPayload{
+			EventType: models.OutboxDeliveryUpdated,
+			UserID:    &userID,
+			Channel:   ChannelEmail,
+			Address:   "sam@example.com",
+			Subject:   "Delivery updated",
+			Body:      "Hello",
+		},
+	}
+	if _, err := notifier.sendNotification(&message); err != nil {
+		t.Fatalf("err = %v, want nil so the outbox does not send the message again", err)
+	}
+	if messages := stub.Messages(); len(messages) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(messages))
+	}
+}
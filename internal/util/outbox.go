@@ -0,0 +1,186 @@
+package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrPermanentFailure marks errors retrying cannot fix, the message is dead-lettered at once
+var ErrPermanentFailure = errors.New("permanent failure")
+
+func permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanentFailure, err)
+}
+
+// OutboxHandler carries out an outbox message. The messages it returns are
+// enqueued in the same transaction that marks it done.
+type OutboxHandler func(message *models.OutboxMessage) ([]models.OutboxMessage, error)
+
+// OutboxWorker delivers outbox messages with a pool of workers, retrying
+// failures with exponential backoff until they are dead-lettered
+type OutboxWorker struct {
+	Workers      int
+	PollInterval time.Duration
+	MaxAttempts  int
+	RetryBase    time.Duration // delay after the first failure, doubled on every further one
+	RetryMax     time.Duration
+	Handlers     map[string]OutboxHandler
+}
+
+// Build a worker from OUTBOX_WORKERS, OUTBOX_POLL_INTERVAL, OUTBOX_MAX_ATTEMPTS,
+// OUTBOX_RETRY_BASE and OUTBOX_RETRY_MAX, handling the topics of all handler sets
+func NewOutboxWorkerFromEnv(handlers ...map[string]OutboxHandler) *OutboxWorker {
+	return &OutboxWorker{
+		Workers:      envInt("OUTBOX_WORKERS", 4),
+		PollInterval: envDuration("OUTBOX_POLL_INTERVAL", 5*time.Second),
+		MaxAttempts:  envInt("OUTBOX_MAX_ATTEMPTS", 8),
+		RetryBase:    envDuration("OUTBOX_RETRY_BASE", 30*time.Second),
+		RetryMax:     envDuration("OUTBOX_RETRY_MAX", 6*time.Hour),
+		Handlers:     MergeOutboxHandlers(handlers...),
+	}
+}
+
+// Combine handler sets. A topic handled by several sets runs each handler and
+// enqueues all their messages, so an event can fan out to notifications and
+// webhooks at once; if any handler fails the whole event is retried.
+func MergeOutboxHandlers(sets ...map[string]OutboxHandler) map[string]OutboxHandler {
+	byTopic := map[string][]OutboxHandler{}
+	for _, set := range sets {
+		for topic, handler := range set {
+			byTopic[topic] = append(byTopic[topic], handler)
+		}
+	}
+
+	merged := make(map[string]OutboxHandler, len(byTopic))
+	for topic, handlers := range byTopic {
+		if len(handlers) == 1 {
+			merged[topic] = handlers[0]
+			continue
+		}
+		merged[topic] = func(message *models.OutboxMessage) ([]models.OutboxMessage, error) {
+			var followUps []models.OutboxMessage
+			for _, handler := range handlers {
+				messages, err := handler(message)
+				if err != nil {
+					return nil, err
+				}
+				followUps = append(followUps, messages...)
+			}
+			return followUps, nil
+		}
+	}
+	return merged
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Delay before the next attempt after a number of failed attempts, with up to
+// 10% jitter so that messages failing together do not retry together
+func (worker *OutboxWorker) RetryDelay(attempts int) time.Duration {
+	delay := worker.RetryBase
+	for i := 1; i < attempts && delay < worker.RetryMax; i++ {
+		delay *= 2
+	}
+	delay = min(delay, worker.RetryMax)
+	return delay + time.Duration(rand.Int64N(int64(delay)/10+1))
+}
+
+// Deliver messages until the context is done
+func (worker *OutboxWorker) Run(ctx context.Context) {
+	if released, err := models.ReleaseClaimedOutboxMessages(); err != nil {
+		log.Println("Failed to release claimed outbox messages:", err)
+	} else if released > 0 {
+		log.Printf("Released %d outbox messages claimed before a restart", released)
+	}
+
+	jobs := make(chan models.OutboxMessage)
+	var wg sync.WaitGroup
+	for range max(worker.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range jobs {
+				worker.Process(&message)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	batch := max(worker.Workers, 1) * 4
+	for {
+		messages, err := models.ClaimOutboxMessages(batch, time.Now())
+		if err != nil {
+			log.Println("Failed to claim outbox messages:", err)
+		}
+		for _, message := range messages {
+			select {
+			case jobs <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+		// Keep going while there is a backlog
+		if len(messages) == batch {
+			continue
+		}
+		select {
+		case <-time.After(worker.PollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Carry out one claimed message and record the outcome
+func (worker *OutboxWorker) Process(message *models.OutboxMessage) {
+	handler, ok := worker.Handlers[message.Topic]
+	var followUps []models.OutboxMessage
+	var err error
+	if !ok {
+		err = permanent(fmt.Errorf("no handler for topic %q", message.Topic))
+	} else {
+		followUps, err = handler(message)
+	}
+
+	if err == nil {
+		if err = models.CompleteOutboxMessage(message, followUps); err == nil {
+			return
+		}
+		log.Printf("Failed to complete outbox message %d: %v", message.ID, err)
+	}
+
+	var retryAt *time.Time
+	if !errors.Is(err, ErrPermanentFailure) && message.Attempts+1 < worker.MaxAttempts {
+		next := time.Now().Add(worker.RetryDelay(message.Attempts + 1))
+		retryAt = &next
+	}
+	if retryAt == nil {
+		log.Printf("Outbox message %d (%s) dead-lettered after %d attempts: %v", message.ID, message.Topic, message.Attempts+1, err)
+	}
+	if err := models.FailOutboxMessage(message, err, retryAt); err != nil {
+		log.Printf("Failed to record outbox message %d failure: %v", message.ID, err)
+	}
+}
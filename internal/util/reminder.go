@@ -0,0 +1,188 @@
+package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Reminders sent per round
+const reminderBatch = 100
+
+// Reminder templates are kept with the other delivery messages under the event and audience
+func reminderTemplateKey(audience string) string {
+	return models.ReminderEvent + "." + audience
+}
+
+// ReminderTimeline is when the reminders of a delivery go out and to whom
+type ReminderTimeline struct {
+	DeliveryID  int                       `json:"deliveryId"`
+	ScheduledAt *time.Time                `json:"scheduledAt"`
+	Active      bool                      `json:"active"`           // false when the delivery gets no reminders
+	Reason      string                    `json:"reason,omitempty"` // why it gets none
+	Reminders   []ReminderTimelineEntry   `json:"reminders"`
+	History     []models.DeliveryReminder `json:"history"` // every reminder stored for the delivery
+}
+
+// ReminderTimelineEntry is one configured offset of the timeline
+type ReminderTimelineEntry struct {
+	Offset     string                      `json:"offset"`
+	DueAt      *time.Time                  `json:"dueAt"`
+	Status     string                      `json:"status"` // pending, sent, skipped (already past when the delivery was scheduled), none (no reminders)
+	Recipients []ReminderTimelineRecipient `json:"recipients"`
+}
+
+// ReminderTimelineRecipient is a user an entry would go to and the messages they would get
+type ReminderTimelineRecipient struct {
+	UserID   int      `json:"userId"`
+	Name     string   `json:"name"`
+	Audience string   `json:"audience"` // school, vendor
+	Orders   int      `json:"orders"`   // orders the reminder lists
+	Channels []string `json:"channels"` // after the user's preferences
+	Subject  string   `json:"subject"`
+}
+
+// Why a delivery gets no reminders, empty when it does
+func reminderInactiveReason(delivery *models.Delivery) string {
+	switch {
+	case delivery.ScheduledAt == nil:
+		return "not scheduled"
+	case delivery.Contract == models.ContractHold:
+		return "on hold"
+	case delivery.Status == models.DeliveryStatusCancelled:
+		return "cancelled"
+	}
+	return ""
+}
+
+// Render the reminders of a delivery for its recipients on the configured
+// channels they want. The delivery needs its School and Orders.Vendor loaded.
+func (notifier *Notifier) reminderNotifications(delivery *models.Delivery) ([]models.OutboxMessage, []ReminderTimelineRecipient, error) {
+	recipients, err := models.GetReminderRecipients(delivery)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var notifications []models.OutboxMessage
+	var timeline []ReminderTimelineRecipient
+	for _, recipient := range recipients {
+		preferences, err := models.GetNotificationPreferences(uint(recipient.User.ID))
+		if err != nil {
+			return nil, nil, err
+		}
+		data := DeliveryMessageData{
+			Recipient: recipient.User,
+			Delivery:  *delivery,
+			School:    delivery.School,
+			Orders:    recipient.Orders,
+		}
+		entry := ReminderTimelineRecipient{UserID: recipient.User.ID, Name: recipient.User.Name, Audience: recipient.Audience, Orders: len(recipient.Orders)}
+		for _, channel := range notifier.Channels {
+			if !preferences.Enabled(models.ReminderEvent, channel.Name()) {
+				continue
+			}
+			subject, body, err := renderMessage(reminderTemplateKey(recipient.Audience), channel.Name(), data)
+			if err != nil {
+				return nil, nil, err
+			}
+			if entry.Subject == "" {
+				entry.Subject = subject
+			}
+			entry.Channels = append(entry.Channels, channel.Name())
+
+			userID := uint(recipient.User.ID)
+			deliveryID := delivery.ID
+			notifications = append(notifications, models.OutboxMessage{
+				Topic:      models.OutboxNotification,
+				DeliveryID: &deliveryID,
+				Payload: models.OutboxPayload{
+					EventType: models.ReminderEvent,
+					UserID:    &userID,
+					Channel:   channel.Name(),
+					Address:   channel.Address(recipient.User),
+					Subject:   subject,
+					Body:      body,
+				},
+			})
+		}
+		timeline = append(timeline, entry)
+	}
+	return notifications, timeline, nil
+}
+
+// Queue the reminders due at now, returning how many went out. Reminders of
+// deliveries that were deleted, cancelled, put on hold or moved since they were
+// scheduled are cancelled instead.
+func (notifier *Notifier) SendDueReminders(now time.Time) (int, error) {
+	reminders, err := models.GetDueDeliveryReminders(now, reminderBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for i := range reminders {
+		reminder := &reminders[i]
+		var delivery models.Delivery
+		err := models.GetDeliveryForNotification(&delivery, reminder.DeliveryID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return sent, err
+		}
+		offset, parseErr := time.ParseDuration(reminder.Offset)
+		if err != nil || parseErr != nil || !models.RemindersApply(&delivery) || !delivery.ScheduledAt.Add(-offset).Equal(reminder.DueAt) {
+			if err := models.CloseDeliveryReminder(reminder, models.ReminderCancelled, nil, now); err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		notifications, _, err := notifier.reminderNotifications(&delivery)
+		if err != nil {
+			return sent, fmt.Errorf("reminder %d: %w", reminder.ID, err)
+		}
+		if err := models.CloseDeliveryReminder(reminder, models.ReminderSent, notifications, now); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Work out the reminder timeline of a delivery without sending anything
+func (notifier *Notifier) PreviewReminders(delivery *models.Delivery, now time.Time) (ReminderTimeline, error) {
+	timeline := ReminderTimeline{DeliveryID: delivery.ID, ScheduledAt: delivery.ScheduledAt, Reason: reminderInactiveReason(delivery)}
+	timeline.Active = timeline.Reason == ""
+	if err := models.GetDeliveryReminders(&timeline.History, delivery.ID); err != nil {
+		return timeline, err
+	}
+
+	var recipients []ReminderTimelineRecipient
+	if timeline.Active {
+		var err error
+		if _, recipients, err = notifier.reminderNotifications(delivery); err != nil {
+			return timeline, err
+		}
+	}
+
+	for _, offset := range models.ReminderOffsets() {
+		entry := ReminderTimelineEntry{Offset: models.FormatReminderOffset(offset), Status: "none", Recipients: []ReminderTimelineRecipient{}}
+		if timeline.Active {
+			dueAt := delivery.ScheduledAt.Add(-offset)
+			entry.DueAt = &dueAt
+			entry.Status = "skipped"
+			for _, reminder := range timeline.History {
+				if reminder.Offset == entry.Offset && reminder.DueAt.Equal(dueAt) && reminder.Status != models.ReminderCancelled {
+					entry.Status = reminder.Status
+				}
+			}
+			if entry.Status == "skipped" && dueAt.After(now) {
+				entry.Status = models.ReminderPending
+			}
+			entry.Recipients = recipients
+		}
+		timeline.Reminders = append(timeline.Reminders, entry)
+	}
+	return timeline, nil
+}
@@ -0,0 +1,224 @@
+package util
+
+import (
+	"LindaBen_Phase_1_Project/internal/models"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Response bytes kept in the webhook delivery log
+const webhookResponseLimit = 4096
+
+// WebhookEvent is the body posted to webhooks
+type WebhookEvent struct {
+	ID         *uint            `json:"id"` // outbox event ID, the same on every retry, for deduplication
+	Event      string           `json:"event"`
+	OccurredAt time.Time        `json:"occurredAt"`
+	Data       WebhookEventData `json:"data"`
+}
+
+// WebhookEventData is what an event is about, as it was when the event was processed
+type WebhookEventData struct {
+	DeliveryID  *int                  `json:"deliveryId,omitempty"`
+	OrderID     *int                  `json:"orderId,omitempty"`
+	Delivery    *models.Delivery      `json:"delivery,omitempty"`
+	Order       *models.Order         `json:"order,omitempty"`
+	Changes     []models.OutboxChange `json:"changes,omitempty"`
+	ChangedByID *uint                 `json:"changedById,omitempty"`
+	WebhookID   *uint                 `json:"webhookId,omitempty"` // pings only
+}
+
+// WebhookSender posts events to the webhooks subscribed to them
+type WebhookSender struct {
+	Client *http.Client
+}
+
+// Build a sender whose requests time out after WEBHOOK_TIMEOUT, 10s by default
+func NewWebhookSenderFromEnv() *WebhookSender {
+	return &WebhookSender{Client: &http.Client{Timeout: envDuration("WEBHOOK_TIMEOUT", 10*time.Second)}}
+}
+
+var (
+	defaultWebhookSender     *WebhookSender
+	defaultWebhookSenderOnce sync.Once
+)
+
+// The sender configured from the environment, built on first use
+func DefaultWebhookSender() *WebhookSender {
+	defaultWebhookSenderOnce.Do(func() {
+		defaultWebhookSender = NewWebhookSenderFromEnv()
+	})
+	return defaultWebhookSender
+}
+
+// Signature of a request body sent at a unix timestamp: the hex HMAC-SHA256 of
+// "timestamp.body" keyed with the webhook's secret
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Body of a ping to a webhook
+func WebhookPingBody(webhook *models.Webhook) (string, error) {
+	webhookID := uint(webhook.ID)
+	body, err := json.Marshal(WebhookEvent{Event: models.WebhookPing, OccurredAt: time.Now(), Data: WebhookEventData{WebhookID: &webhookID}})
+	return string(body), err
+}
+
+// Expand an event into a request to each webhook subscribed to it
+func (sender *WebhookSender) expandEvent(event *models.OutboxMessage) ([]models.OutboxMessage, error) {
+	webhooks, err := models.GetWebhooksForEvent(event.Topic)
+	if err != nil || len(webhooks) == 0 {
+		return nil, err
+	}
+
+	eventID := uint(event.ID)
+	payload := WebhookEvent{
+		ID:         &eventID,
+		Event:      event.Topic,
+		OccurredAt: event.CreatedAt,
+		Data: WebhookEventData{
+			DeliveryID:  event.DeliveryID,
+			OrderID:     event.OrderID,
+			Changes:     event.Payload.Changes,
+			ChangedByID: event.Payload.ChangedByID,
+		},
+	}
+	// Deleted deliveries and orders are sent by ID only
+	if event.DeliveryID != nil {
+		var delivery models.Delivery
+		if err := models.GetDeliveryForNotification(&delivery, *event.DeliveryID); err == nil {
+			payload.Data.Delivery = &delivery
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	if event.OrderID != nil {
+		var order models.Order
+		if err := models.GetOrderForNotification(&order, *event.OrderID); err == nil {
+			payload.Data.Order = &order
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	requests := make([]models.OutboxMessage, len(webhooks))
+	for i, webhook := range webhooks {
+		webhookID := uint(webhook.ID)
+		requests[i] = models.OutboxMessage{
+			Topic:      models.OutboxWebhook,
+			DeliveryID: event.DeliveryID,
+			OrderID:    event.OrderID,
+			Payload:    models.OutboxPayload{WebhookID: &webhookID, EventType: event.Topic, Body: string(body)},
+		}
+	}
+	return requests, nil
+}
+
+// Post a request to its webhook and log the attempt. Requests to webhooks that
+// were deleted or deactivated are dropped. Client errors other than 408 and 429
+// are not retried.
+func (sender *WebhookSender) send(message *models.OutboxMessage) ([]models.OutboxMessage, error) {
+	payload := message.Payload
+	if payload.WebhookID == nil {
+		return nil, permanent(errors.New("webhook message without a webhook"))
+	}
+	var webhook models.Webhook
+	if err := models.GetWebhookByID(&webhook, *payload.WebhookID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !webhook.Active && payload.EventType != models.WebhookPing {
+		return nil, nil
+	}
+
+	entry := models.WebhookDelivery{
+		WebhookID:       *payload.WebhookID,
+		OutboxMessageID: uint(message.ID),
+		EventID:         message.ParentID,
+		Event:           payload.EventType,
+		URL:             webhook.URL,
+		Attempt:         message.Attempts + 1,
+		RequestBody:     payload.Body,
+	}
+	sendErr := sender.post(&webhook, message, &entry)
+	if sendErr != nil {
+		entry.Error = sendErr.Error()
+	} else {
+		entry.Success = true
+	}
+	if err := models.CreateWebhookDelivery(&entry); err != nil {
+		return nil, err
+	}
+	return nil, sendErr
+}
+
+func (sender *WebhookSender) post(webhook *models.Webhook, message *models.OutboxMessage, entry *models.WebhookDelivery) error {
+	body := []byte(message.Payload.Body)
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "LindaBen-Webhooks/1.0")
+	request.Header.Set("X-Webhook-Event", message.Payload.EventType)
+	request.Header.Set("X-Webhook-Delivery", strconv.Itoa(message.ID))
+	if message.ParentID != nil {
+		request.Header.Set("X-Webhook-Id", strconv.FormatUint(uint64(*message.ParentID), 10))
+	}
+	request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	request.Header.Set("X-Webhook-Signature", SignWebhook(webhook.Secret, timestamp, body))
+
+	started := time.Now()
+	response, err := sender.Client.Do(request)
+	entry.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, webhookResponseLimit))
+	entry.StatusCode = response.StatusCode
+	entry.ResponseBody = string(responseBody)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook responded %s", response.Status)
+	if response.StatusCode >= 400 && response.StatusCode < 500 &&
+		response.StatusCode != http.StatusRequestTimeout && response.StatusCode != http.StatusTooManyRequests {
+		return permanent(err)
+	}
+	return err
+}
+
+// Outbox handlers that post events to webhooks
+func (sender *WebhookSender) OutboxHandlers() map[string]OutboxHandler {
+	handlers := map[string]OutboxHandler{
+		models.OutboxWebhook: sender.send,
+	}
+	for _, event := range models.WebhookEvents {
+		handlers[event] = sender.expandEvent
+	}
+	return handlers
+}
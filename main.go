@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"os"
+	"time"
 
 	"LindaBen_Phase_1_Project/internal/db"
 	"LindaBen_Phase_1_Project/internal/handlers"
@@ -28,8 +31,9 @@ func main() {
 
 	loadDatabase()
 
-	// Setup Gin router
-	r := gin.Default()
+	// Setup Gin router, logging requests without the tokens in their query
+	r := gin.New()
+	r.Use(util.RequestLogger(), gin.Recovery())
 
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
@@ -64,12 +68,54 @@ func main() {
 	order := r.Group("/api/orders")
 	handlers.RegisterOrderRoutes(order)
 
+	schedules := r.Group("/api/schedules", util.JWTAuth("admin"))
+	handlers.RegisterScheduleRoutes(schedules)
+
+	blackouts := r.Group("/api/blackouts", util.JWTAuth("admin", "school_admin"))
+	handlers.RegisterBlackoutRoutes(blackouts)
+
+	packages := r.Group("/api/packages")
+	handlers.RegisterPackageRoutes(packages)
+
+	items := r.Group("/api/items")
+	handlers.RegisterItemRoutes(items)
+
+	budgets := r.Group("/api/budgets", util.JWTAuth("admin", "school_admin"))
+	handlers.RegisterBudgetRoutes(budgets)
+
+	inventory := r.Group("/api/inventory", util.JWTAuth("admin"))
+	handlers.RegisterInventoryRoutes(inventory)
+
+	outbox := r.Group("/api/outbox", util.JWTAuth("admin"))
+	handlers.RegisterOutboxRoutes(outbox)
+
+	webhooks := r.Group("/api/webhooks", util.JWTAuth("admin"))
+	handlers.RegisterWebhookRoutes(webhooks)
+
+	notifications := r.Group("/api/notifications", util.JWTAuth("admin", "school_admin", "vendor_admin"))
+	handlers.RegisterNotificationRoutes(notifications)
+
+	digests := r.Group("/api/digests")
+	handlers.RegisterDigestRoutes(digests)
+
+	events := r.Group("/api/events")
+	handlers.RegisterEventRoutes(events)
+
+	calendar := r.Group("/api/calendar")
+	handlers.RegisterCalendarRoutes(calendar)
+
 	// Register logs routes
 	deliveries.GET("/:id/logs", handlers.GetDeliveryLogs)
 	order.GET("/:id/logs", handlers.GetOrderLogs)
 
 	r.Static("/api/uploads", os.Getenv("UPLOAD_PATH"))
 
+	go runScheduleGenerator()
+	go runOrderEscalation()
+	go runOutboxWorker()
+	go runDigests()
+	go runDeliveryReminders()
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -118,13 +164,123 @@ func seedData() {
 
 // run migration
 func loadDatabase() {
+	// Delivery status is computed, so existing rows need a backfill when the column is first added
+	backfillDeliveryStatus := db.Db.Migrator().HasTable(&models.Delivery{}) && !db.Db.Migrator().HasColumn(&models.Delivery{}, "Status")
+	// Internal orders confirmed before inventory was tracked need their stock reserved
+	backfillReservations := !db.Db.Migrator().HasTable(&models.InventoryReservation{})
+	// Deliveries scheduled before reminders existed need theirs scheduled
+	backfillReminders := !db.Db.Migrator().HasTable(&models.DeliveryReminder{})
+
 	db.Db.AutoMigrate(&models.User{})
 	db.Db.AutoMigrate(&models.School{})
 	db.Db.AutoMigrate(&models.Vendor{})
+	db.Db.AutoMigrate(&models.Item{})
 	db.Db.AutoMigrate(&models.Delivery{})
 	db.Db.AutoMigrate(&models.Order{})
 	db.Db.AutoMigrate(&models.DeliveryChangeLog{})
 	db.Db.AutoMigrate(&models.OrderChangeLog{})
+	db.Db.AutoMigrate(&models.DeliverySchedule{})
+	db.Db.AutoMigrate(&models.BlackoutDate{})
+	db.Db.AutoMigrate(&models.PackageType{})
+	db.Db.AutoMigrate(&models.PackageVersion{})
+	db.Db.AutoMigrate(&models.ItemMapping{})
+	db.Db.AutoMigrate(&models.VendorPrice{})
+	db.Db.AutoMigrate(&models.Budget{})
+	db.Db.AutoMigrate(&models.PurchaseOrder{})
+	db.Db.AutoMigrate(&models.Invoice{})
+	db.Db.AutoMigrate(&models.InventoryTransaction{})
+	db.Db.AutoMigrate(&models.InventoryReservation{})
+	db.Db.AutoMigrate(&models.NotificationLog{})
+	db.Db.AutoMigrate(&models.OutboxMessage{})
+	db.Db.AutoMigrate(&models.NotificationPreference{})
+	db.Db.AutoMigrate(&models.Notification{})
+	db.Db.AutoMigrate(&models.DigestSubscription{})
+	db.Db.AutoMigrate(&models.DeliveryReminder{})
+	db.Db.AutoMigrate(&models.Webhook{})
+	db.Db.AutoMigrate(&models.WebhookDelivery{})
+	db.Db.AutoMigrate(&models.CalendarFeed{})
+
+	if err := models.NormalizeOrderStatuses(); err != nil {
+		log.Println("Failed to normalize order statuses:", err)
+	}
+
+	if backfillDeliveryStatus {
+		if err := models.RefreshAllDeliveryStatuses(); err != nil {
+			log.Println("Failed to backfill delivery statuses:", err)
+		}
+	}
+
+	if err := models.MigrateInternalVendor(); err != nil {
+		log.Println("Failed to migrate internal orders to the internal vendor:", err)
+	}
+
+	if backfillReservations {
+		if err := models.ReserveConfirmedInternalOrders(); err != nil {
+			log.Println("Failed to reserve stock for internal orders:", err)
+		}
+	}
+
+	if backfillReminders {
+		if err := models.ScheduleAllDeliveryReminders(time.Now()); err != nil {
+			log.Println("Failed to schedule delivery reminders:", err)
+		}
+	}
 
 	seedData()
 }
+
+// materialize upcoming deliveries of recurring schedules once an hour
+func runScheduleGenerator() {
+	for {
+		count, err := models.GenerateAllScheduleDeliveries(time.Now())
+		if err != nil {
+			log.Println("Failed to generate scheduled deliveries:", err)
+		}
+		if count > 0 {
+			log.Printf("Generated %d scheduled deliveries", count)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// escalate orders still unconfirmed within their vendor's lead time once an hour
+func runOrderEscalation() {
+	for {
+		if _, err := models.EscalateUnconfirmedOrders(time.Now()); err != nil {
+			log.Println("Failed to escalate unconfirmed orders:", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// deliver notifications, webhooks and other outbox messages in the background
+func runOutboxWorker() {
+	util.NewOutboxWorkerFromEnv(util.DefaultNotifier().OutboxHandlers(), util.DefaultWebhookSender().OutboxHandlers(), util.DefaultEventBroker().OutboxHandlers()).Run(context.Background())
+}
+
+// queue the daily and weekly digests once they are due, checking every few minutes
+func runDigests() {
+	schedule := util.DigestScheduleFromEnv()
+	for {
+		count, err := util.DefaultNotifier().SendDueDigests(schedule, time.Now())
+		if err != nil && !errors.Is(err, util.ErrNoNotificationChannels) {
+			log.Println("Failed to send digests:", err)
+		} else if count > 0 {
+			log.Printf("Queued %d digests", count)
+		}
+		time.Sleep(5 * time.Minute)
+	}
+}
+
+// queue delivery reminders as they fall due, checking every minute
+func runDeliveryReminders() {
+	for {
+		count, err := util.DefaultNotifier().SendDueReminders(time.Now())
+		if err != nil {
+			log.Println("Failed to send delivery reminders:", err)
+		} else if count > 0 {
+			log.Printf("Sent %d delivery reminders", count)
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -199,7 +199,11 @@ for line in open(DATA_FILE).readlines():
         # Re-map
         delivery_data["schoolId"] = school_id_map[delivery_data["schoolId"]]
         for o in delivery_data["orders"]:
-            if o["vendorId"] != -1:
+            if o["vendorId"] == -1:
+                # The API resolves internal orders to the internal vendor
+                o["vendorId"] = None
+                o["isInternal"] = True
+            else:
                 o["vendorId"] = vendor_id_map[o["vendorId"]]
             if is_past:
                 # Assume all past deliveries were delivered on time